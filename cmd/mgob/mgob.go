@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/spf13/viper"
 
@@ -14,9 +22,13 @@ import (
 	"github.com/urfave/cli"
 
 	"github.com/stefanprodan/mgob/pkg/api"
+	"github.com/stefanprodan/mgob/pkg/archive"
 	"github.com/stefanprodan/mgob/pkg/backup"
 	"github.com/stefanprodan/mgob/pkg/config"
 	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
+	"github.com/stefanprodan/mgob/pkg/redact"
+	"github.com/stefanprodan/mgob/pkg/restore"
 	"github.com/stefanprodan/mgob/pkg/scheduler"
 )
 
@@ -33,6 +45,7 @@ func beforeApp(c *cli.Context) error {
 		log.Fatalf("unable to determine and set log level: %+v", err)
 	}
 	log.SetLevel(level)
+	log.AddHook(redact.Hook{})
 
 	if c.GlobalBool("JSONLog") {
 		// platforms such as Google StackDriver want logs to stdout
@@ -94,6 +107,147 @@ func main() {
 			Usage: "logging threshold level: debug|info|warn|error|fatal|panic",
 			Value: "info",
 		},
+		cli.StringFlag{
+			Name:   "AgeIdentityFile",
+			Usage:  "age identity file used to decrypt ENC[age:...] plan values",
+			EnvVar: "MGOB_AGE_IDENTITY_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "RestoreConfirmation",
+			Usage:  "only allow the restores prepared and confirmed with POST /restores",
+			EnvVar: "MGOB_RESTORE_CONFIRMATION",
+		},
+		cli.StringFlag{
+			Name:   "AuthConfig",
+			Usage:  "yml file with the tokens, users and client certificates allowed to call the HTTP API",
+			EnvVar: "MGOB_AUTH_CONFIG",
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:      "backup",
+			Usage:     "run a backup plan once, with --dry-run only report what would be done",
+			ArgsUsage: "<plan>",
+			Action:    runBackup,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the redacted commands, reachability and retention report without running anything",
+				},
+			},
+		},
+		{
+			Name:      "drill",
+			Usage:     "run the restore drill of a plan once and print its report",
+			ArgsUsage: "<plan>",
+			Action:    runDrill,
+		},
+		{
+			Name:      "restore",
+			Usage:     "restore an archive of a plan, from the local storage or from a destination",
+			ArgsUsage: "<plan> <archive name or destination key>",
+			Action:    runRestore,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "destination",
+					Usage: "destination to download the archive from: sftp|s3|gcloud|azure|rclone, local storage if not set",
+				},
+				cli.StringSliceFlag{
+					Name:  "ns",
+					Usage: "namespace to restore, db.collection with * wildcards, repeatable",
+				},
+				cli.StringSliceFlag{
+					Name:  "ns-map",
+					Usage: "namespace rename rule nsFrom=nsTo, repeatable",
+				},
+				cli.StringFlag{
+					Name:  "target-uri",
+					Usage: "restore into this uri instead of the plan target",
+				},
+				cli.StringFlag{
+					Name:  "target-database",
+					Usage: "restore into this database instead of the plan database",
+				},
+				cli.BoolFlag{
+					Name:  "drop",
+					Usage: "drop the collections before restoring them",
+				},
+				cli.BoolFlag{
+					Name:  "no-index-restore",
+					Usage: "don't restore the indexes",
+				},
+				cli.BoolFlag{
+					Name:  "snapshot",
+					Usage: "dump the restored database of the target to a pinned archive before restoring",
+				},
+				cli.StringFlag{
+					Name:  "profile",
+					Usage: "restore profile of the plan masking the restored data",
+				},
+				cli.StringFlag{
+					Name:  "key-file",
+					Usage: "gpg secret key decrypting the archive",
+				},
+				cli.StringFlag{
+					Name:  "passphrase-file",
+					Usage: "passphrase of the gpg secret key",
+				},
+			},
+		},
+		{
+			Name:      "inspect",
+			Usage:     "list the namespaces, document counts, indexes and options of an archive without restoring it",
+			ArgsUsage: "<plan> <archive name> | --file <archive>",
+			Action:    runInspect,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file",
+					Usage: "archive file to inspect, no plan needed",
+				},
+				cli.StringFlag{
+					Name:  "destination",
+					Usage: "destination to download the archive from: sftp|s3|gcloud|azure|rclone, local storage if not set",
+				},
+				cli.StringFlag{
+					Name:  "key-file",
+					Usage: "gpg secret key decrypting the archive",
+				},
+				cli.StringFlag{
+					Name:  "passphrase-file",
+					Usage: "passphrase of the gpg secret key",
+				},
+			},
+		},
+		{
+			Name:      "cancel",
+			Usage:     "cancel a running job of the mgob server",
+			ArgsUsage: "<job-id>",
+			Action:    cancelJob,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "url",
+					Usage:  "mgob server address, defaults to the Bind and Port flags",
+					EnvVar: "MGOB_URL",
+				},
+				cli.StringFlag{
+					Name:   "token-file",
+					Usage:  "file holding the bearer token sent to the mgob server",
+					EnvVar: "MGOB_TOKEN_FILE",
+				},
+			},
+		},
+		{
+			Name:      "encrypt-value",
+			Usage:     "encrypt a plan value for an age recipient, the value is read from stdin if not given",
+			ArgsUsage: "[value]",
+			Action:    encryptValue,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "recipient,r",
+					Usage: "age recipient public key (age1...)",
+				},
+			},
+		},
 	}
 	app.Run(os.Args)
 }
@@ -105,14 +259,17 @@ func handleErr(err error, message string) {
 }
 
 func loadConfiguration(c *cli.Context) {
-	appConfig.LogLevel = c.String("LogLevel")
-	appConfig.JSONLog = c.Bool("JSONLog")
-	appConfig.Port = c.Int("Port")
-	appConfig.Host = c.String("Bind")
-	appConfig.ConfigPath = c.String("ConfigPath")
-	appConfig.StoragePath = c.String("StoragePath")
-	appConfig.TmpPath = c.String("TmpPath")
-	appConfig.DataPath = c.String("DataPath")
+	appConfig.LogLevel = c.GlobalString("LogLevel")
+	appConfig.JSONLog = c.GlobalBool("JSONLog")
+	appConfig.Port = c.GlobalInt("Port")
+	appConfig.Host = c.GlobalString("Bind")
+	appConfig.ConfigPath = c.GlobalString("ConfigPath")
+	appConfig.StoragePath = c.GlobalString("StoragePath")
+	appConfig.TmpPath = c.GlobalString("TmpPath")
+	appConfig.DataPath = c.GlobalString("DataPath")
+	appConfig.AgeIdentityFile = c.GlobalString("AgeIdentityFile")
+	appConfig.RestoreConfirmation = c.GlobalBool("RestoreConfirmation")
+	appConfig.AuthConfig = c.GlobalString("AuthConfig")
 	appConfig.Version = version
 
 	log.Infof("starting with config: %+v", appConfig)
@@ -120,6 +277,9 @@ func loadConfiguration(c *cli.Context) {
 	err := envconfig.Process(name, modules)
 	handleErr(err, "Error processing environment configuration")
 
+	err = config.LoadAgeIdentities(appConfig.AgeIdentityFile, os.Getenv("MGOB_AGE_IDENTITY"))
+	handleErr(err, "Error loading age identities")
+
 	appConfig.UseAwsCli = true
 	appConfig.HasGpg = true
 }
@@ -142,6 +302,9 @@ func start(c *cli.Context) error {
 	plans, err := config.LoadPlans(appConfig.ConfigPath)
 	handleErr(err, "Failed to load backup plans")
 
+	// Remove the dbpaths of the validation mongods left by a previous crash.
+	backup.SweepEphemeral(appConfig.TmpPath)
+
 	// Open the database store for status information.
 	store, err := db.Open(path.Join(appConfig.DataPath, "mgob.db"))
 	handleErr(err, "Failed to open database store")
@@ -151,15 +314,30 @@ func start(c *cli.Context) error {
 	statusStore, err := db.NewStatusStore(store)
 	handleErr(err, "Failed to create status store")
 
+	// Keep track of the running jobs and the latest finished ones.
+	jobManager := jobs.NewManager(100)
+
 	// Create a new scheduler and start it.
-	sch := scheduler.New(plans, appConfig, modules, statusStore)
+	sch := scheduler.New(plans, appConfig, modules, statusStore, jobManager)
 	sch.Start()
 
+	// Load the credentials of the HTTP API, without them every endpoint is open.
+	var auth *config.Auth
+	if appConfig.AuthConfig != "" {
+		auth, err = config.LoadAuth(appConfig.AuthConfig)
+		handleErr(err, "Failed to load the API authentication")
+	} else {
+		log.Warn("No AuthConfig set, the HTTP API is served without authentication")
+	}
+
 	// Create a new HTTP server and start it in a separate goroutine.
 	server := &api.HttpServer{
 		Config:  appConfig,
 		Modules: modules,
 		Stats:   statusStore,
+		Jobs:    jobManager,
+		Auth:    auth,
+		Labels:  config.PlanLabels(plans),
 	}
 	log.Infof("Starting HTTP server on port %v", appConfig.Port)
 	go server.Start(appConfig.Version)
@@ -211,3 +389,299 @@ func disableConfig(name string) {
 		appConfig.HasGpg = false
 	}
 }
+
+func runBackup(c *cli.Context) error {
+	planID := c.Args().First()
+	if planID == "" {
+		return cli.NewExitError("a plan name is required", 1)
+	}
+
+	loadConfiguration(c)
+
+	plan, err := config.LoadPlan(appConfig.ConfigPath, planID)
+	if err != nil {
+		return cli.NewExitError(redact.Error(err), 1)
+	}
+
+	checkClients()
+
+	// the manifest is skipped when the store is locked by a running server
+	var statusStore *db.StatusStore
+	store, err := db.Open(path.Join(appConfig.DataPath, "mgob.db"))
+	if err != nil {
+		log.Warnf("Backup manifest is not available: %v", err)
+	} else {
+		defer store.Close()
+		statusStore, err = db.NewStatusStore(store)
+		handleErr(err, "Failed to create status store")
+	}
+
+	if c.Bool("dry-run") {
+		report, err := backup.DryRun(plan, appConfig, statusStore)
+		if err != nil {
+			return cli.NewExitError(redact.Error(err), 1)
+		}
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	res, err := backup.Run(plan, appConfig, modules, statusStore)
+	if err != nil {
+		return cli.NewExitError(redact.Error(err), 1)
+	}
+	log.WithField("plan", plan.Name).Infof("Backup finished in %v archive %v size %v",
+		res.Duration, res.Name, humanize.Bytes(uint64(res.Size)))
+	return nil
+}
+
+func runDrill(c *cli.Context) error {
+	planID := c.Args().First()
+	if planID == "" {
+		return cli.NewExitError("a plan name is required", 1)
+	}
+
+	loadConfiguration(c)
+
+	plan, err := config.LoadPlan(appConfig.ConfigPath, planID)
+	if err != nil {
+		return cli.NewExitError(redact.Error(err), 1)
+	}
+
+	checkClients()
+
+	// the report is not stored when the store is locked by a running server
+	var statusStore *db.StatusStore
+	store, err := db.Open(path.Join(appConfig.DataPath, "mgob.db"))
+	if err != nil {
+		log.Warnf("Backup manifest is not available: %v", err)
+	} else {
+		defer store.Close()
+		statusStore, err = db.NewStatusStore(store)
+		handleErr(err, "Failed to create status store")
+	}
+
+	report, drillErr := backup.Drill(context.Background(), plan, appConfig, statusStore)
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println(string(out))
+	if drillErr != nil {
+		return cli.NewExitError(redact.Error(drillErr), 1)
+	}
+	return nil
+}
+
+func runRestore(c *cli.Context) error {
+	planID := c.Args().Get(0)
+	key := c.Args().Get(1)
+	if planID == "" || key == "" {
+		return cli.NewExitError("a plan name and an archive are required", 1)
+	}
+
+	loadConfiguration(c)
+
+	plan, err := config.LoadPlan(appConfig.ConfigPath, planID)
+	if err != nil {
+		return cli.NewExitError(redact.Error(err), 1)
+	}
+
+	opts := restore.Options{
+		Namespaces:     c.StringSlice("ns"),
+		Drop:           c.Bool("drop"),
+		NoIndexRestore: c.Bool("no-index-restore"),
+		Snapshot:       c.Bool("snapshot"),
+		Profile:        c.String("profile"),
+	}
+	for _, rule := range c.StringSlice("ns-map") {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return cli.NewExitError(fmt.Sprintf("invalid ns-map rule %v, expected nsFrom=nsTo", rule), 1)
+		}
+		opts.NsMap = append(opts.NsMap, restore.NsRule{From: parts[0], To: parts[1]})
+	}
+	if c.String("target-uri") != "" || c.String("target-database") != "" {
+		target := plan.Target
+		if c.String("target-uri") != "" {
+			target = config.Target{Uri: c.String("target-uri")}
+		}
+		if c.String("target-database") != "" {
+			target.Database = c.String("target-database")
+		}
+		opts.Target = &target
+	}
+
+	var statusStore *db.StatusStore
+	store, err := db.Open(path.Join(appConfig.DataPath, "mgob.db"))
+	if err != nil {
+		log.Warnf("Backup manifest is not available: %v", err)
+	} else {
+		defer store.Close()
+		statusStore, err = db.NewStatusStore(store)
+		handleErr(err, "Failed to create status store")
+	}
+
+	var res restore.Result
+	if c.String("destination") == "" {
+		var archive string
+		if archive, err = backup.LocalArchivePath(plan, appConfig, statusStore, key); err != nil {
+			return cli.NewExitError(redact.Error(err), 1)
+		}
+		res, err = restore.Run(plan, appConfig, modules, statusStore, archive, opts)
+	} else {
+		res, err = restore.RunFrom(plan, appConfig, modules, statusStore, restore.Source{
+			Destination: c.String("destination"),
+			Key:         key,
+			FetchOptions: backup.FetchOptions{
+				KeyFile:        c.String("key-file"),
+				PassphraseFile: c.String("passphrase-file"),
+			},
+			Options: opts,
+		})
+	}
+	if err != nil {
+		return cli.NewExitError(redact.Error(err), 1)
+	}
+
+	out, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func runInspect(c *cli.Context) error {
+	file := c.String("file")
+	if file == "" {
+		planID := c.Args().Get(0)
+		name := c.Args().Get(1)
+		if planID == "" || name == "" {
+			return cli.NewExitError("a plan name and an archive, or --file, are required", 1)
+		}
+
+		loadConfiguration(c)
+
+		plan, err := config.LoadPlan(appConfig.ConfigPath, planID)
+		if err != nil {
+			return cli.NewExitError(redact.Error(err), 1)
+		}
+
+		var statusStore *db.StatusStore
+		store, err := db.Open(path.Join(appConfig.DataPath, "mgob.db"))
+		if err != nil {
+			log.Warnf("Backup manifest is not available: %v", err)
+		} else {
+			defer store.Close()
+			statusStore, err = db.NewStatusStore(store)
+			handleErr(err, "Failed to create status store")
+		}
+
+		destination := c.String("destination")
+		if destination == "" {
+			destination = "local"
+		}
+		dest, err := backup.GetDestination(plan, appConfig, destination)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		key, err := backup.DestinationKey(plan, statusStore, destination, name)
+		if err != nil {
+			return cli.NewExitError(redact.Error(err), 1)
+		}
+
+		var cleanup func()
+		file, cleanup, err = backup.FetchArchive(context.Background(), plan, appConfig, statusStore, dest, key, backup.FetchOptions{
+			KeyFile:        c.String("key-file"),
+			PassphraseFile: c.String("passphrase-file"),
+		})
+		defer cleanup()
+		if err != nil {
+			return cli.NewExitError(redact.Error(err), 1)
+		}
+	}
+
+	contents, err := archive.ReadFile(file)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	out, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func cancelJob(c *cli.Context) error {
+	id := c.Args().First()
+	if id == "" {
+		return cli.NewExitError("a job id is required", 1)
+	}
+
+	server := c.String("url")
+	if server == "" {
+		host := c.GlobalString("Bind")
+		if host == "" || host == "0.0.0.0" {
+			host = "127.0.0.1"
+		}
+		server = fmt.Sprintf("http://%v:%v", host, c.GlobalInt("Port"))
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, strings.TrimSuffix(server, "/")+"/jobs/"+url.PathEscape(id), nil)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if file := c.String("token-file"); file != "" {
+		token, err := os.ReadFile(file)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("reading token file %v failed: %v", file, err), 1)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("cancelling job %v failed: %v", id, err), 1)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("cancelling job %v failed: %v", id, err), 1)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return cli.NewExitError(fmt.Sprintf("cancelling job %v failed: %v %v", id, resp.Status, strings.TrimSpace(string(body))), 1)
+	}
+	fmt.Println(strings.TrimSpace(string(body)))
+	return nil
+}
+
+func encryptValue(c *cli.Context) error {
+	recipient := c.String("recipient")
+	if recipient == "" {
+		return cli.NewExitError("an age recipient is required, use --recipient", 1)
+	}
+
+	value := c.Args().First()
+	if value == "" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("reading value from stdin failed: %v", err), 1)
+		}
+		value = strings.TrimRight(string(data), "\r\n")
+	}
+
+	encrypted, err := config.EncryptValue(value, recipient)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	fmt.Println(encrypted)
+	return nil
+}
@@ -0,0 +1,319 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
+	"github.com/stefanprodan/mgob/pkg/restore"
+)
+
+// principal is the authenticated caller of a request, Method is token, basic or certificate
+type principal struct {
+	Name       string
+	Method     string
+	Roles      []config.Grant
+	planLabels map[string]map[string]string
+}
+
+// can tells if the caller has role on a plan, or on every plan when plan is empty
+func (p principal) can(role string, plan string) bool {
+	labels := func() map[string]string {
+		return p.planLabels[plan]
+	}
+	for _, grant := range p.Roles {
+		if grant.Allows(role, plan, labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAny tells if the caller has role on at least one plan
+func (p principal) canAny(role string) bool {
+	for _, grant := range p.Roles {
+		if grant.Has(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// dummyHash is compared with the password of the unknown users, so they take as long as the known ones
+var dummyHash = []byte("$2a$10$voRLnH3.V5ZpfR3K9XZ6Z..LplfI8sI/IPcqsdafUpIJ3ybPz.74C")
+
+// authCtx rejects the requests outside of the allow list that don't carry valid credentials,
+// the caller and its roles are stored in the request context. The label scoped roles are checked
+// against the labels of the plans loaded at startup.
+func authCtx(auth *config.Auth, planLabels map[string]map[string]string) func(next http.Handler) http.Handler {
+	tokens := make(map[string][32]byte, len(auth.Tokens))
+	for _, token := range auth.Tokens {
+		tokens[token.Name] = sha256.Sum256([]byte(token.Token))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !canonical(r.URL.Path) {
+				// the router serves the raw path, it would not match the route the checks are made for
+				log.WithFields(log.Fields{
+					"remote": r.RemoteAddr,
+					"path":   r.URL.Path,
+				}).Warn("Non canonical API request rejected")
+				render.Status(r, 400)
+				render.JSON(w, r, map[string]string{"error": "invalid path"})
+				return
+			}
+			if auth.Allowed(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			p, ok := authenticate(auth, tokens, r)
+			if !ok {
+				log.WithFields(log.Fields{
+					"remote": r.RemoteAddr,
+					"path":   r.URL.Path,
+				}).Warn("Unauthenticated API request rejected")
+				w.Header().Add("WWW-Authenticate", `Bearer realm="mgob"`)
+				if len(auth.Users) > 0 {
+					w.Header().Add("WWW-Authenticate", `Basic realm="mgob"`)
+				}
+				render.Status(r, 401)
+				render.JSON(w, r, map[string]string{"error": "authentication required"})
+				return
+			}
+
+			p.planLabels = planLabels
+			r = r.WithContext(context.WithValue(r.Context(), "app.principal", p))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// canonical tells if a path has no dot segments nor repeated slashes, a trailing slash is kept
+func canonical(p string) bool {
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean == p
+}
+
+// authenticate checks the Authorization header, or without it the verified client certificate
+func authenticate(auth *config.Auth, tokens map[string][32]byte, r *http.Request) (principal, bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return certificatePrincipal(auth, r)
+	}
+
+	if scheme, credentials, found := strings.Cut(header, " "); found && strings.EqualFold(scheme, "Bearer") {
+		sum := sha256.Sum256([]byte(strings.TrimSpace(credentials)))
+		match, ok := config.Token{}, false
+		for _, token := range auth.Tokens {
+			digest := tokens[token.Name]
+			if subtle.ConstantTimeCompare(sum[:], digest[:]) == 1 {
+				match, ok = token, true
+			}
+		}
+		return principal{Name: match.Name, Method: "token", Roles: match.Roles}, ok
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return principal{}, false
+	}
+	hash := dummyHash
+	var match *config.User
+	for i := range auth.Users {
+		if auth.Users[i].Username == username {
+			match, hash = &auth.Users[i], []byte(auth.Users[i].PasswordHash)
+			break
+		}
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || match == nil {
+		return principal{}, false
+	}
+	return principal{Name: username, Method: "basic", Roles: match.Roles}, true
+}
+
+func certificatePrincipal(auth *config.Auth, r *http.Request) (principal, bool) {
+	if auth.TLS == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return principal{}, false
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return principal{}, false
+	}
+	if len(auth.TLS.Clients) == 0 {
+		return principal{Name: name, Method: "certificate", Roles: config.AdminRoles}, true
+	}
+	for _, client := range auth.TLS.Clients {
+		if client.Name == name {
+			return principal{Name: name, Method: "certificate", Roles: client.Roles}, true
+		}
+	}
+	return principal{}, false
+}
+
+// authorize rejects the callers without role on the plan found by planOf, an empty plan needs
+// the role on every plan. Without planOf the role on any plan is enough and the handler filters
+// what it returns with visible.
+func authorize(role string, planOf func(r *http.Request) string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := r.Context().Value("app.principal").(principal)
+			if !ok {
+				// the API is open or the path is allowed
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			plan := ""
+			allowed := false
+			if planOf == nil {
+				allowed = p.canAny(role)
+			} else {
+				plan = planOf(r)
+				allowed = p.can(role, plan)
+			}
+			if !allowed {
+				scope := "every plan"
+				if plan != "" {
+					scope = "plan " + plan
+				}
+				log.WithFields(log.Fields{
+					"plan":   plan,
+					"user":   p.Name,
+					"remote": r.RemoteAddr,
+					"path":   r.URL.Path,
+				}).Warn("Unauthorized API request rejected")
+				render.Status(r, 403)
+				render.JSON(w, r, map[string]string{"error": fmt.Sprintf("%v needs the %v role on %v", p.Name, role, scope)})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// visible tells if the caller can read a plan, for the handlers listing several plans
+func visible(r *http.Request, plan string) bool {
+	p, ok := r.Context().Value("app.principal").(principal)
+	return !ok || p.can(config.RoleViewer, plan)
+}
+
+// allPlans is for the endpoints reaching every plan, such as the profiler and the audit log
+func allPlans(r *http.Request) string {
+	return ""
+}
+
+func urlPlan(r *http.Request) string {
+	return chi.URLParam(r, "planID")
+}
+
+// storagePlan is the plan of a file served from /storage: the plan dir of the legacy archives and logs,
+// or the manifest entry of the templated layouts and snapshots. The storage root, the directories and the
+// other files belong to no plan, they need the role on every plan.
+func storagePlan(store *db.StatusStore) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		key, ok := strings.CutPrefix(path.Clean(r.URL.Path), "/storage/")
+		if !ok || strings.HasSuffix(r.URL.Path, "/") {
+			return ""
+		}
+		dir, name := path.Split(key)
+		dir = strings.TrimSuffix(dir, "/")
+
+		legacy := config.Plan{Name: dir}
+		if backup.CheckKey(legacy, nil, "local", key) == nil || isPlanLog(legacy.Name, name) {
+			return legacy.Name
+		}
+
+		if store == nil {
+			return ""
+		}
+		archives, err := store.GetAllArchives()
+		if err != nil {
+			log.Errorf("Manifest lookup of %v failed %v", key, err)
+			return ""
+		}
+		for _, archive := range archives {
+			if archive.Key == key {
+				return archive.Plan
+			}
+		}
+		// the log of a templated layout is copied next to the archive
+		for _, archive := range archives {
+			if archive.Key != "" && path.Dir(archive.Key) == dir && isPlanLog(archive.Plan, name) {
+				return archive.Plan
+			}
+		}
+		return ""
+	}
+}
+
+var planLogRegex = regexp.MustCompile(`^\d+\.log$`)
+
+// isPlanLog matches the mongodump logs of a plan, like plan-1494056760.log
+func isPlanLog(plan string, name string) bool {
+	ts, ok := strings.CutPrefix(name, plan+"-")
+	return ok && planLogRegex.MatchString(ts)
+}
+
+func jobPlan(manager *jobs.Manager) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if job, ok := manager.Get(chi.URLParam(r, "id")); ok {
+			return job.Info().Plan
+		}
+		return ""
+	}
+}
+
+// requestPlan reads the plan of a restore request, the body is put back for the handler
+func requestPlan(r *http.Request) string {
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, 1<<20))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	var req restore.Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		return ""
+	}
+	return req.Plan
+}
+
+func pendingPlan(pending *restore.Pending) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		plan, _ := pending.Plan(chi.URLParam(r, "token"))
+		return plan
+	}
+}
+
+// principalName is the authenticated caller of a request, empty when the API is open
+func principalName(r *http.Request) string {
+	if p, ok := r.Context().Value("app.principal").(principal); ok {
+		return p.Name
+	}
+	return ""
+}
+
+func getHealth(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, map[string]string{"status": "ok"})
+}
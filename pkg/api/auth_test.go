@@ -0,0 +1,313 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
+)
+
+const testToken = "0123456789abcdef0123"
+
+func testAuth(t *testing.T) *config.Auth {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	return &config.Auth{
+		Tokens: []config.Token{{Name: "ci", Token: testToken, Roles: config.AdminRoles}},
+		Users:  []config.User{{Username: "ops", PasswordHash: string(hash), Roles: config.AdminRoles}},
+		TLS: &config.TLS{
+			Clients: []config.Client{{Name: "backup-bot", Roles: config.AdminRoles}},
+		},
+		Allow: config.DefaultAllow,
+	}
+}
+
+func serve(router http.Handler, method string, target string, prepare func(r *http.Request)) *httptest.ResponseRecorder {
+	return serveBody(router, method, target, "", prepare)
+}
+
+func serveBody(router http.Handler, method string, target string, body string, prepare func(r *http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if prepare != nil {
+		prepare(req)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func basic(username string, password string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.SetBasicAuth(username, password)
+	}
+}
+
+func certificate(name string) func(r *http.Request) {
+	return func(r *http.Request) {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+		r.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}
+	}
+}
+
+func Test_authCtx(t *testing.T) {
+	router := chi.NewRouter()
+	router.Use(authCtx(testAuth(t), nil))
+	router.Get("/health", getHealth)
+	router.HandleFunc("/*", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(principalName(r)))
+	})
+
+	tests := []struct {
+		name    string
+		target  string
+		prepare func(r *http.Request)
+		status  int
+		user    string
+	}{
+		{"no credentials", "/status", nil, 401, ""},
+		{"token", "/status", bearer(testToken), 200, "ci"},
+		{"bad token", "/status", bearer("0123456789abcdef0124"), 401, ""},
+		{"empty token", "/status", bearer(""), 401, ""},
+		{"basic", "/status", basic("ops", "secret"), 200, "ops"},
+		{"bad password", "/status", basic("ops", "wrong"), 401, ""},
+		{"unknown user", "/status", basic("root", "secret"), 401, ""},
+		{"certificate", "/status", certificate("backup-bot"), 200, "backup-bot"},
+		{"unknown certificate", "/status", certificate("other"), 401, ""},
+		{"header before certificate", "/status", func(r *http.Request) {
+			certificate("backup-bot")(r)
+			bearer("wrong")(r)
+		}, 401, ""},
+		{"allowed path", "/health", nil, 200, ""},
+		{"allowed prefix only", "/healthz", nil, 401, ""},
+		{"path traversal", "/metrics/../restore/plan", nil, 400, ""},
+		{"path traversal to an allowed path", "/storage/../metrics/x", nil, 400, ""},
+		{"repeated slash", "/metrics//x", nil, 400, ""},
+		{"trailing slash", "/metrics/", nil, 200, ""},
+	}
+	for _, test := range tests {
+		w := serve(router, http.MethodGet, test.target, test.prepare)
+		assert.Equal(t, test.status, w.Code, test.name)
+		if test.status == 401 {
+			assert.Contains(t, w.Header().Values("WWW-Authenticate"), `Bearer realm="mgob"`, test.name)
+			assert.Contains(t, w.Body.String(), "authentication required", test.name)
+		} else if test.user != "" {
+			assert.Equal(t, test.user, w.Body.String(), test.name)
+		}
+	}
+}
+
+func Test_authCtx_anyCertificate(t *testing.T) {
+	auth := testAuth(t)
+	auth.TLS.Clients = nil
+
+	router := chi.NewRouter()
+	router.Use(authCtx(auth, nil))
+	router.Get("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(principalName(r)))
+	})
+
+	w := serve(router, http.MethodGet, "/status", certificate("any-client"))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "any-client", w.Body.String())
+
+	w = serve(router, http.MethodGet, "/status", func(r *http.Request) {
+		// a certificate that did not verify against the client CA
+		r.TLS = &tls.ConnectionState{}
+	})
+	assert.Equal(t, 401, w.Code)
+}
+
+func testServer(t *testing.T) *HttpServer {
+	dir := t.TempDir()
+	storage := filepath.Join(dir, "storage")
+	for _, plan := range []string{"orders", "users"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(storage, plan), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(storage, plan, plan+"-1494056760.gz"), []byte("archive"), 0644))
+	}
+
+	store, err := db.Open(filepath.Join(dir, "mgob.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	statusStore, err := db.NewStatusStore(store)
+	assert.NoError(t, err)
+
+	auth := testAuth(t)
+	token := func(name string, roles ...config.Grant) config.Token {
+		return config.Token{Name: name, Token: name + "-0123456789abcdef", Roles: roles}
+	}
+	auth.Tokens = append(auth.Tokens,
+		token("operator", config.Grant{Role: config.RoleOperator, Plans: []string{"orders"}}),
+		token("admin", config.Grant{Role: config.RoleAdmin, Plans: []string{"orders"}}),
+		token("viewer", config.Grant{Role: config.RoleViewer, Labels: map[string]string{"env": "staging"}}),
+	)
+
+	return &HttpServer{
+		Config:  &config.AppConfig{ConfigPath: dir, StoragePath: storage, TmpPath: dir},
+		Modules: &config.ModuleConfig{},
+		Stats:   statusStore,
+		Jobs:    jobs.NewManager(10),
+		Auth:    auth,
+		Labels: map[string]map[string]string{
+			"orders": {"env": "production"},
+			"users":  {"env": "staging"},
+		},
+	}
+}
+
+func Test_authorize(t *testing.T) {
+	s := testServer(t)
+	router := s.router("test")
+	ordersJob := s.Jobs.Start("backup", "orders", "api")
+	usersJob := s.Jobs.Start("backup", "users", "api")
+	defer ordersJob.Finish(nil, nil)
+	defer usersJob.Finish(nil, nil)
+
+	tests := []struct {
+		name    string
+		token   string
+		method  string
+		target  string
+		allowed bool
+	}{
+		{"operator backup of its plan", "operator", "POST", "/backup/orders", true},
+		{"operator backup of another plan", "operator", "POST", "/backup/users", false},
+		{"operator restore of its plan", "operator", "POST", "/restore/orders", false},
+		{"operator job of its plan", "operator", "GET", "/jobs/" + ordersJob.ID(), true},
+		{"operator job of another plan", "operator", "GET", "/jobs/" + usersJob.ID(), false},
+		{"operator job logs of another plan", "operator", "GET", "/jobs/" + usersJob.ID() + "/logs", false},
+		{"operator cancel of another plan", "operator", "DELETE", "/jobs/" + usersJob.ID(), false},
+		{"operator storage of its plan", "operator", "GET", "/storage/orders/orders-1494056760.gz", false},
+		{"admin storage of its plan", "admin", "GET", "/storage/orders/orders-1494056760.gz", true},
+		{"admin storage of another plan", "admin", "GET", "/storage/users/users-1494056760.gz", false},
+		{"admin storage root", "admin", "GET", "/storage/", false},
+		{"scoped admin profiler", "admin", "GET", "/debug/pprof/", false},
+		{"scoped admin audit", "admin", "GET", "/audit", false},
+		{"unscoped admin profiler", "ci", "GET", "/debug/pprof/", true},
+		{"unscoped admin storage root", "ci", "GET", "/storage/", true},
+		{"viewer status of a labelled plan", "viewer", "GET", "/status/users", true},
+		{"viewer status of another plan", "viewer", "GET", "/status/orders", false},
+		{"viewer backup of a labelled plan", "viewer", "POST", "/backup/users", false},
+		{"viewer metrics", "viewer", "GET", "/metrics", true},
+	}
+	for _, test := range tests {
+		tokenValue := test.token + "-0123456789abcdef"
+		if test.token == "ci" {
+			tokenValue = testToken
+		}
+		w := serve(router, test.method, test.target, bearer(tokenValue))
+		if test.allowed {
+			assert.NotEqual(t, 403, w.Code, test.name)
+			assert.NotEqual(t, 401, w.Code, test.name)
+		} else {
+			assert.Equal(t, 403, w.Code, test.name)
+		}
+	}
+
+	// the traversals are rejected before the authorization
+	w := serve(router, "GET", "/storage/orders/../users/users-1494056760.gz", bearer("admin-0123456789abcdef"))
+	assert.Equal(t, 400, w.Code)
+}
+
+func Test_authorize_lists(t *testing.T) {
+	s := testServer(t)
+	router := s.router("test")
+	ordersJob := s.Jobs.Start("backup", "orders", "api")
+	usersJob := s.Jobs.Start("backup", "users", "api")
+	defer ordersJob.Finish(nil, nil)
+	defer usersJob.Finish(nil, nil)
+
+	w := serve(router, "GET", "/jobs", bearer("operator-0123456789abcdef"))
+	assert.Equal(t, 200, w.Code)
+	var list []jobs.Info
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, "orders", list[0].Plan)
+	}
+
+	w = serve(router, "GET", "/jobs", bearer(testToken))
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list, 2)
+}
+
+func Test_authorize_restoreRequest(t *testing.T) {
+	router := testServer(t).router("test")
+
+	w := serveBody(router, "POST", "/restores", `{"plan":"users","key":"users-1494056760.gz"}`, bearer("admin-0123456789abcdef"))
+	assert.Equal(t, 403, w.Code)
+
+	// the handler reads the body after the middleware, the plan is then not found in the config dir
+	w = serveBody(router, "POST", "/restores", `{"plan":"orders","key":"orders-1494056760.gz"}`, bearer("admin-0123456789abcdef"))
+	assert.Equal(t, 404, w.Code)
+	assert.NotContains(t, w.Body.String(), "invalid restore request")
+	assert.Contains(t, w.Body.String(), "orders")
+
+	w = serveBody(router, "POST", "/restores", `{"plan":`, bearer("admin-0123456789abcdef"))
+	assert.Equal(t, 403, w.Code)
+	w = serveBody(router, "POST", "/restores", `{"plan":`, bearer(testToken))
+	assert.Equal(t, 400, w.Code)
+}
+
+func Test_authorize_storage(t *testing.T) {
+	s := testServer(t)
+	router := s.router("test")
+
+	// a templated layout of plan users writes in the orders dir
+	assert.NoError(t, os.MkdirAll(filepath.Join(s.Config.StoragePath, "orders", "2023"), 0755))
+	for _, file := range []string{"orders/2023/backup.gz", "orders/2023/users-1494056760.log", "orders/2023/other.gz"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(s.Config.StoragePath, filepath.FromSlash(file)), []byte("archive"), 0644))
+	}
+	assert.NoError(t, s.Stats.PutArchive(&db.Archive{Plan: "users", Name: "backup.gz", Key: "orders/2023/backup.gz"}))
+
+	tests := []struct {
+		name    string
+		target  string
+		allowed bool
+	}{
+		{"legacy archive of its plan", "/storage/orders/orders-1494056760.gz", true},
+		{"templated archive of another plan", "/storage/orders/2023/backup.gz", false},
+		{"templated log of another plan", "/storage/orders/2023/users-1494056760.log", false},
+		{"file of no plan", "/storage/orders/2023/other.gz", false},
+		{"plan dir", "/storage/orders/", false},
+	}
+	for _, test := range tests {
+		w := serve(router, "GET", test.target, bearer("admin-0123456789abcdef"))
+		if test.allowed {
+			assert.Equal(t, 200, w.Code, test.name)
+		} else {
+			assert.Equal(t, 403, w.Code, test.name)
+		}
+	}
+
+	// the plan of the templated archive reaches it
+	users := config.Token{Name: "users-admin", Token: "users-admin-0123456789abcdef",
+		Roles: []config.Grant{{Role: config.RoleAdmin, Plans: []string{"users"}}}}
+	s.Auth.Tokens = append(s.Auth.Tokens, users)
+	router = s.router("test")
+	for _, target := range []string{"/storage/orders/2023/backup.gz", "/storage/orders/2023/users-1494056760.log"} {
+		w := serve(router, "GET", target, bearer(users.Token))
+		assert.Equal(t, 200, w.Code, target)
+	}
+}
@@ -12,32 +12,50 @@ import (
 
 	"github.com/stefanprodan/mgob/pkg/backup"
 	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
 	"github.com/stefanprodan/mgob/pkg/notifier"
+	"github.com/stefanprodan/mgob/pkg/redact"
 )
 
 func postBackup(w http.ResponseWriter, r *http.Request) {
 	cfg := r.Context().Value("app.config").(config.AppConfig)
 	modules := r.Context().Value("app.modules").(config.ModuleConfig)
+	store := r.Context().Value("app.store").(*db.StatusStore)
 	planID := chi.URLParam(r, "planID")
 	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
 	if err != nil {
 		render.Status(r, 500)
-		render.JSON(w, r, map[string]string{"error": err.Error()})
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
 		return
 	}
 
-	log.WithField("plan", planID).Info("On demand backup started")
+	if r.URL.Query().Get("dryRun") == "true" {
+		report, err := backup.DryRun(plan, &cfg, store)
+		if err != nil {
+			log.WithField("plan", planID).Errorf("On demand dry run failed %v", err)
+			render.Status(r, 500)
+			render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+			return
+		}
+		log.WithField("plan", planID).Info("On demand dry run finished")
+		render.JSON(w, r, report)
+		return
+	}
 
-	res, err := backup.Run(plan, &cfg, &modules)
-	if err != nil {
-		log.WithField("plan", planID).Errorf("On demand backup failed %v", err)
-		if err := notifier.SendNotification(fmt.Sprintf("BACKUP FAILED: %v on demand backup failed", planID),
-			err.Error(), true, plan); err != nil {
-			log.WithField("plan", plan.Name).Errorf("Notifier failed for on demand backup %v", err)
+	startJob(w, r, "backup", plan.Name, func(job *jobs.Job) (interface{}, error) {
+		log.WithField("plan", planID).Infof("On demand backup started as job %v", job.ID())
+
+		res, err := backup.RunJob(plan, &cfg, &modules, store, job)
+		if err != nil {
+			log.WithField("plan", planID).Errorf("On demand backup failed %v", err)
+			if err := notifier.SendNotification(fmt.Sprintf("BACKUP FAILED: %v on demand backup failed", planID),
+				err.Error(), true, plan); err != nil {
+				log.WithField("plan", plan.Name).Errorf("Notifier failed for on demand backup %v", err)
+			}
+			return nil, err
 		}
-		render.Status(r, 500)
-		render.JSON(w, r, map[string]string{"error": err.Error()})
-	} else {
+
 		log.WithField("plan", plan.Name).Infof("On demand backup finished in %v archive %v size %v",
 			res.Duration, res.Name, humanize.Bytes(uint64(res.Size)))
 		if err := notifier.SendNotification(fmt.Sprintf("%v on demand backup finished", plan.Name),
@@ -46,8 +64,8 @@ func postBackup(w http.ResponseWriter, r *http.Request) {
 			false, plan); err != nil {
 			log.WithField("plan", plan.Name).Errorf("Notifier failed for on demand backup %v", err)
 		}
-		render.JSON(w, r, toBackupResult(res))
-	}
+		return toBackupResult(res), nil
+	})
 }
 
 type backupResult struct {
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/archive"
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+type destinationBackups struct {
+	Destination string                 `json:"destination"`
+	Archives    []backup.RemoteArchive `json:"archives"`
+	Error       string                 `json:"error,omitempty"`
+}
+
+func getBackups(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	store := r.Context().Value("app.store").(*db.StatusStore)
+	planID := chi.URLParam(r, "planID")
+	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	destinations := backup.Destinations(plan, &cfg)
+	if name := r.URL.Query().Get("destination"); name != "" {
+		dest, err := backup.GetDestination(plan, &cfg, name)
+		if err != nil {
+			render.Status(r, 404)
+			render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+			return
+		}
+		destinations = []backup.Destination{dest}
+	}
+
+	result := make([]destinationBackups, 0, len(destinations))
+	for _, dest := range destinations {
+		item := destinationBackups{Destination: dest.Name(), Archives: make([]backup.RemoteArchive, 0)}
+		archives, err := backup.ListArchives(plan, store, dest)
+		if err != nil {
+			log.WithField("plan", planID).Errorf("Listing backups on %v failed %v", dest.Name(), err)
+			item.Error = redact.Error(err)
+		} else {
+			item.Archives = archives
+		}
+		result = append(result, item)
+	}
+
+	render.JSON(w, r, result)
+}
+
+func getBackupContents(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	store := r.Context().Value("app.store").(*db.StatusStore)
+	planID := chi.URLParam(r, "planID")
+	name := chi.URLParam(r, "name")
+	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	destination := r.URL.Query().Get("destination")
+	if destination == "" {
+		destination = "local"
+	}
+	dest, err := backup.GetDestination(plan, &cfg, destination)
+	if err != nil {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	key, err := backup.DestinationKey(plan, store, destination, name)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	if err := backup.CheckKey(plan, store, destination, key); err != nil {
+		render.Status(r, keyStatus(err, 500))
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	file, cleanup, err := backup.FetchArchive(r.Context(), plan, &cfg, store, dest, key, backup.FetchOptions{})
+	defer cleanup()
+	if err != nil {
+		log.WithField("plan", planID).Errorf("Fetching %v from %v failed %v", key, destination, err)
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	contents, err := archive.ReadFile(file)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+	render.JSON(w, r, contents)
+}
+
+func getBackupValidation(w http.ResponseWriter, r *http.Request) {
+	store := r.Context().Value("app.store").(*db.StatusStore)
+	planID := chi.URLParam(r, "planID")
+	name := chi.URLParam(r, "name")
+
+	var manifest *db.Archive
+	if store != nil {
+		var err error
+		if manifest, err = store.GetArchive(planID, name); err != nil {
+			render.Status(r, 500)
+			render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+			return
+		}
+	}
+	if manifest == nil || manifest.Validation == nil {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": fmt.Sprintf("no validation report for %v/%v", planID, name)})
+		return
+	}
+	render.JSON(w, r, manifest.Validation)
+}
+
+// keyStatus is the status of a rejected archive key, 403 for the archives of another plan
+func keyStatus(err error, fallback int) int {
+	var invalidErr *backup.InvalidKeyError
+	var foreignErr *backup.ForeignKeyError
+	switch {
+	case errors.As(err, &foreignErr):
+		return 403
+	case errors.As(err, &invalidErr):
+		return 400
+	}
+	return fallback
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+func Test_getBackups_redactedError(t *testing.T) {
+	s := testServer(t)
+	assert.NoError(t, os.WriteFile(filepath.Join(s.Config.ConfigPath, "orders.yml"), []byte("target:\n  host: localhost\n"), 0644))
+	redact.Add("s3cr3t-destination")
+
+	w := serve(s.router("test"), "GET", "/backups/orders?destination=s3cr3t-destination", bearer(testToken))
+	assert.Equal(t, 404, w.Code)
+	assert.Contains(t, w.Body.String(), "is not configured for plan orders")
+	assert.NotContains(t, w.Body.String(), "s3cr3t-destination")
+}
+
+func Test_postRestoreFrom_foreignKey(t *testing.T) {
+	s := testServer(t)
+	assert.NoError(t, os.WriteFile(filepath.Join(s.Config.ConfigPath, "orders.yml"), []byte("target:\n  host: localhost\n"), 0644))
+	router := s.router("test")
+
+	w := serveBody(router, "POST", "/restore/orders", `{"destination":"local","key":"users/users-1494056760.gz"}`, bearer("admin-0123456789abcdef"))
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), "is not an archive of plan orders")
+
+	w = serveBody(router, "POST", "/restore/orders", `{"destination":"local","key":"../users/users-1494056760.gz"}`, bearer("admin-0123456789abcdef"))
+	assert.Equal(t, 400, w.Code)
+}
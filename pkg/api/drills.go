@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/notifier"
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+func postDrill(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	store := r.Context().Value("app.store").(*db.StatusStore)
+	planID := chi.URLParam(r, "planID")
+	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	log.WithField("plan", planID).Info("On demand restore drill started")
+	report, err := backup.Drill(context.Background(), plan, &cfg, store)
+	if err != nil {
+		log.WithField("plan", planID).Errorf("On demand restore drill failed %v", redact.Error(err))
+		if err := notifier.SendNotification(fmt.Sprintf("DRILL FAILED: %v on demand restore drill failed", planID),
+			backup.DrillSummary(report), true, plan); err != nil {
+			log.WithField("plan", planID).Errorf("Notifier failed for on demand drill %v", err)
+		}
+		render.Status(r, 500)
+	} else {
+		log.WithField("plan", planID).Infof("On demand restore drill of %v passed, time to restore %v",
+			report.Archive, report.TimeToRestore)
+	}
+	render.JSON(w, r, report)
+}
+
+func getDrills(w http.ResponseWriter, r *http.Request) {
+	store := r.Context().Value("app.store").(*db.StatusStore)
+	planID := chi.URLParam(r, "planID")
+
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			render.Status(r, 400)
+			render.JSON(w, r, map[string]string{"error": fmt.Sprintf("invalid limit %v", l)})
+			return
+		}
+	}
+
+	drills, err := store.GetDrills(planID, limit)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+	render.JSON(w, r, drills)
+}
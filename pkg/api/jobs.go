@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/jobs"
+)
+
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	manager := r.Context().Value("app.jobs").(*jobs.Manager)
+	result := make([]jobs.Info, 0)
+	for _, info := range manager.List() {
+		if visible(r, info.Plan) {
+			result = append(result, info)
+		}
+	}
+	render.JSON(w, r, result)
+}
+
+func getJob(w http.ResponseWriter, r *http.Request) {
+	manager := r.Context().Value("app.jobs").(*jobs.Manager)
+	id := chi.URLParam(r, "id")
+
+	job, ok := manager.Get(id)
+	if !ok {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "job " + id + " not found"})
+		return
+	}
+	render.JSON(w, r, job.Info())
+}
+
+// getJobLogs returns the job log as text, or streams it as server-sent events, one event per line,
+// when the client accepts text/event-stream. The stream ends with an end event once the job has finished.
+func getJobLogs(w http.ResponseWriter, r *http.Request) {
+	manager := r.Context().Value("app.jobs").(*jobs.Manager)
+	id := chi.URLParam(r, "id")
+
+	job, ok := manager.Get(id)
+	if !ok {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "job " + id + " not found"})
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		data, _, _, _ := job.Log(0)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(data)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": "streaming is not supported"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	// a reconnecting client resumes after the last line it got
+	var offset int64
+	if last, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		offset = last
+	}
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		data, end, wait, finished := job.Log(offset)
+		// the lines dropped from a long log are skipped
+		offset = end - int64(len(data))
+		for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			offset += int64(len(line))
+			fmt.Fprintf(w, "id: %v\ndata: %s\n\n", offset, bytes.TrimRight(line, "\r\n"))
+		}
+		if finished {
+			fmt.Fprintf(w, "event: end\ndata: %v\n\n", job.Info().State)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-wait:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func deleteJob(w http.ResponseWriter, r *http.Request) {
+	manager := r.Context().Value("app.jobs").(*jobs.Manager)
+	id := chi.URLParam(r, "id")
+
+	job, ok := manager.Get(id)
+	if !ok {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "job " + id + " not found"})
+		return
+	}
+	if !job.Cancel() {
+		render.Status(r, 409)
+		render.JSON(w, r, map[string]string{"error": "job " + id + " has already finished"})
+		return
+	}
+
+	info := job.Info()
+	log.WithField("plan", info.Plan).Infof("Job %v cancelled during %v", id, info.Stage)
+	render.Status(r, 202)
+	render.JSON(w, r, info)
+}
+
+// startJob runs fn in the background and answers 202 with the job, its progress is served at /jobs/{id}
+func startJob(w http.ResponseWriter, r *http.Request, kind string, plan string, fn func(job *jobs.Job) (interface{}, error)) {
+	manager := r.Context().Value("app.jobs").(*jobs.Manager)
+	job := manager.Start(kind, plan, "api")
+	go func() {
+		result, err := fn(job)
+		job.Finish(result, err)
+	}()
+
+	w.Header().Set("Location", "/jobs/"+job.ID())
+	render.Status(r, 202)
+	render.JSON(w, r, job.Info())
+}
+
+func jobsCtx(manager *jobs.Manager) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = r.WithContext(context.WithValue(r.Context(), "app.jobs", manager))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
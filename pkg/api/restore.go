@@ -1,7 +1,9 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/dustin/go-humanize"
@@ -9,45 +11,160 @@ import (
 	"github.com/go-chi/render"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/stefanprodan/mgob/pkg/backup"
 	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
 	"github.com/stefanprodan/mgob/pkg/notifier"
+	"github.com/stefanprodan/mgob/pkg/redact"
 	"github.com/stefanprodan/mgob/pkg/restore"
 )
 
 func postRestore(w http.ResponseWriter, r *http.Request) {
 	cfg := r.Context().Value("app.config").(config.AppConfig)
 	modules := r.Context().Value("app.modules").(config.ModuleConfig)
+	store := r.Context().Value("app.store").(*db.StatusStore)
 	planID := chi.URLParam(r, "planID")
-	// backup path is /storagePath/planID/backupName
-	backupPath := fmt.Sprintf("%v/%v/%v", cfg.StoragePath, planID, chi.URLParam(r, "backupPath"))
+	if cfg.RestoreConfirmation {
+		rejectUnconfirmed(w, r, store, planID)
+		return
+	}
 	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
 	if err != nil {
 		log.WithField("plan", planID).Errorf("On demand restore failed on load plain %v", err)
 		render.Status(r, 500)
-		render.JSON(w, r, map[string]string{"error": err.Error()})
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
 		return
 	}
 
-	log.WithField("plan", planID).Infof("On demand restore started from %v", backupPath)
+	// backup path is /storagePath/planID/backupName or the manifest key of templated layouts
+	backupPath, err := backup.LocalArchivePath(plan, &cfg, store, chi.URLParam(r, "backupPath"))
+	if err != nil {
+		log.WithField("plan", planID).Errorf("On demand restore failed on archive lookup %v", err)
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
 
-	res, err := restore.Run(plan, &cfg, &modules, backupPath)
+	// the restore options are optional
+	var opts restore.Options
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": fmt.Sprintf("invalid restore request: %v", err)})
+		return
+	}
+
+	entry := requestEntry(r, db.AuditEntry{Action: "restore", Plan: plan.Name})
+	startJob(w, r, "restore", plan.Name, func(job *jobs.Job) (interface{}, error) {
+		log.WithField("plan", planID).Infof("On demand restore started from %v as job %v", backupPath, job.ID())
+
+		opts.Job = job
+		res, err := restore.Run(plan, &cfg, &modules, store, backupPath, opts)
+		auditRestore(store, entry, res, err)
+		return notifyRestore(plan, res, err)
+	})
+}
+
+func postRestoreFrom(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	modules := r.Context().Value("app.modules").(config.ModuleConfig)
+	store := r.Context().Value("app.store").(*db.StatusStore)
+	planID := chi.URLParam(r, "planID")
+	if cfg.RestoreConfirmation {
+		rejectUnconfirmed(w, r, store, planID)
+		return
+	}
+	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
 	if err != nil {
-		log.WithField("plan", planID).Errorf("On demand restore failed on restoring %v", err)
-		if err := notifier.SendNotification(fmt.Sprintf("RESTORE FAILED: %v on demand restore failed", planID),
-			err.Error(), true, plan); err != nil {
-			log.WithField("plan", plan.Name).Errorf("Notifier failed for on demand restore %v", err)
-		}
+		log.WithField("plan", planID).Errorf("On demand restore failed on load plain %v", err)
 		render.Status(r, 500)
-		render.JSON(w, r, map[string]string{"error": err.Error()})
-	} else {
-		log.WithField("plan", plan.Name).Infof("On demand restore finished in %v, restore from %v size %v",
-			res.Duration, res.Name, humanize.Bytes(uint64(res.Size)))
-		if err := notifier.SendNotification(fmt.Sprintf("%v on demand restore finished", plan.Name),
-			fmt.Sprintf("%v restore finished in %v archive size %v",
-				res.Name, res.Duration, humanize.Bytes(uint64(res.Size))),
-			false, plan); err != nil {
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	var src restore.Source
+	if err := json.NewDecoder(r.Body).Decode(&src); err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": fmt.Sprintf("invalid restore request: %v", err)})
+		return
+	}
+	if src.Destination == "" || src.Key == "" {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": "destination and key are required"})
+		return
+	}
+	if err := backup.CheckKey(plan, store, src.Destination, src.Key); err != nil {
+		render.Status(r, keyStatus(err, 500))
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	entry := requestEntry(r, db.AuditEntry{Action: "restore", Plan: plan.Name})
+	startJob(w, r, "restore", plan.Name, func(job *jobs.Job) (interface{}, error) {
+		log.WithField("plan", planID).Infof("On demand restore started from %v %v as job %v", src.Destination, src.Key, job.ID())
+
+		src.Job = job
+		res, err := restore.RunFrom(plan, &cfg, &modules, store, src)
+		auditRestore(store, entry, res, err)
+		return notifyRestore(plan, res, err)
+	})
+}
+
+// notifyRestore logs and notifies the outcome of an on demand restore, the result is the one of its job
+func notifyRestore(plan config.Plan, res restore.Result, err error) (interface{}, error) {
+	if err != nil {
+		log.WithField("plan", plan.Name).Errorf("On demand restore failed on restoring %v", err)
+		if err := notifier.SendNotification(fmt.Sprintf("RESTORE FAILED: %v on demand restore failed", plan.Name),
+			err.Error(), true, plan); err != nil {
 			log.WithField("plan", plan.Name).Errorf("Notifier failed for on demand restore %v", err)
 		}
-		render.JSON(w, r, toBackupResult(res))
+		return toRestoreResult(res), err
 	}
+
+	log.WithField("plan", plan.Name).Infof("On demand restore finished in %v, restore from %v size %v",
+		res.Duration, res.Name, humanize.Bytes(uint64(res.Size)))
+	if err := notifier.SendNotification(fmt.Sprintf("%v on demand restore finished", plan.Name),
+		fmt.Sprintf("%v restore finished in %v archive size %v",
+			res.Name, res.Duration, humanize.Bytes(uint64(res.Size))),
+		false, plan); err != nil {
+		log.WithField("plan", plan.Name).Errorf("Notifier failed for on demand restore %v", err)
+	}
+	return toRestoreResult(res), nil
+}
+
+func toRestoreResult(res restore.Result) restoreResult {
+	return restoreResult{
+		backupResult: toBackupResult(res.Result),
+		Collections:  res.Collections,
+		Snapshot:     res.Snapshot,
+		Masked:       res.Masked,
+	}
+}
+
+// auditRestore records the restores made without confirmation, the entry is taken from the request
+func auditRestore(store *db.StatusStore, entry db.AuditEntry, res restore.Result, err error) {
+	entry.Status = "succeeded"
+	if err != nil {
+		entry.Status = "failed"
+		entry.Error = redact.Error(err)
+	}
+	addAudit(store, entry, toRestoreResult(res))
+}
+
+func rejectUnconfirmed(w http.ResponseWriter, r *http.Request, store *db.StatusStore, planID string) {
+	audit(r, store, db.AuditEntry{
+		Action: "restore",
+		Plan:   planID,
+		Status: "rejected",
+		Error:  "restore confirmation is required",
+	}, nil)
+	render.Status(r, 403)
+	render.JSON(w, r, map[string]string{"error": "restore confirmation is required, use POST /restores"})
+}
+
+type restoreResult struct {
+	backupResult
+	Collections []restore.CollectionResult `json:"collections"`
+	Snapshot    string                     `json:"snapshot,omitempty"`
+	Masked      []restore.MaskedField      `json:"masked,omitempty"`
 }
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
+	"github.com/stefanprodan/mgob/pkg/redact"
+	"github.com/stefanprodan/mgob/pkg/restore"
+)
+
+type preparedRestore struct {
+	restore.Summary
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+func postPrepareRestore(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	store := r.Context().Value("app.store").(*db.StatusStore)
+	pending := r.Context().Value("app.restores").(*restore.Pending)
+
+	var req restore.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": fmt.Sprintf("invalid restore request: %v", err)})
+		return
+	}
+
+	entry := db.AuditEntry{Action: "restore.prepare", Plan: req.Plan, Status: "rejected"}
+	plan, err := config.LoadPlan(cfg.ConfigPath, req.Plan)
+	if err != nil {
+		entry.Error = redact.Error(err)
+		audit(r, store, entry, nil)
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	summary, err := restore.Prepare(plan, &cfg, store, req.Source)
+	if err != nil {
+		entry.Error = redact.Error(err)
+		audit(r, store, entry, summary)
+		render.Status(r, keyStatus(err, 400))
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	token, expires, err := pending.Add(restore.Prepared{Plan: plan.Name, Requester: principalName(r), Source: req.Source})
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	entry.Status = "prepared"
+	entry.Token = restore.TokenID(token)
+	audit(r, store, entry, summary)
+
+	render.Status(r, 201)
+	render.JSON(w, r, preparedRestore{Summary: summary, Token: token, Expires: expires.UTC()})
+}
+
+func postConfirmRestore(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	modules := r.Context().Value("app.modules").(config.ModuleConfig)
+	store := r.Context().Value("app.store").(*db.StatusStore)
+	pending := r.Context().Value("app.restores").(*restore.Pending)
+	token := chi.URLParam(r, "token")
+
+	entry := requestEntry(r, db.AuditEntry{Action: "restore.confirm", Token: restore.TokenID(token), Status: "rejected"})
+	prepared, ok := pending.Take(token)
+	if !ok {
+		entry.Error = "unknown or expired confirmation token"
+		addAudit(store, entry, nil)
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": entry.Error})
+		return
+	}
+	entry.Plan = prepared.Plan
+	entry.Requester = prepared.Requester
+
+	plan, err := config.LoadPlan(cfg.ConfigPath, prepared.Plan)
+	if err != nil {
+		entry.Error = redact.Error(err)
+		addAudit(store, entry, nil)
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	// the job outlives the request, it only uses the values copied here
+	src := prepared.Source
+	startJob(w, r, "restore", plan.Name, func(job *jobs.Job) (interface{}, error) {
+		log.WithField("plan", plan.Name).Infof("Confirmed restore started from %v as job %v", src.Key, job.ID())
+
+		src.Job = job
+		var res restore.Result
+		var err error
+		if src.Destination == "" {
+			var archive string
+			if archive, err = backup.LocalArchivePath(plan, &cfg, store, src.Key); err == nil {
+				res, err = restore.Run(plan, &cfg, &modules, store, archive, src.Options)
+			}
+		} else {
+			res, err = restore.RunFrom(plan, &cfg, &modules, store, src)
+		}
+
+		entry.Status = "succeeded"
+		if err != nil {
+			entry.Status = "failed"
+			entry.Error = redact.Error(err)
+		}
+		addAudit(store, entry, toRestoreResult(res))
+		return notifyRestore(plan, res, err)
+	})
+}
+
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	store := r.Context().Value("app.store").(*db.StatusStore)
+
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			render.Status(r, 400)
+			render.JSON(w, r, map[string]string{"error": fmt.Sprintf("invalid limit %v", l)})
+			return
+		}
+	}
+
+	entries, err := store.GetAudit(limit)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+	render.JSON(w, r, entries)
+}
+
+// audit records an API operation, the request goes on if the audit log can't be written
+func audit(r *http.Request, store *db.StatusStore, entry db.AuditEntry, details interface{}) {
+	addAudit(store, requestEntry(r, entry), details)
+}
+
+// requestEntry sets the caller of an audit entry, the jobs take it before their request returns
+func requestEntry(r *http.Request, entry db.AuditEntry) db.AuditEntry {
+	entry.Remote = r.RemoteAddr
+	entry.User = principalName(r)
+	return entry
+}
+
+// addAudit records an entry whose caller is already set
+func addAudit(store *db.StatusStore, entry db.AuditEntry, details interface{}) {
+	entry.Timestamp = time.Now().UTC()
+	if details != nil {
+		if buf, err := json.Marshal(details); err == nil {
+			entry.Details = buf
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"plan":      entry.Plan,
+		"action":    entry.Action,
+		"status":    entry.Status,
+		"remote":    entry.Remote,
+		"user":      entry.User,
+		"requester": entry.Requester,
+	}).Info("audit")
+
+	if store == nil {
+		return
+	}
+	if err := store.AddAudit(&entry); err != nil {
+		log.WithField("plan", entry.Plan).Errorf("Audit log update failed %v", err)
+	}
+}
+
+func restoresCtx(pending *restore.Pending) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = r.WithContext(context.WithValue(r.Context(), "app.restores", pending))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
+	"github.com/stefanprodan/mgob/pkg/notifier"
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+func postRotate(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	store := r.Context().Value("app.store").(*db.StatusStore)
+	planID := chi.URLParam(r, "planID")
+	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+		return
+	}
+
+	var opts backup.RotateOptions
+	if r.ContentLength > 0 {
+		if err := render.DecodeJSON(r.Body, &opts); err != nil {
+			render.Status(r, 400)
+			render.JSON(w, r, map[string]string{"error": redact.Error(err)})
+			return
+		}
+	}
+
+	startJob(w, r, "rotate", plan.Name, func(job *jobs.Job) (interface{}, error) {
+		log.WithField("plan", planID).Infof("Key rotation started as job %v", job.ID())
+
+		report, err := backup.Rotate(plan, &cfg, store, opts, job)
+		if err != nil {
+			log.WithField("plan", planID).Errorf("Key rotation failed %v", err)
+			return report, err
+		}
+
+		log.WithField("plan", planID).Infof("Key rotation finished in %v, %v rotated, %v failed",
+			report.Duration, report.Rotated, report.Failed)
+		if report.Failed > 0 {
+			if err := notifier.SendNotification(fmt.Sprintf("KEY ROTATION FAILED: %v key rotation failed", planID),
+				fmt.Sprintf("%v archives re-encrypted, %v failed", report.Rotated, report.Failed), true, plan); err != nil {
+				log.WithField("plan", planID).Errorf("Notifier failed for key rotation %v", err)
+			}
+			return report, errors.Errorf("%v archives re-encrypted, %v failed", report.Rotated, report.Failed)
+		}
+		return report, nil
+	})
+}
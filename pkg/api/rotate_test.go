@@ -0,0 +1,32 @@
+package api
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/stefanprodan/mgob/pkg/jobs"
+)
+
+func Test_postRotate_job(t *testing.T) {
+	s := testServer(t)
+	assert.NoError(t, os.WriteFile(filepath.Join(s.Config.ConfigPath, "orders.yml"), []byte("target:\n  host: localhost\n"), 0644))
+
+	w := serve(s.router("test"), "POST", "/encryption/orders/rotate", bearer(testToken))
+	assert.Equal(t, 202, w.Code)
+	var info jobs.Info
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, "rotate", info.Kind)
+	assert.Equal(t, "/jobs/"+info.ID, w.Header().Get("Location"))
+
+	job, ok := s.Jobs.Get(info.ID)
+	if assert.True(t, ok) {
+		assert.Eventually(t, func() bool { return job.Info().Finished != nil }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, jobs.StateFailed, job.Info().State)
+		assert.Contains(t, job.Info().Error, "has no gpg encryption configured")
+	}
+}
@@ -12,52 +12,139 @@ import (
 
 	"github.com/stefanprodan/mgob/pkg/config"
 	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
+	"github.com/stefanprodan/mgob/pkg/restore"
 )
 
 type HttpServer struct {
 	Config  *config.AppConfig
 	Modules *config.ModuleConfig
 	Stats   *db.StatusStore
+	Jobs    *jobs.Manager
+	Auth    *config.Auth
+	// Labels are the labels of the loaded plans, by plan name
+	Labels map[string]map[string]string
 }
 
 func (s *HttpServer) Start(version string) {
+	tlsConfig, err := s.Auth.ServerTLS()
+	if err != nil {
+		log.Errorf("HTTP server not started: %v", err)
+		return
+	}
+	server := &http.Server{
+		Addr:      fmt.Sprintf("%s:%v", s.Config.Host, s.Config.Port),
+		Handler:   s.router(version),
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig != nil {
+		log.Error(server.ListenAndServeTLS("", ""))
+		return
+	}
+	log.Error(server.ListenAndServe())
+}
+
+func (s *HttpServer) router(version string) http.Handler {
+	pending := restore.NewPending(restore.ConfirmationTTL)
 
 	r := chi.NewRouter()
 	r.Use(middleware.Recoverer)
 	if s.Config.LogLevel == "debug" {
 		r.Use(middleware.DefaultLogger)
 	}
+	if s.Auth != nil {
+		r.Use(authCtx(s.Auth, s.Labels))
+	}
 
-	r.Mount("/metrics", metricsRouter())
+	r.Get("/health", getHealth)
+
+	r.Route("/metrics", func(r chi.Router) {
+		r.Use(authorize(config.RoleViewer, allPlans))
+		r.Mount("/", metricsRouter())
+	})
 
-	r.Mount("/debug", middleware.Profiler())
+	r.Route("/debug", func(r chi.Router) {
+		r.Use(authorize(config.RoleAdmin, allPlans))
+		r.Mount("/", middleware.Profiler())
+	})
 
 	r.Route("/version", func(r chi.Router) {
+		r.Use(authorize(config.RoleViewer, nil))
 		r.Use(appVersionCtx(version))
 		r.Get("/", getVersion)
 	})
 
 	r.Route("/status", func(r chi.Router) {
 		r.Use(statusCtx(s.Stats))
-		r.Get("/", getStatus)
-		r.Get("/{planID}", getPlanStatus)
+		r.With(authorize(config.RoleViewer, nil)).Get("/", getStatus)
+		r.With(authorize(config.RoleViewer, urlPlan)).Get("/{planID}", getPlanStatus)
 	})
 
 	r.Route("/backup", func(r chi.Router) {
 		r.Use(configCtx(*s.Config, *s.Modules))
-		r.Post("/{planID}", postBackup)
+		r.Use(storeCtx(s.Stats))
+		r.Use(jobsCtx(s.Jobs))
+		r.With(authorize(config.RoleOperator, urlPlan)).Post("/{planID}", postBackup)
+	})
+
+	r.Route("/encryption", func(r chi.Router) {
+		r.Use(configCtx(*s.Config, *s.Modules))
+		r.Use(storeCtx(s.Stats))
+		r.Use(jobsCtx(s.Jobs))
+		r.With(authorize(config.RoleAdmin, urlPlan)).Post("/{planID}/rotate", postRotate)
 	})
 
 	r.Route("/restore", func(r chi.Router) {
 		r.Use(configCtx(*s.Config, *s.Modules))
-		r.Post("/{planID}/{backupPath}", postRestore)
+		r.Use(storeCtx(s.Stats))
+		r.Use(jobsCtx(s.Jobs))
+		r.With(authorize(config.RoleAdmin, urlPlan)).Post("/{planID}", postRestoreFrom)
+		r.With(authorize(config.RoleAdmin, urlPlan)).Post("/{planID}/{backupPath}", postRestore)
+	})
+
+	r.Route("/restores", func(r chi.Router) {
+		r.Use(configCtx(*s.Config, *s.Modules))
+		r.Use(storeCtx(s.Stats))
+		r.Use(restoresCtx(pending))
+		r.Use(jobsCtx(s.Jobs))
+		r.With(authorize(config.RoleAdmin, requestPlan)).Post("/", postPrepareRestore)
+		r.With(authorize(config.RoleAdmin, pendingPlan(pending))).Post("/{token}", postConfirmRestore)
+	})
+
+	r.Route("/jobs", func(r chi.Router) {
+		r.Use(jobsCtx(s.Jobs))
+		r.With(authorize(config.RoleViewer, nil)).Get("/", getJobs)
+		r.With(authorize(config.RoleViewer, jobPlan(s.Jobs))).Get("/{id}", getJob)
+		r.With(authorize(config.RoleViewer, jobPlan(s.Jobs))).Get("/{id}/logs", getJobLogs)
+		r.With(authorize(config.RoleOperator, jobPlan(s.Jobs))).Delete("/{id}", deleteJob)
+	})
+
+	r.Route("/audit", func(r chi.Router) {
+		r.Use(authorize(config.RoleAdmin, allPlans))
+		r.Use(storeCtx(s.Stats))
+		r.Get("/", getAudit)
+	})
+
+	r.Route("/backups", func(r chi.Router) {
+		r.Use(configCtx(*s.Config, *s.Modules))
+		r.Use(storeCtx(s.Stats))
+		r.With(authorize(config.RoleViewer, urlPlan)).Get("/{planID}", getBackups)
+		r.With(authorize(config.RoleViewer, urlPlan)).Get("/{planID}/{name}/contents", getBackupContents)
+		r.With(authorize(config.RoleViewer, urlPlan)).Get("/{planID}/{name}/validation", getBackupValidation)
+	})
+
+	r.Route("/drills", func(r chi.Router) {
+		r.Use(configCtx(*s.Config, *s.Modules))
+		r.Use(storeCtx(s.Stats))
+		r.With(authorize(config.RoleViewer, urlPlan)).Get("/{planID}", getDrills)
+		r.With(authorize(config.RoleOperator, urlPlan)).Post("/{planID}", postDrill)
 	})
 
 	if s.Config.StoragePath != "" {
-		FileServer(r, "/storage", http.Dir(s.Config.StoragePath))
+		FileServer(r.With(authorize(config.RoleAdmin, storagePlan(s.Stats))), "/storage", http.Dir(s.Config.StoragePath))
 	}
 
-	log.Error(http.ListenAndServe(fmt.Sprintf("%s:%v", s.Config.Host, s.Config.Port), r))
+	return r
 }
 
 func FileServer(r chi.Router, path string, root http.FileSystem) {
@@ -87,3 +174,12 @@ func configCtx(data config.AppConfig, modules config.ModuleConfig) func(next htt
 		})
 	}
 }
+
+func storeCtx(store *db.StatusStore) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = r.WithContext(context.WithValue(r.Context(), "app.store", store))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/go-chi/render"
 
 	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/redact"
 )
 
 type appStatus []*db.Status
@@ -22,7 +23,7 @@ func statusCtx(store *db.StatusStore) func(next http.Handler) http.Handler {
 			data, err := store.GetAll()
 			if err != nil {
 				render.Status(r, 500)
-				render.JSON(w, r, map[string]string{"error": err.Error()})
+				render.JSON(w, r, map[string]string{"error": redact.Error(err)})
 				return
 			}
 
@@ -34,7 +35,13 @@ func statusCtx(store *db.StatusStore) func(next http.Handler) http.Handler {
 
 func getStatus(w http.ResponseWriter, r *http.Request) {
 	data := r.Context().Value("app.status").(appStatus)
-	render.JSON(w, r, data)
+	result := make(appStatus, 0, len(data))
+	for _, s := range data {
+		if visible(r, s.Plan) {
+			result = append(result, s)
+		}
+	}
+	render.JSON(w, r, result)
 }
 
 func getPlanStatus(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,258 @@
+// Package archive reads the mongodump --archive format without a MongoDB server.
+//
+// An archive starts with a magic number and a prelude block holding the archive header and the
+// metadata of every collection. The body is a sequence of blocks, each made of a namespace header
+// followed by the BSON documents of that namespace and a terminator. The whole stream is gzipped
+// when mongodump runs with --gzip.
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const magicNumber uint32 = 0x8199e26d
+
+// terminator ends a block, in place of the length of the next document
+const terminator int32 = -1
+
+// maxDocumentSize bounds the length read from a corrupted archive, BSON documents are limited to 16MB
+const maxDocumentSize = 64 * 1024 * 1024
+
+type header struct {
+	ConcurrentCollections int32  `bson:"concurrent_collections"`
+	Version               string `bson:"version"`
+	ServerVersion         string `bson:"server_version"`
+	ToolVersion           string `bson:"tool_version"`
+}
+
+type collectionMetadata struct {
+	Database   string `bson:"db"`
+	Collection string `bson:"collection"`
+	Metadata   string `bson:"metadata"`
+	Size       int64  `bson:"size"`
+	Type       string `bson:"type"`
+}
+
+// metadata is the extended JSON document of a collection metadata
+type metadata struct {
+	Options bson.M   `bson:"options"`
+	Indexes []bson.M `bson:"indexes"`
+	Type    string   `bson:"type"`
+}
+
+type namespaceHeader struct {
+	Database   string `bson:"db"`
+	Collection string `bson:"collection"`
+	EOF        bool   `bson:"EOF"`
+	CRC        int64  `bson:"CRC"`
+}
+
+// Collection is a namespace found in an archive, Size is the BSON size of its documents
+type Collection struct {
+	Database   string   `json:"db"`
+	Collection string   `json:"collection"`
+	Type       string   `json:"type,omitempty"`
+	Documents  int64    `json:"documents"`
+	Size       int64    `json:"size"`
+	Indexes    []bson.M `json:"indexes"`
+	Options    bson.M   `json:"options"`
+}
+
+// Namespace is the db.collection name
+func (c Collection) Namespace() string {
+	return c.Database + "." + c.Collection
+}
+
+// Contents describes an archive
+type Contents struct {
+	Version       string       `json:"version"`
+	ServerVersion string       `json:"server_version"`
+	ToolVersion   string       `json:"tool_version"`
+	Compressed    bool         `json:"compressed"`
+	Collections   []Collection `json:"collections"`
+}
+
+// ReadFile reads an archive file, gzipped or not
+func ReadFile(file string) (*Contents, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Opening file %v failed", file)
+	}
+	defer f.Close()
+
+	contents, err := Read(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading archive %v failed", file)
+	}
+	return contents, nil
+}
+
+// Read parses an archive stream, gzipped or not, and counts the documents of every namespace
+func Read(r io.Reader) (*Contents, error) {
+	br := bufio.NewReader(r)
+	contents := &Contents{Collections: make([]Collection, 0)}
+
+	peek, err := br.Peek(2)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading magic number failed")
+	}
+	var in io.Reader = br
+	if peek[0] == 0x1f && peek[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "opening gzip stream failed")
+		}
+		defer gz.Close()
+		in = gz
+		contents.Compressed = true
+	}
+
+	var magic uint32
+	if err := binary.Read(in, binary.LittleEndian, &magic); err != nil {
+		return nil, errors.Wrap(err, "reading magic number failed")
+	}
+	if magic != magicNumber {
+		return nil, errors.Errorf("not a mongodump archive, magic number %#x", magic)
+	}
+
+	index := make(map[string]int)
+	if err := readPrelude(in, contents, index); err != nil {
+		return nil, err
+	}
+	if err := readBody(in, contents, index); err != nil {
+		return nil, err
+	}
+	return contents, nil
+}
+
+func readPrelude(in io.Reader, contents *Contents, index map[string]int) error {
+	doc, err := readDocument(in)
+	if err != nil {
+		return errors.Wrap(err, "reading archive header failed")
+	}
+	var h header
+	if err := bson.Unmarshal(doc, &h); err != nil {
+		return errors.Wrap(err, "decoding archive header failed")
+	}
+	contents.Version = h.Version
+	contents.ServerVersion = h.ServerVersion
+	contents.ToolVersion = h.ToolVersion
+
+	for {
+		doc, err := readDocument(in)
+		if err != nil {
+			return errors.Wrap(err, "reading collection metadata failed")
+		}
+		if doc == nil {
+			return nil
+		}
+
+		var cm collectionMetadata
+		if err := bson.Unmarshal(doc, &cm); err != nil {
+			return errors.Wrap(err, "decoding collection metadata failed")
+		}
+		c := Collection{
+			Database:   cm.Database,
+			Collection: cm.Collection,
+			Type:       cm.Type,
+			Indexes:    make([]bson.M, 0),
+			Options:    bson.M{},
+		}
+		if cm.Metadata != "" {
+			var m metadata
+			if err := bson.UnmarshalExtJSON([]byte(cm.Metadata), false, &m); err != nil {
+				return errors.Wrapf(err, "decoding metadata of %v failed", c.Namespace())
+			}
+			if m.Indexes != nil {
+				c.Indexes = m.Indexes
+			}
+			if m.Options != nil {
+				c.Options = m.Options
+			}
+			if c.Type == "" {
+				c.Type = m.Type
+			}
+		}
+		index[c.Namespace()] = len(contents.Collections)
+		contents.Collections = append(contents.Collections, c)
+	}
+}
+
+func readBody(in io.Reader, contents *Contents, index map[string]int) error {
+	for {
+		doc, err := readDocument(in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading namespace header failed")
+		}
+		if doc == nil {
+			// empty block
+			continue
+		}
+
+		var h namespaceHeader
+		if err := bson.Unmarshal(doc, &h); err != nil {
+			return errors.Wrap(err, "decoding namespace header failed")
+		}
+		ns := h.Database + "." + h.Collection
+		i, ok := index[ns]
+		if !ok {
+			// the oplog and the namespaces missing from the prelude
+			i = len(contents.Collections)
+			index[ns] = i
+			contents.Collections = append(contents.Collections, Collection{
+				Database:   h.Database,
+				Collection: h.Collection,
+				Indexes:    make([]bson.M, 0),
+				Options:    bson.M{},
+			})
+		}
+
+		for {
+			doc, err := readDocument(in)
+			if err != nil {
+				return errors.Wrapf(err, "reading documents of %v failed", ns)
+			}
+			if doc == nil {
+				break
+			}
+			contents.Collections[i].Documents++
+			contents.Collections[i].Size += int64(len(doc))
+		}
+	}
+}
+
+// readDocument reads a BSON document, nil at a terminator and io.EOF at the end of the stream
+func readDocument(in io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(in, lenBuf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("archive is truncated")
+		}
+		return nil, err
+	}
+
+	length := int32(binary.LittleEndian.Uint32(lenBuf[:]))
+	if length == terminator {
+		return nil, nil
+	}
+	if length < 5 || length > maxDocumentSize {
+		return nil, errors.Errorf("invalid document length %v", length)
+	}
+
+	doc := make([]byte, length)
+	copy(doc, lenBuf[:])
+	if _, err := io.ReadFull(in, doc[4:]); err != nil {
+		return nil, errors.New("archive is truncated")
+	}
+	return doc, nil
+}
@@ -0,0 +1,93 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func writeDoc(t *testing.T, buf *bytes.Buffer, doc interface{}) {
+	data, err := bson.Marshal(doc)
+	assert.NoError(t, err)
+	buf.Write(data)
+}
+
+func writeTerminator(buf *bytes.Buffer) {
+	binary.Write(buf, binary.LittleEndian, terminator)
+}
+
+// testArchive builds an archive the way mongodump writes it, with the users documents split in two blocks
+func testArchive(t *testing.T) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, magicNumber)
+
+	writeDoc(t, &buf, bson.M{"concurrent_collections": int32(4), "version": "0.1", "server_version": "6.0.5", "tool_version": "100.7.0"})
+	writeDoc(t, &buf, bson.M{"db": "app", "collection": "users", "size": int64(0), "type": "collection",
+		"metadata": `{"indexes":[{"v":{"$numberInt":"2"},"key":{"_id":{"$numberInt":"1"}},"name":"_id_"},` +
+			`{"v":{"$numberInt":"2"},"key":{"email":{"$numberInt":"1"}},"name":"email_1","unique":true}],` +
+			`"uuid":"5a7fd0d8e9b04e1f9e2a9bd1e63e3f55","collectionName":"users","type":"collection"}`})
+	writeDoc(t, &buf, bson.M{"db": "app", "collection": "logs", "size": int64(0), "type": "collection",
+		"metadata": `{"options":{"capped":true,"size":{"$numberInt":"4096"}},"indexes":[],"collectionName":"logs"}`})
+	writeTerminator(&buf)
+
+	writeDoc(t, &buf, bson.M{"db": "app", "collection": "users", "EOF": false, "CRC": int64(0)})
+	writeDoc(t, &buf, bson.M{"_id": 1, "email": "a@example.com"})
+	writeDoc(t, &buf, bson.M{"_id": 2, "email": "b@example.com"})
+	writeTerminator(&buf)
+	writeDoc(t, &buf, bson.M{"db": "app", "collection": "logs", "EOF": true, "CRC": int64(0)})
+	writeTerminator(&buf)
+	writeDoc(t, &buf, bson.M{"db": "app", "collection": "users", "EOF": false, "CRC": int64(0)})
+	writeDoc(t, &buf, bson.M{"_id": 3, "email": "c@example.com"})
+	writeTerminator(&buf)
+	writeDoc(t, &buf, bson.M{"db": "app", "collection": "users", "EOF": true, "CRC": int64(0)})
+	writeTerminator(&buf)
+	return buf.Bytes()
+}
+
+func Test_Read(t *testing.T) {
+	data := testArchive(t)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(data)
+	w.Close()
+
+	for _, compressed := range []bool{false, true} {
+		in := data
+		if compressed {
+			in = gz.Bytes()
+		}
+		contents, err := Read(bytes.NewReader(in))
+		assert.NoError(t, err)
+		assert.Equal(t, compressed, contents.Compressed)
+		assert.Equal(t, "6.0.5", contents.ServerVersion)
+		assert.Equal(t, "100.7.0", contents.ToolVersion)
+		assert.Len(t, contents.Collections, 2)
+
+		users := contents.Collections[0]
+		assert.Equal(t, "app.users", users.Namespace())
+		assert.Equal(t, int64(3), users.Documents)
+		assert.Len(t, users.Indexes, 2)
+		assert.Equal(t, "email_1", users.Indexes[1]["name"])
+		assert.Equal(t, true, users.Indexes[1]["unique"])
+
+		logs := contents.Collections[1]
+		assert.Equal(t, int64(0), logs.Documents)
+		assert.Equal(t, true, logs.Options["capped"])
+		assert.Equal(t, int32(4096), logs.Options["size"])
+	}
+}
+
+func Test_Read_invalid(t *testing.T) {
+	data := testArchive(t)
+
+	_, err := Read(bytes.NewReader(data[:len(data)-10]))
+	assert.Error(t, err)
+
+	_, err = Read(bytes.NewReader([]byte("not an archive")))
+	assert.Error(t, err)
+}
@@ -1,34 +1,96 @@
 package backup
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
+	"io"
 	"strings"
 	"time"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
 
 	"github.com/stefanprodan/mgob/pkg/config"
 )
 
-func azureUpload(file string, plan config.Plan) (string, error) {
-	azurefile := strings.TrimLeft(file, "!/")
-	upload := fmt.Sprintf("az storage blob upload -c '%v' --file '%v' --name '%v' --connection-string '%v'",
-		plan.Azure.ContainerName, file, azurefile, plan.Azure.ConnectionString)
+func azureUpload(ctx context.Context, file string, key string, plan config.Plan) (string, error) {
+	stdout, stderr, err := runCmdContext(ctx, time.Duration(plan.Scheduler.Timeout)*time.Minute, nil, azureUploadCmd(file, key, plan)...)
+	output := flatten(append(stdout, stderr...))
 
-	result, err := sh.Command("/bin/sh", "-c", upload).SetTimeout(time.Duration(plan.Scheduler.Timeout) * time.Minute).CombinedOutput()
-	output := ""
-	if len(result) > 0 {
-		output = strings.Replace(string(result), "\n", " ", -1)
+	if err != nil {
+		return "", errors.Wrapf(err, "Azure uploading %v to %v failed %v", file, plan.Azure.ContainerName, output)
+	}
+
+	if strings.Contains(output, "<Error>") {
+		return "", errors.Errorf("Azure upload failed %v", output)
+	}
+
+	return output, nil
+}
+
+func azureUploadCmd(file string, key string, plan config.Plan) []string {
+	azurefile := key
+	if azurefile == "" {
+		azurefile = strings.TrimLeft(file, "!/")
 	}
+	return []string{"az", "storage", "blob", "upload", "-c", plan.Azure.ContainerName, "--file", file,
+		"--name", azurefile, "--connection-string", plan.Azure.ConnectionString}
+}
+
+// azureReplace overwrites the blob of a rotated archive, az refuses to upload over an existing blob by default
+func azureReplace(ctx context.Context, file string, key string, plan config.Plan) (string, error) {
+	cmd := append(azureUploadCmd(file, key, plan), "--overwrite")
+	stdout, stderr, err := runCmdContext(ctx, time.Duration(plan.Scheduler.Timeout)*time.Minute, nil, cmd...)
+	output := flatten(append(stdout, stderr...))
 
 	if err != nil {
-		return "", errors.Wrapf(err, "Azure uploading %v to %v failed %v", file, plan.Azure.ContainerName, output)
+		return "", errors.Wrapf(err, "Azure replacing %v in %v failed %v", key, plan.Azure.ContainerName, output)
 	}
 
 	if strings.Contains(output, "<Error>") {
 		return "", errors.Errorf("Azure upload failed %v", output)
 	}
 
-	return strings.Replace(output, "\n", " ", -1), nil
+	return output, nil
+}
+
+type azureDestination struct {
+	plan config.Plan
+}
+
+func (d *azureDestination) Name() string {
+	return "azure"
+}
+
+func (d *azureDestination) List() ([]RemoteArchive, error) {
+	stdout, _, err := runCmd(0, "az", "storage", "blob", "list", "-c", d.plan.Azure.ContainerName,
+		"--num-results", "*", "--output", "json", "--connection-string", d.plan.Azure.ConnectionString)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Azure listing %v failed", d.plan.Azure.ContainerName)
+	}
+
+	var blobs []struct {
+		Name       string `json:"name"`
+		Properties struct {
+			ContentLength int64     `json:"contentLength"`
+			LastModified  time.Time `json:"lastModified"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(stdout, &blobs); err != nil {
+		return nil, errors.Wrapf(err, "Azure listing %v failed", d.plan.Azure.ContainerName)
+	}
+
+	objects := make([]RemoteArchive, 0, len(blobs))
+	for _, blob := range blobs {
+		objects = append(objects, RemoteArchive{
+			Key:      blob.Name,
+			Size:     blob.Properties.ContentLength,
+			Modified: blob.Properties.LastModified.UTC(),
+		})
+	}
+	return objects, nil
+}
+
+func (d *azureDestination) Open(key string) (io.ReadCloser, error) {
+	return streamCmd("az", "storage", "blob", "download", "-c", d.plan.Azure.ContainerName, "--name", key,
+		"--file", "/dev/stdout", "--no-progress", "--connection-string", d.plan.Azure.ConnectionString)
 }
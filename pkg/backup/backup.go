@@ -1,24 +1,37 @@
 package backup
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"time"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
 )
 
-func Run(plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig) (Result, error) {
-	tmpPath := conf.TmpPath
+func Run(plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig, store *db.StatusStore) (Result, error) {
+	return RunJob(plan, conf, modules, store, nil)
+}
 
+// RunJob is Run reporting its stages and progress to a job, cancelling the job kills the running tool
+// and removes the temporary files
+func RunJob(plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig, store *db.StatusStore, job *jobs.Job) (Result, error) {
 	t1 := time.Now()
+	ctx := job.Context()
+
+	if plan.Refresh != nil {
+		return Result{Plan: plan.Name, Timestamp: t1.UTC(), Status: 500},
+			errors.Errorf("plan %v is a refresh job, it has nothing to back up", plan.Name)
+	}
 
-	archive, mlog, err := dump(plan, tmpPath, t1.UTC())
+	archive, mlog, dataSize, validation, err := dump(plan, conf, store, t1.UTC(), job)
 	log.WithFields(log.Fields{
 		"plan":    plan.Name,
 		"archive": archive,
@@ -33,6 +46,11 @@ func Run(plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig)
 	}
 	_, res.Name = filepath.Split(archive)
 
+	defer func() {
+		if ctx.Err() != nil {
+			removeTemp(archive, mlog)
+		}
+	}()
 	if err != nil {
 		return res, err
 	}
@@ -44,74 +62,69 @@ func Run(plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig)
 	res.Size = fi.Size()
 
 	file := archive
+	manifest := &db.Archive{
+		Plan:       plan.Name,
+		Timestamp:  res.Timestamp,
+		DataSize:   dataSize,
+		Validation: validation,
+	}
 
 	if plan.Encryption != nil {
+		if err := cancelled(ctx); err != nil {
+			return res, err
+		}
+		job.SetStage("encryption")
 		encryptedFile := fmt.Sprintf("%v.encrypted", archive)
-		output, err := encrypt(archive, encryptedFile, plan, conf)
+		output, recipients, err := encrypt(ctx, archive, encryptedFile, plan, conf)
 		if err != nil {
 			return res, err
 		} else {
 			removeUnencrypted(archive, encryptedFile)
 			file = encryptedFile
+			manifest.Encrypted = true
+			manifest.Recipients = recipients
 			log.WithField("plan", plan.Name).Infof("Encryption finished %v", output)
 		}
 	}
 
-	if conf.StoragePath != "" && plan.Scheduler.Retention != 0 {
-		localBackupOutput, err := localBackup(file, conf.StoragePath, mlog, plan)
-		if err != nil {
-			return res, err
-		} else {
-			log.WithField("plan", plan.Name).Infof("%v", localBackupOutput)
-		}
+	if fi, err := os.Stat(file); err == nil {
+		manifest.Size = fi.Size()
 	}
-
-	if plan.SFTP != nil {
-		sftpOutput, err := sftpUpload(file, plan)
-		if err != nil {
-			return res, err
-		} else {
-			log.WithField("plan", plan.Name).Info(sftpOutput)
-		}
+	if manifest.Checksum, err = fileChecksum(file); err != nil {
+		return res, err
 	}
 
-	if plan.S3 != nil {
-		s3Output, err := s3Upload(file, plan, conf.UseAwsCli)
-		if err != nil {
-			return res, err
-		} else {
-			log.WithField("plan", plan.Name).Infof("S3 upload finished %v", s3Output)
-		}
+	key, err := archiveKey(plan, res.Timestamp, file)
+	if err != nil {
+		return res, err
 	}
+	manifest.Key = key
 
-	if plan.GCloud != nil {
-		gCloudOutput, err := gCloudUpload(file, plan)
-		if err != nil {
-			return res, err
-		} else {
-			log.WithField("plan", plan.Name).Infof("GCloud upload finished %v", gCloudOutput)
-		}
+	if err := cancelled(ctx); err != nil {
+		return res, err
 	}
-
-	if plan.Azure != nil {
-		azureOutput, err := azureUpload(file, plan)
-		if err != nil {
-			return res, err
-		} else {
-			log.WithField("plan", plan.Name).Infof("Azure upload finished %v", azureOutput)
-		}
+	job.SetStage("upload")
+	uploads := uploaders(plan, conf, mlog)
+	for _, u := range uploads {
+		job.SetDestination(u.name, "pending", 0)
 	}
-
-	if plan.Rclone != nil {
-		rcloneOutput, err := rcloneUpload(file, plan)
+	for _, u := range uploads {
+		job.SetDestination(u.name, "uploading", 0)
+		output, err := u.upload(ctx, file, key)
 		if err != nil {
+			job.SetDestination(u.name, "failed", 0)
 			return res, err
-		} else {
-			log.WithField("plan", plan.Name).Infof("Rclone upload finished %v", rcloneOutput)
 		}
+		job.SetDestination(u.name, "done", manifest.Size)
+		log.WithField("plan", plan.Name).Infof("%v upload finished %v", u.name, output)
+		manifest.Destinations = append(manifest.Destinations, u.name)
 	}
 
-	output, err := cleanup(file, mlog)
+	if err := cancelled(ctx); err != nil {
+		return res, err
+	}
+	job.SetStage("cleanup")
+	output, err := cleanup(ctx, file, mlog)
 	if err != nil {
 		return res, err
 	} else {
@@ -121,19 +134,92 @@ func Run(plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig)
 	t2 := time.Now()
 	res.Status = 200
 	res.Duration = t2.Sub(t1)
+
+	if store != nil {
+		manifest.Name = path.Base(objectName(file, key))
+		if err := store.PutArchive(manifest); err != nil {
+			log.WithField("plan", plan.Name).Errorf("Manifest update failed %v", err)
+		} else if key != "" && conf.StoragePath != "" && plan.Scheduler.Retention > 0 {
+			if err := applyManifestRetention(store, plan, conf.StoragePath); err != nil {
+				log.WithField("plan", plan.Name).Errorf("Retention job failed %v", err)
+			}
+		}
+	} else if key != "" && conf.StoragePath != "" && plan.Scheduler.Retention > 0 {
+		log.WithField("plan", plan.Name).Warn("Retention skipped, templated layouts need the manifest")
+	}
+
 	return res, nil
 }
 
-func cleanup(file string, mlog string) (string, error) {
-	err := sh.Command("rm", file).Run()
+// uploader uploads an archive to one destination of a plan
+type uploader struct {
+	name   string
+	upload func(ctx context.Context, file string, key string) (string, error)
+}
+
+// uploaders lists the destinations Run uploads to, in upload order. DryRun records their commands.
+func uploaders(plan config.Plan, conf *config.AppConfig, mlog string) []uploader {
+	uploads := make([]uploader, 0)
+	if conf.StoragePath != "" && plan.Scheduler.Retention != 0 {
+		uploads = append(uploads, uploader{"local", func(ctx context.Context, file string, key string) (string, error) {
+			return localBackup(ctx, file, key, conf.StoragePath, mlog, plan)
+		}})
+	}
+	if plan.SFTP != nil {
+		uploads = append(uploads, uploader{"sftp", func(ctx context.Context, file string, key string) (string, error) {
+			return sftpUpload(ctx, file, key, plan)
+		}})
+	}
+	if plan.S3 != nil {
+		uploads = append(uploads, uploader{"s3", func(ctx context.Context, file string, key string) (string, error) {
+			return s3Upload(ctx, file, key, plan, conf.UseAwsCli)
+		}})
+	}
+	if plan.GCloud != nil {
+		uploads = append(uploads, uploader{"gcloud", func(ctx context.Context, file string, key string) (string, error) {
+			return gCloudUpload(ctx, file, key, plan)
+		}})
+	}
+	if plan.Azure != nil {
+		uploads = append(uploads, uploader{"azure", func(ctx context.Context, file string, key string) (string, error) {
+			return azureUpload(ctx, file, key, plan)
+		}})
+	}
+	if plan.Rclone != nil {
+		uploads = append(uploads, uploader{"rclone", func(ctx context.Context, file string, key string) (string, error) {
+			return rcloneUpload(ctx, file, key, plan)
+		}})
+	}
+	return uploads
+}
+
+// cancelled stops a run between two stages once its job is cancelled
+func cancelled(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "job cancelled")
+	}
+	return nil
+}
+
+// removeTemp removes what a cancelled run left in the temp path
+func removeTemp(archive string, mlog string) {
+	for _, file := range []string{archive, fmt.Sprintf("%v.encrypted", archive), mlog} {
+		if err := os.Remove(file); err == nil {
+			log.Debugf("removed %v of the cancelled run", file)
+		}
+	}
+}
+
+func cleanup(ctx context.Context, file string, mlog string) (string, error) {
+	_, _, err := runCmdContext(ctx, 0, nil, "rm", file)
 	if err != nil {
 		return "", errors.Wrapf(err, "remove file from %v failed", file)
 	}
 	// check if log file exists, is not always created
-	if _, err := os.Stat(mlog); os.IsNotExist(err) {
+	if _, err := os.Stat(mlog); os.IsNotExist(err) && !dryRun(ctx) {
 		log.Debug("appears no log file was generated")
 	} else {
-		err = sh.Command("rm", mlog).Run()
+		_, _, err = runCmdContext(ctx, 0, nil, "rm", mlog)
 		if err != nil {
 			return "", errors.Wrapf(err, "remove file from %v failed", mlog)
 		}
@@ -3,97 +3,58 @@ package backup
 import (
 	"strings"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
 )
 
 func CheckMongodump() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "mongodump --version").CombinedOutput()
-	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return "", errors.Wrapf(err, "mongodump failed %v", ex)
-	}
-
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return checkVersion("mongodump", "", "mongodump", "--version")
 }
 
 func CheckMinioClient() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "mc --version").CombinedOutput()
-	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return "", errors.Wrapf(err, "mc failed %v", ex)
-	}
-
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return checkVersion("mc", "", "mc", "--version")
 }
 
 func CheckAWSClient() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "aws --version").CombinedOutput()
-	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return "", errors.Wrapf(err, "aws failed %v", ex)
-	}
-
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return checkVersion("aws", "", "aws", "--version")
 }
 
 func CheckGpg() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "gpg --version").CombinedOutput()
-	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return "", errors.Wrapf(err, "gpg failed %v", ex)
-	}
-
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return checkVersion("gpg", "", "gpg", "--version")
 }
 
 func CheckGCloudClient() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "gcloud --version").CombinedOutput()
-	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return "", errors.Wrapf(err, "gcloud failed %v", ex)
-	}
-
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return checkVersion("gcloud", "", "gcloud", "--version")
 }
 
 func CheckAzureClient() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "az --version | grep 'azure-cli'").CombinedOutput()
-	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return "", errors.Wrapf(err, "az failed %v", ex)
-	}
-
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return checkVersion("az", "azure-cli", "az", "--version")
 }
 
 func CheckRCloneClient() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "rclone version | grep 'rclone'").CombinedOutput()
+	return checkVersion("rclone", "rclone", "rclone", "version")
+}
+
+// checkVersion runs a version command and returns its output,
+// limited to the lines containing filter when set
+func checkVersion(name string, filter string, argv ...string) (string, error) {
+	stdout, stderr, err := runCmd(0, argv...)
+	output := string(stdout) + string(stderr)
 	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
+		return "", errors.Wrapf(err, "%v failed %v", name, flatten([]byte(output)))
+	}
+
+	if filter != "" {
+		lines := make([]string, 0)
+		for _, line := range strings.Split(output, "\n") {
+			if strings.Contains(line, filter) {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) == 0 {
+			return "", errors.Errorf("%v failed, %v not found in %v", name, filter, flatten([]byte(output)))
 		}
-		return "", errors.Wrapf(err, "rclone failed %v", ex)
+		output = strings.Join(lines, "\n")
 	}
 
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return strings.Replace(output, "\n", " ", -1), nil
 }
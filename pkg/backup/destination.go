@@ -0,0 +1,382 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// RemoteArchive is an archive found on a destination, Key is relative to the destination root
+type RemoteArchive struct {
+	Key       string    `json:"key"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Modified  time.Time `json:"modified"`
+	Encrypted bool      `json:"encrypted"`
+	Checksum  string    `json:"sha256,omitempty"`
+	// Validation is the status of the validation restore recorded in the manifest
+	Validation string `json:"validation,omitempty"`
+}
+
+// Destination is a backend the archives of a plan are uploaded to
+type Destination interface {
+	Name() string
+	// List returns every object of the destination, unfiltered
+	List() ([]RemoteArchive, error)
+	// Open streams an archive, the error of Close must be checked once read
+	Open(key string) (io.ReadCloser, error)
+}
+
+// Destinations returns the destinations configured for a plan, in upload order
+func Destinations(plan config.Plan, conf *config.AppConfig) []Destination {
+	destinations := make([]Destination, 0)
+	if conf.StoragePath != "" && plan.Scheduler.Retention != 0 {
+		destinations = append(destinations, &localDestination{root: conf.StoragePath, plan: plan})
+	}
+	if plan.SFTP != nil {
+		destinations = append(destinations, &sftpDestination{plan: plan})
+	}
+	if plan.S3 != nil {
+		destinations = append(destinations, &s3Destination{plan: plan, useAwsCli: conf.UseAwsCli})
+	}
+	if plan.GCloud != nil {
+		destinations = append(destinations, &gCloudDestination{plan: plan})
+	}
+	if plan.Azure != nil {
+		destinations = append(destinations, &azureDestination{plan: plan})
+	}
+	if plan.Rclone != nil {
+		destinations = append(destinations, &rcloneDestination{plan: plan})
+	}
+	return destinations
+}
+
+// GetDestination finds a configured destination by name
+func GetDestination(plan config.Plan, conf *config.AppConfig, name string) (Destination, error) {
+	for _, d := range Destinations(plan, conf) {
+		if d.Name() == name {
+			return d, nil
+		}
+	}
+	return nil, errors.Errorf("destination %v is not configured for plan %v", name, plan.Name)
+}
+
+// ListArchives lists the archives of a plan on a destination, newest first,
+// with the checksum recorded in the manifest
+func ListArchives(plan config.Plan, store *db.StatusStore, dest Destination) ([]RemoteArchive, error) {
+	objects, err := dest.List()
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := make(map[string]*db.Archive)
+	if store != nil {
+		archives, err := store.GetArchives(plan.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, archive := range archives {
+			manifest[archive.Name] = archive
+		}
+	}
+
+	result := make([]RemoteArchive, 0)
+	for _, object := range objects {
+		object.Name = path.Base(object.Key)
+		archive, ok := manifest[object.Name]
+		if !ok && !isPlanArchive(plan, object.Name) {
+			continue
+		}
+		object.Encrypted = strings.HasSuffix(object.Name, ".encrypted")
+		if ok {
+			object.Checksum = archive.Checksum
+			if archive.Validation != nil {
+				object.Validation = archive.Validation.Status
+			}
+		}
+		result = append(result, object)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Modified.After(result[j].Modified)
+	})
+	return result, nil
+}
+
+// DestinationKey finds the key of a named archive on a destination,
+// through the manifest for templated layouts and snapshots
+func DestinationKey(plan config.Plan, store *db.StatusStore, destination string, name string) (string, error) {
+	if store != nil {
+		archive, err := store.GetArchive(plan.Name, name)
+		if err != nil {
+			return "", err
+		}
+		if archive != nil && archive.Key != "" {
+			return archive.Key, nil
+		}
+	}
+	if destination == "local" {
+		return path.Join(plan.Name, name), nil
+	}
+	return name, nil
+}
+
+// isPlanArchive matches the legacy archive names, like plan-1494056760.gz or plan-snapshot-1494056760.gz.encrypted,
+// the plan name is matched whole so plan db doesn't list the archives of db-staging
+func isPlanArchive(plan config.Plan, name string) bool {
+	base, ok := strings.CutPrefix(name, plan.Name+"-")
+	return ok && planArchiveRegex.MatchString(base)
+}
+
+var planArchiveRegex = regexp.MustCompile(`^(snapshot-)?\d+\.gz(\.encrypted)?$`)
+
+// FetchOptions point to the secret key able to decrypt the archive
+type FetchOptions struct {
+	KeyFile        string `json:"keyFile"`
+	PassphraseFile string `json:"passphraseFile"`
+}
+
+// FetchArchive downloads an archive from a destination to the temp path, verifies its checksum
+// against the manifest and decrypts it. The returned cleanup removes the temporary files.
+func FetchArchive(ctx context.Context, plan config.Plan, conf *config.AppConfig, store *db.StatusStore, dest Destination,
+	key string, opts FetchOptions) (string, func(), error) {
+	if err := CheckKey(plan, store, dest.Name(), key); err != nil {
+		return "", func() {}, err
+	}
+	name := path.Base(key)
+	tmpDir := ""
+	cleanup := func() {
+		if tmpDir != "" {
+			os.RemoveAll(tmpDir)
+		}
+	}
+
+	var expected string
+	if store != nil {
+		archive, err := store.GetArchive(plan.Name, name)
+		if err != nil {
+			return "", cleanup, err
+		}
+		if archive != nil {
+			expected = archive.Checksum
+		}
+	}
+
+	localDest, local := dest.(*localDestination)
+	if !local || strings.HasSuffix(name, ".encrypted") {
+		// each fetch gets its own dir, concurrent restores and drills may fetch the same archive
+		dir, err := os.MkdirTemp(conf.TmpPath, "fetch-")
+		if err != nil {
+			return "", cleanup, errors.Wrapf(err, "Creating a temp dir in %v failed", conf.TmpPath)
+		}
+		tmpDir = dir
+	}
+
+	var file string
+	var checksum string
+	var err error
+	if local {
+		// no copy of the local archives
+		file = localDest.path(key)
+		checksum, err = fileChecksum(file)
+	} else {
+		file = filepath.Join(tmpDir, name)
+		checksum, err = download(ctx, dest, key, file)
+	}
+	if err != nil {
+		return "", cleanup, err
+	}
+
+	if expected == "" {
+		log.WithField("plan", plan.Name).Warnf("Restore: no checksum recorded for %v, verification skipped", name)
+	} else if checksum != expected {
+		return "", cleanup, errors.Errorf("checksum mismatch for %v on %v: got %v, expected %v",
+			name, dest.Name(), checksum, expected)
+	}
+
+	if strings.HasSuffix(name, ".encrypted") {
+		if opts.KeyFile != "" {
+			if _, err := gpgImportSecretKey(opts.KeyFile, opts.PassphraseFile); err != nil {
+				return "", cleanup, err
+			}
+		}
+		decrypted := filepath.Join(tmpDir, strings.TrimSuffix(name, ".encrypted"))
+		if _, err := gpgDecrypt(ctx, file, decrypted, opts.PassphraseFile); err != nil {
+			return "", cleanup, err
+		}
+		file = decrypted
+	}
+
+	return file, cleanup, nil
+}
+
+// InvalidKeyError is returned for the archive keys escaping the destination root
+type InvalidKeyError struct {
+	Key string
+}
+
+func (e *InvalidKeyError) Error() string {
+	return fmt.Sprintf("invalid archive key %v", e.Key)
+}
+
+// ForeignKeyError is returned for the archive keys that are not archives of the plan
+type ForeignKeyError struct {
+	Plan string
+	Key  string
+}
+
+func (e *ForeignKeyError) Error() string {
+	return fmt.Sprintf("%v is not an archive of plan %v", e.Key, e.Plan)
+}
+
+// CheckKey accepts the keys of the plan manifest, and the legacy archive names of the plan in the
+// plan dir of the local storage or at the root of the other destinations
+func CheckKey(plan config.Plan, store *db.StatusStore, destination string, key string) error {
+	if key == "" || path.IsAbs(key) || path.Clean(key) != key || key == ".." || strings.HasPrefix(key, "../") {
+		return &InvalidKeyError{Key: key}
+	}
+	name := path.Base(key)
+	if store != nil {
+		archive, err := store.GetArchive(plan.Name, name)
+		if err != nil {
+			return err
+		}
+		if archive != nil && archive.Key == key {
+			return nil
+		}
+	}
+	dir := "."
+	if destination == "local" {
+		dir = plan.Name
+	}
+	if path.Dir(key) == dir && isPlanArchive(plan, name) {
+		return nil
+	}
+	return &ForeignKeyError{Plan: plan.Name, Key: key}
+}
+
+func download(ctx context.Context, dest Destination, key string, file string) (string, error) {
+	t1 := time.Now()
+	rc, err := dest.Open(key)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		rc.Close()
+		return "", errors.Wrapf(err, "Creating file %v failed", file)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), contextReader{ctx, rc})
+	if closeErr := rc.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "%v downloading %v failed", dest.Name(), key)
+	}
+
+	log.Debugf("%v download of %v finished, %v bytes in %v", dest.Name(), key, n, time.Since(t1))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// contextReader stops a copy when ctx is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func fileChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "Opening file %v failed", file)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "Reading file %v failed", file)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type localDestination struct {
+	root string
+	plan config.Plan
+}
+
+func (d *localDestination) Name() string {
+	return "local"
+}
+
+// List walks the plan dir, or the whole storage when templated layouts may place archives elsewhere
+func (d *localDestination) List() ([]RemoteArchive, error) {
+	objects := make([]RemoteArchive, 0)
+	dir := filepath.Join(d.root, d.plan.Name)
+	if hasLayout(d.plan) {
+		dir = d.root
+	}
+
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !strings.Contains(info.Name(), ".gz") {
+			return nil
+		}
+		key, err := filepath.Rel(d.root, file)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, RemoteArchive{
+			Key:      filepath.ToSlash(key),
+			Size:     info.Size(),
+			Modified: info.ModTime().UTC(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %v failed", dir)
+	}
+	return objects, nil
+}
+
+func (d *localDestination) Open(key string) (io.ReadCloser, error) {
+	file := d.path(key)
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Opening file %v failed", file)
+	}
+	return f, nil
+}
+
+func (d *localDestination) path(key string) string {
+	return filepath.Join(d.root, filepath.FromSlash(key))
+}
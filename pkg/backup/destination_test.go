@@ -0,0 +1,172 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ListArchives_local(t *testing.T) {
+	storage := t.TempDir()
+	planDir := filepath.Join(storage, "mongo-test")
+	assert.NoError(t, os.MkdirAll(planDir, 0755))
+	for _, name := range []string{"mongo-test-1.gz", "mongo-test-2.gz.encrypted", "mongo-test-2.log", "other.txt"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(planDir, name), []byte(name), 0644))
+	}
+
+	plan := config.Plan{Name: "mongo-test", Scheduler: config.Scheduler{Retention: 2}}
+	dest, err := GetDestination(plan, &config.AppConfig{StoragePath: storage}, "local")
+	assert.NoError(t, err)
+
+	archives, err := ListArchives(plan, nil, dest)
+	assert.NoError(t, err)
+	assert.Len(t, archives, 2)
+	for _, archive := range archives {
+		assert.Contains(t, []string{"mongo-test/mongo-test-1.gz", "mongo-test/mongo-test-2.gz.encrypted"}, archive.Key)
+		assert.Equal(t, archive.Key == "mongo-test/mongo-test-2.gz.encrypted", archive.Encrypted)
+	}
+
+	_, err = GetDestination(plan, &config.AppConfig{StoragePath: storage}, "s3")
+	assert.Error(t, err)
+}
+
+func Test_FetchArchive_checksum(t *testing.T) {
+	dir := t.TempDir()
+	bolt, err := db.Open(filepath.Join(dir, "mgob.db"))
+	assert.NoError(t, err)
+	defer bolt.Close()
+	store, err := db.NewStatusStore(bolt)
+	assert.NoError(t, err)
+
+	storage := filepath.Join(dir, "storage")
+	assert.NoError(t, os.MkdirAll(filepath.Join(storage, "mongo-test"), 0755))
+	file := filepath.Join(storage, "mongo-test", "mongo-test-1.gz")
+	assert.NoError(t, os.WriteFile(file, []byte("archive"), 0644))
+	checksum, err := fileChecksum(file)
+	assert.NoError(t, err)
+
+	plan := config.Plan{Name: "mongo-test", Scheduler: config.Scheduler{Retention: 2}}
+	conf := &config.AppConfig{StoragePath: storage, TmpPath: dir}
+	dest, err := GetDestination(plan, conf, "local")
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.PutArchive(&db.Archive{Plan: plan.Name, Name: "mongo-test-1.gz", Timestamp: time.Now(), Checksum: checksum}))
+	path, cleanup, err := FetchArchive(context.Background(), plan, conf, store, dest, "mongo-test/mongo-test-1.gz", FetchOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, file, path)
+	cleanup()
+	assert.FileExists(t, file)
+
+	assert.NoError(t, store.PutArchive(&db.Archive{Plan: plan.Name, Name: "mongo-test-1.gz", Timestamp: time.Now(), Checksum: "bad"}))
+	_, cleanup, err = FetchArchive(context.Background(), plan, conf, store, dest, "mongo-test/mongo-test-1.gz", FetchOptions{})
+	cleanup()
+	assert.ErrorContains(t, err, "checksum mismatch")
+
+	_, cleanup, err = FetchArchive(context.Background(), plan, conf, store, dest, "../mongo-test-1.gz", FetchOptions{})
+	cleanup()
+	assert.ErrorContains(t, err, "invalid archive key")
+}
+
+func Test_isPlanArchive(t *testing.T) {
+	plan := config.Plan{Name: "db"}
+	tests := map[string]bool{
+		"db-1494056760.gz":                    true,
+		"db-1494056760.gz.encrypted":          true,
+		"db-snapshot-1494056760.gz":           true,
+		"db-staging-1494056760.gz":            false,
+		"db-staging-snapshot-1494056760.gz":   false,
+		"db-1494056760.log":                   false,
+		"db-1494056760.gz.encrypted.rotating": false,
+		"other-db-1494056760.gz":              false,
+	}
+	for name, expected := range tests {
+		assert.Equal(t, expected, isPlanArchive(plan, name), name)
+	}
+}
+
+func Test_CheckKey(t *testing.T) {
+	bolt, err := db.Open(filepath.Join(t.TempDir(), "mgob.db"))
+	assert.NoError(t, err)
+	defer bolt.Close()
+	store, err := db.NewStatusStore(bolt)
+	assert.NoError(t, err)
+
+	plan := config.Plan{Name: "orders"}
+	assert.NoError(t, store.PutArchive(&db.Archive{Plan: "orders", Name: "backup.gz", Key: "2023/01/orders/backup.gz"}))
+	assert.NoError(t, store.PutArchive(&db.Archive{Plan: "users", Name: "users-1494056760.gz", Key: "users/users-1494056760.gz"}))
+
+	tests := []struct {
+		destination string
+		key         string
+		err         interface{}
+	}{
+		{"local", "orders/orders-1494056760.gz", nil},
+		{"local", "orders/snapshots/orders-snapshot-1494056760.gz", &ForeignKeyError{}},
+		{"local", "2023/01/orders/backup.gz", nil},
+		{"local", "users/users-1494056760.gz", &ForeignKeyError{}},
+		{"local", "users/orders-1494056760.gz", &ForeignKeyError{}},
+		{"local", "orders/../users/users-1494056760.gz", &InvalidKeyError{}},
+		{"s3", "orders-1494056760.gz.encrypted", nil},
+		{"s3", "users-1494056760.gz", &ForeignKeyError{}},
+		{"s3", "orders/orders-1494056760.gz", &ForeignKeyError{}},
+	}
+	for _, test := range tests {
+		err := CheckKey(plan, store, test.destination, test.key)
+		if test.err == nil {
+			assert.NoError(t, err, test.key)
+		} else {
+			assert.IsType(t, test.err, err, test.key)
+		}
+	}
+}
+
+// memDestination serves objects from memory, as a remote destination
+type memDestination map[string]string
+
+func (d memDestination) Name() string { return "mem" }
+
+func (d memDestination) List() ([]RemoteArchive, error) {
+	objects := make([]RemoteArchive, 0, len(d))
+	for key, content := range d {
+		objects = append(objects, RemoteArchive{Key: key, Size: int64(len(content))})
+	}
+	return objects, nil
+}
+
+func (d memDestination) Open(key string) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(d[key])), nil
+}
+
+func Test_FetchArchive_tmpDir(t *testing.T) {
+	tmp := t.TempDir()
+	plan := config.Plan{Name: "mongo-test"}
+	conf := &config.AppConfig{TmpPath: tmp}
+	dest := memDestination{"mongo-test-1.gz": "archive"}
+
+	first, cleanupFirst, err := FetchArchive(context.Background(), plan, conf, nil, dest, "mongo-test-1.gz", FetchOptions{})
+	assert.NoError(t, err)
+	second, cleanupSecond, err := FetchArchive(context.Background(), plan, conf, nil, dest, "mongo-test-1.gz", FetchOptions{})
+	assert.NoError(t, err)
+
+	// a fetch of the same archive doesn't overwrite the one in use
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, "mongo-test-1.gz", filepath.Base(first))
+	cleanupFirst()
+	assert.NoFileExists(t, first)
+	content, err := os.ReadFile(second)
+	assert.NoError(t, err)
+	assert.Equal(t, "archive", string(content))
+
+	cleanupSecond()
+	entries, err := os.ReadDir(tmp)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,189 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/archive"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+// Drill fetches an archive of the plan from the drill destination, restores it into the validation
+// database and checks it like a new backup. The report is stored and returned with the error.
+// Cancelling ctx stops the fetch and the restore.
+func Drill(ctx context.Context, plan config.Plan, conf *config.AppConfig, store *db.StatusStore) (*db.Drill, error) {
+	t1 := time.Now()
+	report := &db.Drill{
+		Plan:      plan.Name,
+		Timestamp: t1.UTC(),
+		Status:    "failed",
+	}
+
+	err := drill(ctx, plan, conf, store, report)
+	report.Duration = time.Since(t1)
+	if err != nil {
+		report.Error = redact.Error(err)
+		if ctx.Err() != nil {
+			report.Status = "cancelled"
+		}
+	} else {
+		report.Status = "passed"
+	}
+
+	if store != nil {
+		if err := store.AddDrill(report); err != nil {
+			log.WithField("plan", plan.Name).Errorf("Drill report store failed %v", err)
+		}
+	}
+	return report, err
+}
+
+func drill(ctx context.Context, plan config.Plan, conf *config.AppConfig, store *db.StatusStore, report *db.Drill) error {
+	if plan.Drill == nil {
+		return errors.Errorf("plan %v has no drill", plan.Name)
+	}
+	if plan.Validation == nil {
+		return errors.Errorf("plan %v has no validation database to restore its drills into", plan.Name)
+	}
+	if err := checkValidation(*plan.Validation); err != nil {
+		return err
+	}
+
+	report.Destination = plan.Drill.Destination
+	if report.Destination == "" {
+		report.Destination = "local"
+	}
+	report.Pick = plan.Drill.Pick
+	if report.Pick == "" {
+		report.Pick = "latest"
+	}
+
+	dest, err := GetDestination(plan, conf, report.Destination)
+	if err != nil {
+		return err
+	}
+	objects, err := ListArchives(plan, store, dest)
+	if err != nil {
+		return errors.Wrapf(err, "listing the archives on %v failed", report.Destination)
+	}
+	candidates, err := drillCandidates(plan, store, objects)
+	if err != nil {
+		return err
+	}
+	object, err := pickArchive(candidates, report.Pick)
+	if err != nil {
+		return errors.Wrapf(err, "no archive of plan %v to drill on %v", plan.Name, report.Destination)
+	}
+	report.Archive = object.Name
+	report.ArchiveTime = object.Modified.UTC()
+	log.WithField("plan", plan.Name).Infof("Drill of %v archive %v from %v started", report.Pick, object.Name, report.Destination)
+
+	t1 := time.Now()
+	file, cleanup, err := FetchArchive(ctx, plan, conf, store, dest, object.Key, FetchOptions{
+		KeyFile:        plan.Drill.KeyFile,
+		PassphraseFile: plan.Drill.PassphraseFile,
+	})
+	defer cleanup()
+	report.FetchDuration = time.Since(t1)
+	if err != nil {
+		return err
+	}
+
+	contents, err := archive.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	// the target has moved on since the archive was made, its content can't be compared
+	validation := *plan.Validation
+	validation.Checksum = ""
+	plan.Validation = &validation
+
+	report.Validation, err = validate(ctx, plan, conf, file, archivedDocMap(contents))
+	if report.Validation != nil {
+		report.TimeToRestore = report.FetchDuration + report.Validation.RestoreDuration
+	}
+	return err
+}
+
+// DrillSummary formats a drill report for the notifications
+func DrillSummary(report *db.Drill) string {
+	lines := []string{
+		fmt.Sprintf("Drill %v of plan %v", report.Status, report.Plan),
+		fmt.Sprintf("Archive: %v (%v) from %v, %v pick", report.Archive, report.ArchiveTime.Format(time.RFC3339), report.Destination, report.Pick),
+		fmt.Sprintf("Time to restore: %v (download %v), total %v", report.TimeToRestore, report.FetchDuration, report.Duration),
+	}
+	if report.Validation != nil {
+		failed := 0
+		for _, c := range report.Validation.Collections {
+			if len(c.Errors) > 0 {
+				failed++
+				lines = append(lines, fmt.Sprintf("%v: %v", c.Collection, strings.Join(c.Errors, "; ")))
+			}
+		}
+		lines = append(lines, fmt.Sprintf("Collections: %v checked, %v failed", len(report.Validation.Collections), failed))
+		for _, target := range report.Validation.Targets {
+			lines = append(lines, strings.TrimSpace(fmt.Sprintf("Target %v %v: %v %v", target.Label, target.Version, target.Status, target.Error)))
+		}
+	}
+	if report.Error != "" {
+		lines = append(lines, fmt.Sprintf("Error: %v", report.Error))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// drillCandidates leaves out the pinned archives, the snapshots of the restore targets
+func drillCandidates(plan config.Plan, store *db.StatusStore, objects []RemoteArchive) ([]RemoteArchive, error) {
+	if store == nil {
+		return objects, nil
+	}
+	candidates := make([]RemoteArchive, 0, len(objects))
+	for _, object := range objects {
+		archive, err := store.GetArchive(plan.Name, object.Name)
+		if err != nil {
+			return nil, err
+		}
+		if archive != nil && archive.Pinned {
+			continue
+		}
+		candidates = append(candidates, object)
+	}
+	return candidates, nil
+}
+
+// pickArchive chooses among archives sorted newest first
+func pickArchive(archives []RemoteArchive, pick string) (RemoteArchive, error) {
+	if len(archives) == 0 {
+		return RemoteArchive{}, errors.New("no archive found")
+	}
+	switch pick {
+	case "", "latest":
+		return archives[0], nil
+	case "oldest":
+		return archives[len(archives)-1], nil
+	case "random":
+		return archives[rand.Intn(len(archives))], nil
+	}
+	return RemoteArchive{}, errors.Errorf("unknown drill pick %v, use latest, random or oldest", pick)
+}
+
+// archivedDocMap lists the collections of an archive with their document count, like getDumpedDocMap
+func archivedDocMap(contents *archive.Contents) map[string]string {
+	result := make(map[string]string)
+	for _, c := range contents.Collections {
+		if c.Database == "" {
+			continue
+		}
+		result[c.Namespace()] = strconv.FormatInt(c.Documents, 10)
+	}
+	return result
+}
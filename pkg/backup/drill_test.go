@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/stefanprodan/mgob/pkg/archive"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+func Test_pickArchive(t *testing.T) {
+	archives := []RemoteArchive{{Name: "mongo-test-3.gz"}, {Name: "mongo-test-2.gz"}, {Name: "mongo-test-1.gz"}}
+
+	latest, err := pickArchive(archives, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "mongo-test-3.gz", latest.Name)
+
+	oldest, err := pickArchive(archives, "oldest")
+	assert.NoError(t, err)
+	assert.Equal(t, "mongo-test-1.gz", oldest.Name)
+
+	random, err := pickArchive(archives, "random")
+	assert.NoError(t, err)
+	assert.Contains(t, archives, random)
+
+	_, err = pickArchive(archives, "first")
+	assert.Error(t, err)
+	_, err = pickArchive(nil, "latest")
+	assert.Error(t, err)
+}
+
+func Test_archivedDocMap(t *testing.T) {
+	contents := &archive.Contents{Collections: []archive.Collection{
+		{Database: "test", Collection: "users", Documents: 3},
+		{Database: "test", Collection: "orders", Documents: 0},
+		{Database: "", Collection: "oplog", Documents: 12},
+	}}
+	assert.Equal(t, map[string]string{"test.users": "3", "test.orders": "0"}, archivedDocMap(contents))
+}
+
+func Test_Drill(t *testing.T) {
+	dir := t.TempDir()
+	bolt, err := db.Open(filepath.Join(dir, "mgob.db"))
+	assert.NoError(t, err)
+	defer bolt.Close()
+	store, err := db.NewStatusStore(bolt)
+	assert.NoError(t, err)
+
+	storage := filepath.Join(dir, "storage")
+	assert.NoError(t, os.MkdirAll(filepath.Join(storage, "mongo-test"), 0755))
+	for i, name := range []string{"mongo-test-1.gz", "mongo-test-2.gz", "mongo-test-snapshot-3.gz"} {
+		file := filepath.Join(storage, "mongo-test", name)
+		assert.NoError(t, os.WriteFile(file, []byte("not an archive"), 0644))
+		modified := time.Now().Add(time.Duration(i) * time.Hour)
+		assert.NoError(t, os.Chtimes(file, modified, modified))
+	}
+	assert.NoError(t, store.PutArchive(&db.Archive{Plan: "mongo-test", Name: "mongo-test-snapshot-3.gz", Pinned: true}))
+
+	plan := config.Plan{
+		Name:       "mongo-test",
+		Scheduler:  config.Scheduler{Retention: 2},
+		Validation: &config.Validation{Database: config.Target{Host: "127.0.0.1", Port: 27017, Database: "test_restore"}},
+		Drill:      &config.Drill{Cron: "0 3 * * 0"},
+	}
+	conf := &config.AppConfig{StoragePath: storage, TmpPath: dir}
+
+	// the archive is unreadable, the drill fails before the restore
+	report, err := Drill(context.Background(), plan, conf, store)
+	assert.Error(t, err)
+	assert.Equal(t, "failed", report.Status)
+	assert.Equal(t, "local", report.Destination)
+	assert.Equal(t, "latest", report.Pick)
+	assert.Equal(t, "mongo-test-2.gz", report.Archive)
+	assert.NotEmpty(t, report.Error)
+
+	plan.Drill.Pick = "oldest"
+	report, err = Drill(context.Background(), plan, conf, store)
+	assert.Error(t, err)
+	assert.Equal(t, "mongo-test-1.gz", report.Archive)
+
+	drills, err := store.GetDrills(plan.Name, 0)
+	assert.NoError(t, err)
+	assert.Len(t, drills, 2)
+	assert.Equal(t, "mongo-test-1.gz", drills[0].Archive)
+	assert.Equal(t, "mongo-test-2.gz", drills[1].Archive)
+
+	drills, err = store.GetDrills("mongo", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, drills)
+
+	plan.Validation = nil
+	_, err = Drill(context.Background(), plan, conf, store)
+	assert.Error(t, err)
+}
+
+func Test_DrillSummary(t *testing.T) {
+	summary := DrillSummary(&db.Drill{
+		Plan:          "mongo-test",
+		Status:        "failed",
+		Archive:       "mongo-test-1.gz",
+		Destination:   "s3",
+		Pick:          "random",
+		TimeToRestore: 3 * time.Minute,
+		Validation: &db.Validation{Collections: []db.CollectionValidation{
+			{Collection: "users"},
+			{Collection: "orders", Errors: []string{"index total_1 is missing"}},
+		}},
+	})
+	assert.Contains(t, summary, "Drill failed of plan mongo-test")
+	assert.Contains(t, summary, "Time to restore: 3m0s")
+	assert.Contains(t, summary, "orders: index total_1 is missing")
+	assert.Contains(t, summary, "Collections: 2 checked, 1 failed")
+}
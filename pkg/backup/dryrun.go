@@ -0,0 +1,306 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+const dryRunDialTimeout = 5 * time.Second
+
+type DryRunCommand struct {
+	Stage   string `json:"stage"`
+	Command string `json:"command"`
+}
+
+type DryRunCheck struct {
+	Name      string        `json:"name"`
+	Address   string        `json:"address"`
+	Reachable bool          `json:"reachable"`
+	Error     string        `json:"error,omitempty"`
+	Latency   time.Duration `json:"latency"`
+}
+
+type DryRunReport struct {
+	Plan         config.Plan     `json:"plan"`
+	Archive      string          `json:"archive"`
+	Commands     []DryRunCommand `json:"commands"`
+	Reachability []DryRunCheck   `json:"reachability"`
+	Retention    []string        `json:"retention"`
+	Warnings     []string        `json:"warnings,omitempty"`
+}
+
+// cmdRecorder is the executor of a dry run, the commands reaching runCmdOutput are recorded instead of run
+type cmdRecorder struct {
+	mu       sync.Mutex
+	commands []DryRunCommand
+}
+
+type recordingKey struct{}
+
+type recording struct {
+	recorder *cmdRecorder
+	stage    string
+}
+
+func (r *cmdRecorder) add(stage string, argv []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = append(r.commands, DryRunCommand{
+		Stage:   stage,
+		Command: redact.String(strings.Join(argv, " ")),
+	})
+}
+
+// context makes the functions of Run record their commands under stage
+func (r *cmdRecorder) context(stage string) context.Context {
+	return context.WithValue(context.Background(), recordingKey{}, recording{recorder: r, stage: stage})
+}
+
+// record adds argv to the dry run of ctx, it tells the caller to skip the command when ctx is a dry run
+func record(ctx context.Context, argv []string) bool {
+	rec, ok := ctx.Value(recordingKey{}).(recording)
+	if !ok {
+		return false
+	}
+	rec.recorder.add(rec.stage, argv)
+	return true
+}
+
+// dryRun tells if ctx belongs to a dry run, for the steps of Run that don't go through a command
+func dryRun(ctx context.Context) bool {
+	_, ok := ctx.Value(recordingKey{}).(recording)
+	return ok
+}
+
+// DryRun reports what Run would execute for a plan without dumping, uploading or deleting anything.
+// The commands come from the functions of Run, recorded instead of run. Commands and the plan are
+// redacted, the target and destinations are only probed with a TCP dial.
+func DryRun(plan config.Plan, conf *config.AppConfig, store *db.StatusStore) (DryRunReport, error) {
+	report := DryRunReport{
+		Plan:         plan.Redacted(),
+		Commands:     make([]DryRunCommand, 0),
+		Reachability: make([]DryRunCheck, 0),
+		Retention:    make([]string, 0),
+	}
+	rec := &cmdRecorder{commands: make([]DryRunCommand, 0)}
+
+	if plan.Refresh != nil {
+		return report, errors.Errorf("plan %v is a refresh job, it has nothing to back up", plan.Name)
+	}
+
+	ts := time.Now().UTC()
+	archive, mlog := archivePaths(plan, conf.TmpPath, ts)
+	report.Archive = archive
+
+	dumpCmd, err := BuildDumpCmd(archive, plan.Target)
+	if err != nil {
+		return report, err
+	}
+	timeout := time.Duration(plan.Scheduler.Timeout) * time.Minute
+	if _, _, err := runDump(rec.context("dump"), dumpCmd, plan.Retry, archive, nil, 0, timeout); err != nil {
+		return report, err
+	}
+
+	// the validation talks to the databases with the driver, its restores are listed instead
+	if plan.Validation != nil {
+		if err := checkValidation(*plan.Validation); err != nil {
+			return report, err
+		}
+		if err := dryRunValidation(plan, conf, archive, plan.Validation.Database, plan.Validation.Ephemeral, "validation", rec.add); err != nil {
+			return report, err
+		}
+		for _, target := range plan.Validation.Targets {
+			if err := dryRunValidation(plan, conf, archive, target.Database, target.Ephemeral, "validation "+target.Label, rec.add); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	file := archive
+	if plan.Encryption != nil {
+		encryptedFile := fmt.Sprintf("%v.encrypted", archive)
+		if _, _, err := encrypt(rec.context("encrypt"), archive, encryptedFile, plan, conf); err != nil {
+			// Run uploads the unencrypted archive in that case
+			report.Warnings = append(report.Warnings, redact.Error(err))
+		} else {
+			file = encryptedFile
+		}
+	}
+
+	key, err := archiveKey(plan, ts, file)
+	if err != nil {
+		return report, err
+	}
+
+	for _, u := range uploaders(plan, conf, mlog) {
+		if _, err := u.upload(rec.context(u.name), file, key); err != nil {
+			report.Warnings = append(report.Warnings, redact.Error(err))
+		}
+		switch u.name {
+		case "local":
+			if plan.Scheduler.Retention > 0 {
+				files, err := dryRunRetention(plan, conf, store, key, localPlanDir(conf.StoragePath, file, key, plan))
+				if err != nil {
+					report.Warnings = append(report.Warnings, redact.Error(err))
+				} else {
+					report.Retention = files
+				}
+			}
+		case "sftp":
+			report.Reachability = append(report.Reachability,
+				dialCheck("sftp", net.JoinHostPort(plan.SFTP.Host, fmt.Sprint(plan.SFTP.Port))))
+		case "s3":
+			report.Reachability = append(report.Reachability, dialCheck("s3", urlAddress(plan.S3.URL)))
+		case "gcloud":
+			report.Reachability = append(report.Reachability, dialCheck("gcloud", "storage.googleapis.com:443"))
+		case "azure":
+			report.Reachability = append(report.Reachability,
+				dialCheck("azure", azureAddress(plan.Azure.ConnectionString)))
+		case "rclone":
+			report.Warnings = append(report.Warnings, "rclone remotes are not probed for reachability")
+		}
+	}
+
+	if _, err := cleanup(rec.context("cleanup"), file, mlog); err != nil {
+		return report, err
+	}
+	report.Commands = rec.commands
+
+	hosts, err := targetAddresses(plan.Target)
+	if err != nil {
+		report.Reachability = append([]DryRunCheck{{Name: "target", Error: redact.Error(err)}}, report.Reachability...)
+	} else {
+		checks := make([]DryRunCheck, 0, len(hosts))
+		for _, host := range hosts {
+			checks = append(checks, dialCheck("target", host))
+		}
+		report.Reachability = append(checks, report.Reachability...)
+	}
+
+	return report, nil
+}
+
+func dryRunRetention(plan config.Plan, conf *config.AppConfig, store *db.StatusStore, key string, planDir string) ([]string, error) {
+	if key == "" {
+		return retentionCandidates(planDir, plan.Scheduler.Retention-1)
+	}
+	if store == nil {
+		return nil, errors.New("retention of templated layouts needs the manifest")
+	}
+	archives, err := store.GetArchives(plan.Name)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0)
+	for _, archive := range manifestRetentionCandidates(archives, "local", plan.Scheduler.Retention-1) {
+		files = append(files, filepath.Join(conf.StoragePath, filepath.FromSlash(archive.Key)))
+	}
+	return files, nil
+}
+
+func dialCheck(name string, address string) DryRunCheck {
+	check := DryRunCheck{Name: name, Address: address}
+	t1 := time.Now()
+	conn, err := net.DialTimeout("tcp", address, dryRunDialTimeout)
+	check.Latency = time.Since(t1)
+	if err != nil {
+		check.Error = redact.Error(err)
+		return check
+	}
+	conn.Close()
+	check.Reachable = true
+	return check
+}
+
+// targetAddresses lists the host:port pairs of a target, SRV uris are resolved
+func targetAddresses(target config.Target) ([]string, error) {
+	if target.Uri == "" {
+		hosts := make([]string, 0)
+		for _, host := range strings.Split(target.Host, ",") {
+			hosts = append(hosts, withPort(strings.TrimSpace(host), fmt.Sprint(target.Port)))
+		}
+		return hosts, nil
+	}
+
+	cs, err := connstring.ParseAndValidate(target.Uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing target uri failed")
+	}
+	hosts := make([]string, 0, len(cs.Hosts))
+	for _, host := range cs.Hosts {
+		hosts = append(hosts, withPort(host, "27017"))
+	}
+	return hosts, nil
+}
+
+func urlAddress(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	port := "443"
+	if u.Scheme == "http" {
+		port = "80"
+	}
+	return withPort(u.Host, port)
+}
+
+// azureAddress finds the blob endpoint of a storage connection string
+func azureAddress(connectionString string) string {
+	account := ""
+	suffix := "core.windows.net"
+	for _, part := range strings.Split(connectionString, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "BlobEndpoint":
+			return urlAddress(kv[1])
+		case "AccountName":
+			account = kv[1]
+		case "EndpointSuffix":
+			suffix = kv[1]
+		}
+	}
+	return fmt.Sprintf("%v.blob.%v:443", account, suffix)
+}
+
+func withPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// dryRunValidation reports the commands restoring the archive into a validation target
+func dryRunValidation(plan config.Plan, conf *config.AppConfig, archive string, database config.Target,
+	ephemeral *config.Ephemeral, stage string, add func(string, []string)) error {
+	if ephemeral != nil {
+		mongodCmd, err := ephemeralCmd(*ephemeral, fmt.Sprintf("%v/%v<random>", conf.TmpPath, ephemeralPrefix+plan.Name+"-"), "<free port>")
+		if err != nil {
+			return err
+		}
+		add(stage, mongodCmd)
+		database = (&ephemeralMongod{}).target(database)
+	}
+	restoreCmd, err := BuildRestoreCmd(archive, plan.Target, database)
+	if err != nil {
+		return err
+	}
+	add(stage, restoreCmd)
+	return nil
+}
@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/redact"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_retentionCandidates(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"p-1.gz", "p-2.gz", "p-3.gz", "p-1.log", "p-2.log", "p-3.log"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte{}, 0644))
+	}
+
+	files, err := retentionCandidates(dir, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "p-1.gz"), filepath.Join(dir, "p-1.log")}, files)
+
+	// nothing is removed by listing candidates
+	files, err = filepath.Glob(filepath.Join(dir, "*"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 6)
+}
+
+func Test_DryRun(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	storage := t.TempDir()
+	planDir := filepath.Join(storage, "test")
+	assert.NoError(t, os.MkdirAll(planDir, 0755))
+	for _, name := range []string{"test-1.gz", "test-2.gz"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(planDir, name), []byte{}, 0644))
+	}
+
+	redact.Add("dry-run-secret")
+	plan := config.Plan{
+		Name: "test",
+		Target: config.Target{
+			Host:     "127.0.0.1",
+			Port:     port,
+			Database: "test",
+			Username: "admin",
+			Password: "dry-run-secret",
+		},
+		Scheduler: config.Scheduler{Retention: 2},
+	}
+	conf := &config.AppConfig{TmpPath: "/tmp", StoragePath: storage}
+
+	report, err := DryRun(plan, conf, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "dump", report.Commands[0].Stage)
+	for _, cmd := range report.Commands {
+		assert.False(t, strings.Contains(cmd.Command, "dry-run-secret"), cmd.Command)
+	}
+	assert.Equal(t, []string{filepath.Join(planDir, "test-1.gz")}, report.Retention)
+	assert.Len(t, report.Reachability, 1)
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%v", port), report.Reachability[0].Address)
+	assert.True(t, report.Reachability[0].Reachable)
+	assert.Len(t, report.Plan.Target.Password, len(redact.Mask))
+
+	// the archives are left untouched
+	files, _ := filepath.Glob(filepath.Join(planDir, "*.gz"))
+	assert.Len(t, files, 2)
+}
+
+func Test_DryRun_validationTargets(t *testing.T) {
+	plan := config.Plan{
+		Name:   "test",
+		Target: config.Target{Host: "127.0.0.1", Port: 1, Database: "test"},
+		Validation: &config.Validation{
+			Database: config.Target{Host: "127.0.0.1", Port: 27017, Database: "test_restore"},
+			Targets: []config.ValidationTarget{
+				{Label: "7.0", Ephemeral: &config.Ephemeral{Binary: "/opt/mongodb-7.0/bin/mongod"}},
+				{Label: "8.0", Database: config.Target{Host: "mongo8", Port: 27017, Database: "test_restore"}},
+			},
+		},
+	}
+
+	report, err := DryRun(plan, &config.AppConfig{TmpPath: "/tmp"}, nil)
+	assert.NoError(t, err)
+	stages := make([]string, 0)
+	for _, cmd := range report.Commands {
+		stages = append(stages, cmd.Stage)
+	}
+	assert.Equal(t, []string{"dump", "validation", "validation 7.0", "validation 7.0", "validation 8.0"}, stages[:5])
+	assert.True(t, strings.HasPrefix(report.Commands[2].Command, "/opt/mongodb-7.0/bin/mongod"))
+	assert.Contains(t, report.Commands[4].Command, "--host mongo8")
+
+	plan.Validation.Targets = append(plan.Validation.Targets, config.ValidationTarget{Label: "8.0", Database: config.Target{Host: "other"}})
+	_, err = DryRun(plan, &config.AppConfig{TmpPath: "/tmp"}, nil)
+	assert.Error(t, err)
+}
+
+func Test_azureAddress(t *testing.T) {
+	assert.Equal(t, "acc.blob.core.windows.net:443",
+		azureAddress("DefaultEndpointsProtocol=https;AccountName=acc;AccountKey=a2V5;EndpointSuffix=core.windows.net"))
+	assert.Equal(t, "127.0.0.1:10000",
+		azureAddress("AccountName=devstoreaccount1;BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;"))
+}
+
+func Test_DryRun_recordsRun(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "storage")
+	plan := config.Plan{
+		Name:      "test",
+		Target:    config.Target{Host: "127.0.0.1", Port: 1, Database: "test"},
+		Scheduler: config.Scheduler{Retention: 2},
+		S3:        &config.S3{URL: "http://127.0.0.1:1", Bucket: "backups", API: "S3v4"},
+	}
+
+	report, err := DryRun(plan, &config.AppConfig{TmpPath: "/tmp", StoragePath: storage}, nil)
+	assert.NoError(t, err)
+	byStage := make(map[string][]string)
+	for _, cmd := range report.Commands {
+		byStage[cmd.Stage] = append(byStage[cmd.Stage], cmd.Command)
+	}
+	assert.Len(t, byStage["dump"], 1)
+	assert.Equal(t, []string{"mkdir", "cp", "cp"}, commandNames(byStage["local"]))
+	assert.Equal(t, strings.Join(minioAliasCmd(plan), " "), byStage["s3"][0])
+	assert.Equal(t, strings.Join(minioUploadCmd(report.Archive, "", plan), " "), byStage["s3"][1])
+	assert.Equal(t, []string{"rm", "rm"}, commandNames(byStage["cleanup"]))
+
+	// the functions of Run only recorded their commands
+	assert.NoDirExists(t, storage)
+}
+
+func commandNames(commands []string) []string {
+	names := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		names = append(names, strings.Fields(cmd)[0])
+	}
+	return names
+}
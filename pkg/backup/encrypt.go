@@ -1,26 +1,26 @@
 package backup
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"regexp"
 	"strings"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/stefanprodan/mgob/pkg/config"
 )
 
-func encrypt(file string, encryptedFile string, plan config.Plan, conf *config.AppConfig) (string, error) {
+func encrypt(ctx context.Context, file string, encryptedFile string, plan config.Plan, conf *config.AppConfig) (string, []string, error) {
 	if plan.Encryption.Gpg != nil {
 		if !conf.HasGpg {
-			return "", errors.Errorf("GPG configuration is present, but no GPG binary is found! Uploading unencrypted backup.")
+			return "", nil, errors.Errorf("GPG configuration is present, but no GPG binary is found! Uploading unencrypted backup.")
 		}
-		return gpgEncrypt(file, encryptedFile, plan)
+		return gpgEncrypt(ctx, file, encryptedFile, plan)
 	}
 
-	return "", errors.Errorf("Encryption config is not valid!")
+	return "", nil, errors.Errorf("Encryption config is not valid!")
 }
 
 func removeUnencrypted(file string, encryptedFile string) {
@@ -31,62 +31,95 @@ func removeUnencrypted(file string, encryptedFile string) {
 	}
 }
 
-func gpgEncrypt(file string, encryptedFile string, plan config.Plan) (string, error) {
+func gpgEncrypt(ctx context.Context, file string, encryptedFile string, plan config.Plan) (string, []string, error) {
 	output := ""
-	recipient := ""
 
-	recipients := plan.Encryption.Gpg.Recipients
+	recipients := append([]string{}, plan.Encryption.Gpg.Recipients...)
 
 	keyFile := plan.Encryption.Gpg.KeyFile
 	if keyFile != "" {
 		keyFileStat, err := os.Stat(keyFile)
 		if err == nil && !keyFileStat.IsDir() {
 			// import key from file
-			importCmd := fmt.Sprintf("gpg --batch --import  %v", keyFile)
-
-			result, err := sh.Command("/bin/sh", "-c", importCmd).CombinedOutput()
-			if len(result) > 0 {
-				output += strings.Replace(string(result), "\n", " ", -1)
-			}
+			stdout, stderr, err := runCmdContext(ctx, 0, nil, "gpg", "--batch", "--import", keyFile)
+			output += flatten(append(stdout, stderr...))
 			if err != nil {
-				return "", errors.Wrapf(err, "Importing encryption key for plan %v failed %s", plan.Name, output)
+				return "", nil, errors.Wrapf(err, "Importing encryption key for plan %v failed %s", plan.Name, output)
 			}
-			if !strings.Contains(output, "imported: 1") && !strings.Contains(output, "unchanged: 1") {
-				return "", errors.Errorf("Importing encryption key failed %v", output)
+			if dryRun(ctx) {
+				// the key is not imported, its id is unknown
+				recipients = append(recipients, fmt.Sprintf("<key id from %v>", keyFile))
+			} else if !strings.Contains(output, "imported: 1") && !strings.Contains(output, "unchanged: 1") {
+				return "", nil, errors.Errorf("Importing encryption key failed %v", output)
 			}
 
 			re := regexp.MustCompile(`key ([0-9A-F]+):`)
 			keyMatch := re.FindStringSubmatch(output)
 			log.WithField("plan", plan.Name).Debugf("Import output: %v", output)
-			log.WithField("plan", plan.Name).Debugf("Parsed key id: %v", keyMatch[1])
 			if keyMatch != nil {
+				log.WithField("plan", plan.Name).Debugf("Parsed key id: %v", keyMatch[1])
 				recipients = append(recipients, keyMatch[1])
 			}
 		}
 	}
 
-	recipient = strings.Join(recipients, " -r ")
+	if len(recipients) == 0 {
+		return "", nil, errors.Errorf("GPG configuration is present, but no encryption key is configured! %v", output)
+	}
 
-	if recipient == "" {
-		return "", errors.Errorf("GPG configuration is present, but no encryption key is configured! %v", output)
+	// encrypt file
+	stdout, stderr, err := runCmdContext(ctx, 0, nil, gpgEncryptCmd(file, encryptedFile, recipients, plan.Encryption.Gpg.KeyServer)...)
+	output += flatten(append(stdout, stderr...))
+	if err != nil {
+		os.Remove(encryptedFile)
+		return "", nil, errors.Wrapf(err, "Encryption for plan %v failed %s", plan.Name, output)
 	}
 
-	keyServer := plan.Encryption.Gpg.KeyServer
+	return output, recipients, nil
+}
+
+func gpgEncryptCmd(file string, encryptedFile string, recipients []string, keyServer string) []string {
 	if keyServer == "" {
 		keyServer = "hkps://keys.openpgp.org"
 	}
 
-	// encrypt file
-	encryptCmd := fmt.Sprintf(
-		"gpg -v --batch --yes --trust-model always --auto-key-locate local,%v -e -r %v -o %v %v",
-		keyServer, recipient, encryptedFile, file)
+	cmd := []string{"gpg", "-v", "--batch", "--yes", "--trust-model", "always",
+		"--auto-key-locate", fmt.Sprintf("local,%v", keyServer), "-e"}
+	for _, r := range recipients {
+		cmd = append(cmd, "-r", r)
+	}
+	return append(cmd, "-o", encryptedFile, file)
+}
 
-	result, err := sh.Command("/bin/sh", "-c", encryptCmd).CombinedOutput()
-	if len(result) > 0 {
-		output += strings.Replace(string(result), "\n", " ", -1)
+// gpgImportSecretKey imports the secret key used to decrypt archives
+func gpgImportSecretKey(keyFile string, passphraseFile string) (string, error) {
+	cmd := []string{"gpg", "--batch"}
+	if passphraseFile != "" {
+		cmd = append(cmd, "--pinentry-mode", "loopback", "--passphrase-file", passphraseFile)
 	}
+	cmd = append(cmd, "--import", keyFile)
+
+	stdout, stderr, err := runCmd(0, cmd...)
+	output := flatten(append(stdout, stderr...))
+	if err != nil {
+		return "", errors.Wrapf(err, "Importing decryption key %v failed %s", keyFile, output)
+	}
+
+	return output, nil
+}
+
+// gpgDecrypt decrypts a file with the secret keys found in the keyring
+func gpgDecrypt(ctx context.Context, file string, decryptedFile string, passphraseFile string) (string, error) {
+	cmd := []string{"gpg", "--batch", "--yes"}
+	if passphraseFile != "" {
+		cmd = append(cmd, "--pinentry-mode", "loopback", "--passphrase-file", passphraseFile)
+	}
+	cmd = append(cmd, "-o", decryptedFile, "-d", file)
+
+	stdout, stderr, err := runCmdContext(ctx, 0, nil, cmd...)
+	output := flatten(append(stdout, stderr...))
 	if err != nil {
-		return "", errors.Wrapf(err, "Encryption for plan %v failed %s", plan.Name, output)
+		return "", errors.Wrapf(err, "Decrypting %v failed %s", file, output)
 	}
 
 	return output, nil
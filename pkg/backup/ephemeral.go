@@ -0,0 +1,255 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// ephemeralPrefix names the dbpath of the validation mongods under TmpPath
+const ephemeralPrefix = "mgob-mongod-"
+
+// ephemeralOwner holds the pid and the instance of the mgob process owning a dbpath
+const ephemeralOwner = "mgob.pid"
+
+// ephemeralInstance tells this mgob process from a previous one that had the same pid,
+// such as pid 1 in a restarted container
+var ephemeralInstance = newInstanceID()
+
+func newInstanceID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf)
+}
+
+const defaultEphemeralStartTimeout = 60 * time.Second
+
+// ephemeralMongod is a mongod started for a single validation
+type ephemeralMongod struct {
+	plan   string
+	dir    string
+	port   int
+	cmd    *exec.Cmd
+	done   chan error
+	exited bool
+}
+
+// ephemeralCmd builds the mongod command line, listening on localhost only
+func ephemeralCmd(ephemeral config.Ephemeral, dir string, port string) ([]string, error) {
+	binary := ephemeral.Binary
+	if binary == "" {
+		binary = "mongod"
+	}
+	cmd := []string{binary,
+		"--dbpath", dir,
+		"--port", port,
+		"--bind_ip", "127.0.0.1",
+		"--nounixsocket",
+		"--logpath", filepath.Join(dir, "mongod.log"),
+	}
+	params, err := splitArgs(ephemeral.Params)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing ephemeral mongod params failed")
+	}
+	return append(cmd, params...), nil
+}
+
+// startEphemeral starts a mongod on a free port with a temporary dbpath and waits until it accepts connections
+func startEphemeral(plan config.Plan, tmpPath string) (*ephemeralMongod, error) {
+	SweepEphemeral(tmpPath)
+
+	dir, err := os.MkdirTemp(tmpPath, ephemeralPrefix+plan.Name+"-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating dbpath in %v failed", tmpPath)
+	}
+	owner := fmt.Sprintf("%v %v", os.Getpid(), ephemeralInstance)
+	if err := os.WriteFile(filepath.Join(dir, ephemeralOwner), []byte(owner), 0644); err != nil {
+		os.RemoveAll(dir)
+		return nil, errors.Wrapf(err, "writing %v failed", ephemeralOwner)
+	}
+
+	port, err := freePort()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	argv, err := ephemeralCmd(*plan.Validation.Ephemeral, dir, strconv.Itoa(port))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.SysProcAttr = ephemeralSysProcAttr()
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, &NotFoundError{Name: argv[0]}
+		}
+		return nil, errors.Wrapf(err, "running %v failed", argv[0])
+	}
+
+	m := &ephemeralMongod{plan: plan.Name, dir: dir, port: port, cmd: cmd, done: make(chan error, 1)}
+	go func() {
+		m.done <- cmd.Wait()
+	}()
+	log.WithField("plan", plan.Name).Infof("Validation: started %v on port %v with dbpath %v", argv[0], port, dir)
+
+	timeout := time.Duration(plan.Validation.Ephemeral.StartTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultEphemeralStartTimeout
+	}
+	if err := m.waitReady(timeout); err != nil {
+		m.Stop()
+		return nil, err
+	}
+	return m, nil
+}
+
+// target is the validation database served by the mongod
+func (m *ephemeralMongod) target(validation config.Target) config.Target {
+	database := validation.Database
+	if database == "" {
+		database = "validation"
+	}
+	return config.Target{
+		Host:     "127.0.0.1",
+		Port:     m.port,
+		Database: database,
+		NoGzip:   validation.NoGzip,
+	}
+}
+
+func (m *ephemeralMongod) waitReady(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	uri := BuildUri(config.Target{Host: "127.0.0.1", Port: m.port})
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetServerSelectionTimeout(time.Second))
+	if err != nil {
+		return errors.Wrap(err, "connecting to the validation mongod failed")
+	}
+	defer client.Disconnect(context.Background())
+
+	for {
+		if err := client.Ping(ctx, nil); err == nil {
+			return nil
+		}
+		select {
+		case err := <-m.done:
+			m.exited = true
+			return errors.Errorf("validation mongod exited before accepting connections: %v %v", err, m.logTail())
+		case <-ctx.Done():
+			return errors.Errorf("validation mongod not ready after %v %v", timeout, m.logTail())
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// logTail returns the last lines of the mongod log for the error messages
+func (m *ephemeralMongod) logTail() string {
+	buf, err := os.ReadFile(filepath.Join(m.dir, "mongod.log"))
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) > 5 {
+		lines = lines[len(lines)-5:]
+	}
+	return flatten([]byte(strings.Join(lines, "\n")))
+}
+
+// Stop shuts the mongod down, killing it if it doesn't exit in time, and removes its dbpath
+func (m *ephemeralMongod) Stop() {
+	if !m.exited {
+		if err := m.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			m.cmd.Process.Kill()
+		}
+		select {
+		case <-m.done:
+		case <-time.After(30 * time.Second):
+			log.WithField("plan", m.plan).Warnf("Validation: mongod on port %v killed after shutdown timeout", m.port)
+			m.cmd.Process.Kill()
+			<-m.done
+		}
+		m.exited = true
+	}
+	if err := os.RemoveAll(m.dir); err != nil {
+		log.WithField("plan", m.plan).Errorf("Validation: removing %v failed %v", m.dir, err)
+	}
+}
+
+// freePort asks the kernel for an unused local port
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, errors.Wrap(err, "finding a free port failed")
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// SweepEphemeral removes the dbpaths left in tmpPath by mgob processes that are no longer running
+func SweepEphemeral(tmpPath string) {
+	entries, err := os.ReadDir(tmpPath)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), ephemeralPrefix) {
+			continue
+		}
+		dir := filepath.Join(tmpPath, entry.Name())
+		if !staleEphemeral(dir) {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Errorf("Removing stale validation dbpath %v failed %v", dir, err)
+			continue
+		}
+		log.Infof("Removed stale validation dbpath %v", dir)
+	}
+}
+
+func staleEphemeral(dir string) bool {
+	buf, err := os.ReadFile(filepath.Join(dir, ephemeralOwner))
+	if err != nil {
+		// the owner may not have written its pid yet
+		fi, err := os.Stat(dir)
+		return err == nil && time.Since(fi.ModTime()) > time.Minute
+	}
+	fields := strings.Fields(string(buf))
+	if len(fields) == 0 {
+		return true
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return true
+	}
+	if len(fields) > 1 && fields[1] == ephemeralInstance {
+		return false
+	}
+	if pid == os.Getpid() {
+		// left by a previous process with the same pid
+		return true
+	}
+	return !processAlive(pid)
+}
@@ -0,0 +1,16 @@
+//go:build linux
+
+package backup
+
+import "syscall"
+
+// ephemeralSysProcAttr has the kernel kill the mongod when mgob dies,
+// its dbpath is then removed by the next sweep
+func ephemeralSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
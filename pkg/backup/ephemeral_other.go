@@ -0,0 +1,14 @@
+//go:build !linux
+
+package backup
+
+import "syscall"
+
+func ephemeralSysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// processAlive can't tell on this platform, the dbpaths are only removed by their owner
+func processAlive(pid int) bool {
+	return true
+}
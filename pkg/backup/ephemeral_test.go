@@ -0,0 +1,80 @@
+package backup
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+func TestEphemeralCmd(t *testing.T) {
+	cmd, err := ephemeralCmd(config.Ephemeral{Params: `--wiredTigerCacheSizeGB 0.25 --setParameter "diagnosticDataCollectionEnabled=false"`}, "/tmp/db", "27018")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mongod", "--dbpath", "/tmp/db", "--port", "27018", "--bind_ip", "127.0.0.1",
+		"--nounixsocket", "--logpath", "/tmp/db/mongod.log",
+		"--wiredTigerCacheSizeGB", "0.25", "--setParameter", "diagnosticDataCollectionEnabled=false"}, cmd)
+
+	cmd, err = ephemeralCmd(config.Ephemeral{Binary: "/opt/mongodb/bin/mongod"}, "/tmp/db", "27018")
+	assert.NoError(t, err)
+	assert.Equal(t, "/opt/mongodb/bin/mongod", cmd[0])
+}
+
+func TestEphemeralTarget(t *testing.T) {
+	m := &ephemeralMongod{port: 40123}
+	assert.Equal(t, config.Target{Host: "127.0.0.1", Port: 40123, Database: "validation", NoGzip: true},
+		m.target(config.Target{Host: "mongo", Port: 27017, Username: "admin", Password: "secret", NoGzip: true}))
+	assert.Equal(t, "test_restore", m.target(config.Target{Database: "test_restore"}).Database)
+}
+
+func TestSweepEphemeral(t *testing.T) {
+	tmp := t.TempDir()
+	owned := func(name string, pid string) string {
+		dir := filepath.Join(tmp, name)
+		assert.NoError(t, os.Mkdir(dir, 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, ephemeralOwner), []byte(pid), 0644))
+		return dir
+	}
+	running := owned(ephemeralPrefix+"running", strconv.Itoa(os.Getpid())+" "+ephemeralInstance)
+	// left by a previous mgob with the same pid, pid 1 in a restarted container
+	restarted := owned(ephemeralPrefix+"restarted", strconv.Itoa(os.Getpid())+" 0123456789abcdef")
+	legacy := owned(ephemeralPrefix+"legacy", strconv.Itoa(os.Getpid()))
+	corrupted := owned(ephemeralPrefix+"corrupted", "not a pid")
+	// a dbpath whose owner has not written its pid yet
+	starting := filepath.Join(tmp, ephemeralPrefix+"starting")
+	assert.NoError(t, os.Mkdir(starting, 0755))
+	other := owned("other", "not a pid")
+	exited := exec.Command("true")
+	assert.NoError(t, exited.Run())
+	dead := owned(ephemeralPrefix+"dead", strconv.Itoa(exited.Process.Pid))
+
+	SweepEphemeral(tmp)
+
+	assert.DirExists(t, running)
+	assert.DirExists(t, starting)
+	assert.DirExists(t, other)
+	assert.NoDirExists(t, corrupted)
+	assert.NoDirExists(t, restarted)
+	assert.NoDirExists(t, legacy)
+	if runtime.GOOS == "linux" {
+		assert.NoDirExists(t, dead)
+	}
+}
+
+func TestStartEphemeral_Exited(t *testing.T) {
+	tmp := t.TempDir()
+	plan := config.Plan{Name: "test", Validation: &config.Validation{Ephemeral: &config.Ephemeral{Binary: "false", StartTimeout: 10}}}
+
+	_, err := startEphemeral(plan, tmp)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exited before accepting connections")
+
+	entries, err := os.ReadDir(tmp)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
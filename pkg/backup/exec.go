@@ -0,0 +1,261 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/jobs"
+)
+
+// ExitError is returned when an external tool exits with a non-zero code
+type ExitError struct {
+	Name   string
+	Code   int
+	Stderr string
+}
+
+func (e *ExitError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("%v exited with code %v", e.Name, e.Code)
+	}
+	return fmt.Sprintf("%v exited with code %v: %v", e.Name, e.Code, e.Stderr)
+}
+
+// TimeoutError is returned when an external tool is killed after the plan timeout
+type TimeoutError struct {
+	Name    string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%v killed after %v timeout", e.Name, e.Timeout)
+}
+
+// CancelledError is returned when an external tool is killed because its job was cancelled
+type CancelledError struct {
+	Name string
+}
+
+func (e *CancelledError) Error() string {
+	return fmt.Sprintf("%v killed, job cancelled", e.Name)
+}
+
+func (e *CancelledError) Unwrap() error {
+	return context.Canceled
+}
+
+// NotFoundError is returned when an external tool is not installed
+type NotFoundError struct {
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%v executable not found in PATH", e.Name)
+}
+
+// runCmd executes argv without a shell, a zero timeout means no timeout.
+// stdout and stderr are captured separately, the error is one of the typed errors above.
+func runCmd(timeout time.Duration, argv ...string) ([]byte, []byte, error) {
+	return runCmdEnv(timeout, nil, argv...)
+}
+
+// runCmdEnv is runCmd with env added to the mgob environment
+func runCmdEnv(timeout time.Duration, env []string, argv ...string) ([]byte, []byte, error) {
+	return runCmdContext(context.Background(), timeout, env, argv...)
+}
+
+// runCmdContext is runCmdEnv killing the tool and its children when ctx is cancelled
+func runCmdContext(ctx context.Context, timeout time.Duration, env []string, argv ...string) ([]byte, []byte, error) {
+	return runCmdOutput(ctx, timeout, env, nil, argv...)
+}
+
+// runCmdOutput is runCmdContext copying stdout and stderr to output as they are produced,
+// and to the job log when ctx belongs to a job
+func runCmdOutput(ctx context.Context, timeout time.Duration, env []string, output io.Writer, argv ...string) ([]byte, []byte, error) {
+	if len(argv) == 0 {
+		return nil, nil, errors.New("empty command")
+	}
+	if record(ctx, argv) {
+		return nil, nil, nil
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	sinks := make([]io.Writer, 0)
+	if output != nil {
+		sinks = append(sinks, output)
+	}
+	if job := jobs.FromContext(ctx); job != nil {
+		fmt.Fprintf(job, "$ %v\n", strings.Join(argv, " "))
+		sinks = append(sinks, job)
+	}
+	if len(sinks) > 0 {
+		cmd.Stdout = io.MultiWriter(append([]io.Writer{&stdout}, sinks...)...)
+		cmd.Stderr = io.MultiWriter(append([]io.Writer{&stderr}, sinks...)...)
+	}
+	cmd.SysProcAttr = cmdSysProcAttr()
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd.Process)
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	err := cmd.Run()
+	if err == nil {
+		return stdout.Bytes(), stderr.Bytes(), nil
+	}
+
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, nil, &NotFoundError{Name: argv[0]}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return stdout.Bytes(), stderr.Bytes(), &TimeoutError{Name: argv[0], Timeout: timeout}
+	}
+	if ctx.Err() == context.Canceled {
+		return stdout.Bytes(), stderr.Bytes(), &CancelledError{Name: argv[0]}
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return stdout.Bytes(), stderr.Bytes(), &ExitError{
+			Name:   argv[0],
+			Code:   exitErr.ExitCode(),
+			Stderr: flatten(stderr.Bytes()),
+		}
+	}
+
+	return stdout.Bytes(), stderr.Bytes(), errors.Wrapf(err, "running %v failed", argv[0])
+}
+
+// cmdReader streams the stdout of a running tool, Close reports its exit status
+type cmdReader struct {
+	io.ReadCloser
+	name   string
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (r *cmdReader) Close() error {
+	r.ReadCloser.Close()
+	err := r.cmd.Wait()
+	if err == nil {
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{
+			Name:   r.name,
+			Code:   exitErr.ExitCode(),
+			Stderr: flatten(r.stderr.Bytes()),
+		}
+	}
+	return errors.Wrapf(err, "running %v failed", r.name)
+}
+
+// streamCmd starts argv without a shell and returns its stdout,
+// the caller must read it to the end and check the error of Close
+func streamCmd(argv ...string) (io.ReadCloser, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrapf(err, "running %v failed", argv[0])
+	}
+
+	if err := cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, &NotFoundError{Name: argv[0]}
+		}
+		return nil, errors.Wrapf(err, "running %v failed", argv[0])
+	}
+
+	return &cmdReader{ReadCloser: stdout, name: argv[0], cmd: cmd, stderr: &stderr}, nil
+}
+
+// RunHook executes a hook command without a shell, its stdout and stderr are returned combined
+func RunHook(command string, timeout time.Duration, env []string) ([]byte, error) {
+	argv, err := splitArgs(command)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing hook command failed")
+	}
+	stdout, stderr, err := runCmdEnv(timeout, env, argv...)
+	return append(stdout, stderr...), err
+}
+
+// flatten joins the lines of a tool output for log and error messages
+func flatten(output []byte) string {
+	return strings.TrimSpace(strings.Replace(string(output), "\n", " ", -1))
+}
+
+// splitArgs splits extra command line params like `--ssl --authenticationDatabase "my db"`,
+// honouring single and double quotes and backslash escapes the way a shell would
+func splitArgs(params string) ([]string, error) {
+	args := make([]string, 0)
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, r := range params {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.Errorf("unterminated quote in %v", params)
+	}
+	if escaped {
+		return nil, errors.Errorf("trailing backslash in %v", params)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
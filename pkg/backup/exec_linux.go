@@ -0,0 +1,18 @@
+//go:build linux
+
+package backup
+
+import (
+	"os"
+	"syscall"
+)
+
+// cmdSysProcAttr starts a tool in its own process group, so it can be killed with its children,
+// and has the kernel kill it when mgob dies
+func cmdSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+}
+
+func killProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package backup
+
+import (
+	"os"
+	"syscall"
+)
+
+func cmdSysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// killProcessGroup only kills the tool on this platform, its children are left running
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/jobs"
+)
+
+func Test_runCmd_special_chars(t *testing.T) {
+	arg := `pa"ss$HOME'word; echo injected`
+	stdout, _, err := runCmd(0, "echo", arg)
+	assert.NoError(t, err)
+	assert.Equal(t, arg+"\n", string(stdout))
+}
+
+func Test_runCmd_ExitError(t *testing.T) {
+	_, _, err := runCmd(0, "ls", "/mgob-does-not-exist")
+	exitErr, ok := err.(*ExitError)
+	assert.True(t, ok)
+	assert.Equal(t, "ls", exitErr.Name)
+	assert.NotEqual(t, 0, exitErr.Code)
+	assert.NotEmpty(t, exitErr.Stderr)
+}
+
+func Test_runCmd_NotFoundError(t *testing.T) {
+	_, _, err := runCmd(0, "mgob-does-not-exist")
+	_, ok := err.(*NotFoundError)
+	assert.True(t, ok)
+}
+
+func Test_runCmd_TimeoutError(t *testing.T) {
+	_, _, err := runCmd(10*time.Millisecond, "sleep", "1")
+	_, ok := err.(*TimeoutError)
+	assert.True(t, ok)
+}
+
+func Test_runCmdContext_CancelledError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	// the background sleep holds the output pipe, the command only returns if it is killed too
+	t1 := time.Now()
+	_, _, err := runCmdContext(ctx, time.Minute, nil, "sh", "-c", "sleep 10 & sleep 10")
+	_, ok := err.(*CancelledError)
+	assert.True(t, ok)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Less(t, time.Since(t1), 5*time.Second)
+}
+
+func Test_runCmdOutput(t *testing.T) {
+	job := jobs.NewManager(10).Start("backup", "mongo-test", "api")
+	var output bytes.Buffer
+	stdout, stderr, err := runCmdOutput(job.Context(), 0, nil, &output, "sh", "-c", "echo out; echo err >&2")
+	assert.NoError(t, err)
+	assert.Equal(t, "out\n", string(stdout))
+	assert.Equal(t, "err\n", string(stderr))
+	assert.Contains(t, output.String(), "out\n")
+	assert.Contains(t, output.String(), "err\n")
+
+	log, _, _, _ := job.Log(0)
+	assert.Contains(t, string(log), "$ sh -c echo out; echo err >&2\n")
+	assert.Contains(t, string(log), "err\n")
+}
+
+func Test_splitArgs(t *testing.T) {
+	args, err := splitArgs(`--ssl  --authenticationDatabase "my db" --tlsCertificateKeyFilePassword 'a "b" $c' --x=a\ b`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--ssl", "--authenticationDatabase", "my db", "--tlsCertificateKeyFilePassword", `a "b" $c`, "--x=a b"}, args)
+
+	args, err = splitArgs(`--empty ""`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--empty", ""}, args)
+
+	_, err = splitArgs(`--unterminated 'quote`)
+	assert.Error(t, err)
+}
+
+func Test_uploadCmds_special_chars(t *testing.T) {
+	plan := config.Plan{
+		Name: "mongo-test",
+		S3: &config.S3{
+			URL:       "https://play.min.io",
+			Bucket:    "backup",
+			AccessKey: "access",
+			SecretKey: `se"cr$et'`,
+			API:       "S3v4",
+		},
+		Azure: &config.Azure{
+			ContainerName:    "it's-mine",
+			ConnectionString: `AccountKey=a"b$c;`,
+		},
+	}
+
+	assert.Equal(t, []string{"mc", "alias", "set", "mongo-test", "https://play.min.io", "access", `se"cr$et'`, "--api", "S3v4"},
+		minioAliasCmd(plan))
+	assert.Equal(t, []string{"aws", "configure", "set", "aws_secret_access_key", `se"cr$et'`}, awsConfigureCmds(plan)[1])
+	assert.Equal(t, []string{"az", "storage", "blob", "upload", "-c", "it's-mine", "--file", "/tmp/a.gz",
+		"--name", "tmp/a.gz", "--connection-string", `AccountKey=a"b$c;`}, azureUploadCmd("/tmp/a.gz", "", plan))
+}
+
+func Test_streamCmd(t *testing.T) {
+	rc, err := streamCmd("echo", "-n", "archive")
+	assert.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.Equal(t, "archive", string(data))
+
+	rc, err = streamCmd("sh", "-c", "echo missing >&2; exit 1")
+	assert.NoError(t, err)
+	_, err = io.ReadAll(rc)
+	assert.NoError(t, err)
+	var exitErr *ExitError
+	assert.ErrorAs(t, rc.Close(), &exitErr)
+	assert.Equal(t, "missing", exitErr.Stderr)
+}
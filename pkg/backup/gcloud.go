@@ -1,47 +1,40 @@
 package backup
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
 
 	"github.com/stefanprodan/mgob/pkg/config"
 )
 
-func gCloudKeyFileAuth(keyFilePath string) error {
+func gCloudKeyFileAuth(ctx context.Context, keyFilePath string) error {
 	if _, err := os.Stat(keyFilePath); err != nil {
 		return err
 	}
-	register := fmt.Sprintf("gcloud auth activate-service-account --key-file=%v", keyFilePath)
-	if _, err := sh.Command("/bin/sh", "-c", register).CombinedOutput(); err != nil {
+	if _, _, err := runCmdContext(ctx, 0, nil, "gcloud", "auth", "activate-service-account", fmt.Sprintf("--key-file=%v", keyFilePath)); err != nil {
 		return err
 	}
 	return nil
 }
 
-func gCloudUpload(file string, plan config.Plan) (string, error) {
+func gCloudUpload(ctx context.Context, file string, key string, plan config.Plan) (string, error) {
 
 	if len(plan.GCloud.KeyFilePath) > 0 {
-		if err := gCloudKeyFileAuth(plan.GCloud.KeyFilePath); err != nil {
+		if err := gCloudKeyFileAuth(ctx, plan.GCloud.KeyFilePath); err != nil {
 			return "", errors.Wrapf(err, "gcloud auth for plan %v failed", plan.Name)
 		}
 	}
 
-	fileName := filepath.Base(file)
-
-	upload := fmt.Sprintf("gsutil cp %v gs://%v/%v",
-		file, plan.GCloud.Bucket, fileName)
-
-	result, err := sh.Command("/bin/sh", "-c", upload).SetTimeout(time.Duration(plan.Scheduler.Timeout) * time.Minute).CombinedOutput()
-	output := ""
-	if len(result) > 0 {
-		output = strings.Replace(string(result), "\n", " ", -1)
-	}
+	stdout, stderr, err := runCmdContext(ctx, time.Duration(plan.Scheduler.Timeout)*time.Minute, nil, gCloudUploadCmd(file, key, plan)...)
+	output := flatten(append(stdout, stderr...))
 
 	if err != nil {
 		return "", errors.Wrapf(err, "GCloud uploading %v to gs://%v failed %v", file, plan.GCloud.Bucket, output)
@@ -51,5 +44,58 @@ func gCloudUpload(file string, plan config.Plan) (string, error) {
 		return "", errors.Errorf("GCloud upload failed %v", output)
 	}
 
-	return strings.Replace(output, "\n", " ", -1), nil
+	return output, nil
+}
+
+func gCloudUploadCmd(file string, key string, plan config.Plan) []string {
+	return []string{"gsutil", "cp", file, fmt.Sprintf("gs://%v/%v", plan.GCloud.Bucket, objectName(file, key))}
+}
+
+type gCloudDestination struct {
+	plan config.Plan
+}
+
+func (d *gCloudDestination) Name() string {
+	return "gcloud"
+}
+
+var gsutilListRegex = regexp.MustCompile(`^\s*(\d+)\s+(\S+)\s+(gs://.+)$`)
+
+func (d *gCloudDestination) List() ([]RemoteArchive, error) {
+	if len(d.plan.GCloud.KeyFilePath) > 0 {
+		if err := gCloudKeyFileAuth(context.Background(), d.plan.GCloud.KeyFilePath); err != nil {
+			return nil, errors.Wrapf(err, "gcloud auth for plan %v failed", d.plan.Name)
+		}
+	}
+
+	bucket := fmt.Sprintf("gs://%v/", d.plan.GCloud.Bucket)
+	stdout, _, err := runCmd(0, "gsutil", "ls", "-l", bucket+"**")
+	if err != nil {
+		return nil, errors.Wrapf(err, "GCloud listing %v failed", bucket)
+	}
+
+	objects := make([]RemoteArchive, 0)
+	for _, line := range strings.Split(string(stdout), "\n") {
+		matches := gsutilListRegex.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+		size, _ := strconv.ParseInt(matches[1], 10, 64)
+		modified, _ := time.Parse(time.RFC3339, matches[2])
+		objects = append(objects, RemoteArchive{
+			Key:      strings.TrimPrefix(matches[3], bucket),
+			Size:     size,
+			Modified: modified.UTC(),
+		})
+	}
+	return objects, nil
+}
+
+func (d *gCloudDestination) Open(key string) (io.ReadCloser, error) {
+	if len(d.plan.GCloud.KeyFilePath) > 0 {
+		if err := gCloudKeyFileAuth(context.Background(), d.plan.GCloud.KeyFilePath); err != nil {
+			return nil, errors.Wrapf(err, "gcloud auth for plan %v failed", d.plan.Name)
+		}
+	}
+	return streamCmd("gsutil", "cat", fmt.Sprintf("gs://%v/%v", d.plan.GCloud.Bucket, key))
 }
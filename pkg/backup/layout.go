@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// archiveKey renders the plan layout for an archive, the key is relative to the destination root.
+// An empty key means the plan has no layout and the legacy flat naming is used.
+func archiveKey(plan config.Plan, ts time.Time, file string) (string, error) {
+	if !hasLayout(plan) {
+		return "", nil
+	}
+
+	base := fmt.Sprintf("%v-%v", plan.Name, ts.Unix())
+	return config.RenderLayout(plan, config.LayoutData{
+		Plan: plan.Name,
+		Time: ts,
+		Ext:  strings.TrimPrefix(filepath.Base(file), base),
+	})
+}
+
+func hasLayout(plan config.Plan) bool {
+	return plan.Archive != nil && plan.Archive.Layout != ""
+}
+
+// objectName is the remote name of an archive, the key or the file name without layout
+func objectName(file string, key string) string {
+	if key != "" {
+		return key
+	}
+	return filepath.Base(file)
+}
+
+// LocalArchivePath finds an archive in the local storage, through the manifest for templated layouts and snapshots
+func LocalArchivePath(plan config.Plan, conf *config.AppConfig, store *db.StatusStore, name string) (string, error) {
+	legacy := filepath.Join(conf.StoragePath, plan.Name, name)
+	if store == nil {
+		return legacy, nil
+	}
+
+	archive, err := store.GetArchive(plan.Name, name)
+	if err != nil {
+		return "", err
+	}
+	if archive == nil || archive.Key == "" {
+		// archives made before the layout was set
+		return legacy, nil
+	}
+
+	return filepath.Join(conf.StoragePath, filepath.FromSlash(archive.Key)), nil
+}
+
+// manifestRetentionCandidates lists the templated archives kept on a destination beyond the retention
+func manifestRetentionCandidates(archives []*db.Archive, destination string, retention int) []*db.Archive {
+	candidates := make([]*db.Archive, 0)
+	kept := 0
+	for _, archive := range archives {
+		if archive.Key == "" || archive.Pinned || !hasDestination(archive, destination) {
+			continue
+		}
+		if kept < retention {
+			kept++
+			continue
+		}
+		candidates = append(candidates, archive)
+	}
+	return candidates
+}
+
+// applyManifestRetention removes the local archives of a templated layout beyond the retention,
+// along with their logs and the directories left empty
+func applyManifestRetention(store *db.StatusStore, plan config.Plan, storagePath string) error {
+	archives, err := store.GetArchives(plan.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, archive := range manifestRetentionCandidates(archives, "local", plan.Scheduler.Retention) {
+		file := filepath.Join(storagePath, filepath.FromSlash(archive.Key))
+		mlog := filepath.Join(filepath.Dir(file), fmt.Sprintf("%v-%v.log", plan.Name, archive.Timestamp.Unix()))
+		for _, f := range []string{file, mlog} {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "removing old file %v failed", f)
+			}
+		}
+		removeEmptyDirs(filepath.Dir(file), storagePath)
+
+		archive.Destinations = removeDestination(archive.Destinations, "local")
+		if len(archive.Destinations) == 0 {
+			err = store.DeleteArchive(archive.Plan, archive.Name)
+		} else {
+			err = store.PutArchive(archive)
+		}
+		if err != nil {
+			return err
+		}
+		log.WithField("plan", plan.Name).Debugf("Retention removed %v", file)
+	}
+
+	return nil
+}
+
+func removeEmptyDirs(dir string, root string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// fails on the first non-empty dir
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+func hasDestination(archive *db.Archive, destination string) bool {
+	for _, d := range archive.Destinations {
+		if d == destination {
+			return true
+		}
+	}
+	return false
+}
+
+func removeDestination(destinations []string, destination string) []string {
+	result := make([]string, 0, len(destinations))
+	for _, d := range destinations {
+		if d != destination {
+			result = append(result, d)
+		}
+	}
+	return result
+}
@@ -0,0 +1,151 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_archiveKey(t *testing.T) {
+	ts := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	plan := config.Plan{
+		Name:    "mongo-test",
+		Archive: &config.Archive{Layout: `{{.Plan}}/{{.Time.Format "2006/01/02"}}/{{.Plan}}-{{.Time.Unix}}{{.Ext}}`},
+	}
+
+	key, err := archiveKey(plan, ts, "/tmp/mongo-test-1680674828.gz.encrypted")
+	assert.NoError(t, err)
+	assert.Equal(t, "mongo-test/2023/04/05/mongo-test-1680674828.gz.encrypted", key)
+
+	plan.Archive.Layout = `{{.Plan}}/{{.Time.Format "20060102T150405"}}{{.Ext}}`
+	key, err = archiveKey(plan, ts, "/tmp/mongo-test-1680674828.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "mongo-test/20230405T060708.gz", key)
+
+	key, err = archiveKey(config.Plan{Name: "mongo-test"}, ts, "/tmp/mongo-test-1680674828.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "", key)
+	assert.Equal(t, "mongo-test-1680674828.gz", objectName("/tmp/mongo-test-1680674828.gz", key))
+}
+
+func Test_archiveKey_invalid(t *testing.T) {
+	ts := time.Unix(1680674828, 0).UTC()
+	for _, layout := range []string{"../{{.Plan}}{{.Ext}}", "/{{.Plan}}{{.Ext}}", "{{.Plan}}/", "{{.Missing}}", "{{.Plan"} {
+		plan := config.Plan{Name: "mongo-test", Archive: &config.Archive{Layout: layout}}
+		_, err := archiveKey(plan, ts, "/tmp/mongo-test-1680674828.gz")
+		assert.Error(t, err, layout)
+	}
+}
+
+func Test_uploadCmds_layout(t *testing.T) {
+	plan := config.Plan{
+		Name:   "mongo-test",
+		S3:     &config.S3{Bucket: "backup"},
+		GCloud: &config.GCloud{Bucket: "backup"},
+		Rclone: &config.Rclone{Bucket: "backup", ConfigFilePath: "/etc/rclone.conf"},
+		Azure:  &config.Azure{ContainerName: "backup"},
+	}
+	key := "mongo-test/2023/04/05/mongo-test-1680674828.gz"
+	file := "/tmp/mongo-test-1680674828.gz"
+
+	assert.Equal(t, "s3://backup/"+key, awsUploadCmd(file, key, plan)[5])
+	assert.Equal(t, "mongo-test/backup/"+key, minioUploadCmd(file, key, plan)[4])
+	assert.Equal(t, "gs://backup/"+key, gCloudUploadCmd(file, key, plan)[3])
+	assert.Equal(t, "mongo-test:backup/"+key, rcloneUploadCmd(file, key, plan)[4])
+	assert.Equal(t, key, azureUploadCmd(file, key, plan)[9])
+	assert.Equal(t, []string{"rclone", "--config=/etc/rclone.conf", "copyto", file, "mongo-test:backup/" + key},
+		rcloneReplaceCmd(file, key, plan))
+}
+
+func Test_applyManifestRetention(t *testing.T) {
+	dir := t.TempDir()
+	bolt, err := db.Open(filepath.Join(dir, "mgob.db"))
+	assert.NoError(t, err)
+	defer bolt.Close()
+	store, err := db.NewStatusStore(bolt)
+	assert.NoError(t, err)
+
+	storage := filepath.Join(dir, "storage")
+	plan := config.Plan{
+		Name:      "mongo-test",
+		Scheduler: config.Scheduler{Retention: 1},
+		Archive:   &config.Archive{Layout: `{{.Plan}}/{{.Time.Format "2006-01-02"}}/{{.Plan}}-{{.Time.Unix}}{{.Ext}}`},
+	}
+
+	for i, destinations := range [][]string{{"local", "s3"}, {"local"}, {"local"}} {
+		ts := time.Date(2023, 4, 5+i, 0, 0, 0, 0, time.UTC)
+		archive, _ := archivePaths(plan, "/tmp", ts)
+		key, err := archiveKey(plan, ts, archive)
+		assert.NoError(t, err)
+		file := filepath.Join(storage, key)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		assert.NoError(t, os.WriteFile(file, []byte{}, 0644))
+		assert.NoError(t, store.PutArchive(&db.Archive{
+			Plan:         plan.Name,
+			Name:         filepath.Base(key),
+			Key:          key,
+			Timestamp:    ts,
+			Destinations: destinations,
+		}))
+	}
+
+	assert.NoError(t, applyManifestRetention(store, plan, storage))
+
+	dirs, _ := filepath.Glob(filepath.Join(storage, "mongo-test", "*"))
+	assert.Equal(t, []string{filepath.Join(storage, "mongo-test", "2023-04-07")}, dirs)
+
+	archives, err := store.GetArchives(plan.Name)
+	assert.NoError(t, err)
+	assert.Len(t, archives, 2)
+	assert.Equal(t, []string{"s3"}, archives[1].Destinations)
+
+	path, err := LocalArchivePath(plan, &config.AppConfig{StoragePath: storage}, store, archives[0].Name)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(storage, archives[0].Key), path)
+}
+
+func Test_manifestRetentionCandidates_pinned(t *testing.T) {
+	archives := []*db.Archive{
+		{Name: "c", Key: "p/c.gz", Destinations: []string{"local"}},
+		{Name: "snapshot", Key: "p/snapshots/snapshot.gz", Destinations: []string{"local"}, Pinned: true},
+		{Name: "b", Key: "p/b.gz", Destinations: []string{"local"}},
+		{Name: "a", Key: "p/a.gz", Destinations: []string{"local"}},
+	}
+
+	candidates := manifestRetentionCandidates(archives, "local", 1)
+	assert.Len(t, candidates, 2)
+	assert.Equal(t, "b", candidates[0].Name)
+	assert.Equal(t, "a", candidates[1].Name)
+}
+
+func Test_LocalArchivePath_snapshot(t *testing.T) {
+	dir := t.TempDir()
+	bolt, err := db.Open(filepath.Join(dir, "mgob.db"))
+	assert.NoError(t, err)
+	defer bolt.Close()
+	store, err := db.NewStatusStore(bolt)
+	assert.NoError(t, err)
+
+	plan := config.Plan{Name: "mongo-test"}
+	conf := &config.AppConfig{StoragePath: "/storage"}
+	assert.NoError(t, store.PutArchive(&db.Archive{
+		Plan:     plan.Name,
+		Name:     "mongo-test-snapshot-1680674828.gz",
+		Key:      "mongo-test/snapshots/mongo-test-snapshot-1680674828.gz",
+		Pinned:   true,
+		Snapshot: &db.Snapshot{Database: "app", Restore: "mongo-test-1680674000.gz"},
+	}))
+
+	path, err := LocalArchivePath(plan, conf, store, "mongo-test-snapshot-1680674828.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "/storage/mongo-test/snapshots/mongo-test-snapshot-1680674828.gz", path)
+
+	path, err = LocalArchivePath(plan, conf, store, "mongo-test-1680674000.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "/storage/mongo-test/mongo-test-1680674000.gz", path)
+}
@@ -1,7 +1,9 @@
 package backup
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
@@ -10,96 +12,200 @@ import (
 	"strings"
 	"time"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
+	"github.com/stefanprodan/mgob/pkg/redact"
 )
 
-func localBackup(file string, storagePath string, mlog string, plan config.Plan) (string, error) {
+func localBackup(ctx context.Context, file string, key string, storagePath string, mlog string, plan config.Plan) (string, error) {
 	t1 := time.Now()
-	planDir := fmt.Sprintf("%v/%v", storagePath, plan.Name)
-	err := sh.Command("mkdir", "-p", planDir).Run()
+	distPath := localDistPath(storagePath, file, key, plan)
+	planDir := localPlanDir(storagePath, file, key, plan)
+	_, _, err := runCmdContext(ctx, 0, nil, "mkdir", "-p", planDir)
 	if err != nil {
 		return "", errors.Wrapf(err, "creating dir %v in %v failed", plan.Name, storagePath)
 	}
-	err = sh.Command("cp", file, planDir).Run()
+	_, _, err = runCmdContext(ctx, 0, nil, "cp", file, distPath)
 	if err != nil {
-		return "", errors.Wrapf(err, "moving file from %v to %v failed", file, planDir)
+		// no partial archive is left in the storage
+		os.Remove(distPath)
+		return "", errors.Wrapf(err, "moving file from %v to %v failed", file, distPath)
 	}
-	// check if log file exists, is not always created
-	if _, err := os.Stat(mlog); os.IsNotExist(err) {
+	// check if log file exists, is not always created. A dry run has no log but Run has one.
+	if _, err := os.Stat(mlog); os.IsNotExist(err) && !dryRun(ctx) {
 		log.WithField("plan", plan.Name).Debug("appears no log file was generated")
 	} else {
-		err = sh.Command("cp", mlog, planDir).Run()
+		_, _, err = runCmdContext(ctx, 0, nil, "cp", mlog, planDir)
 		if err != nil {
 			return "", errors.Wrapf(err, "moving file from %v to %v failed", mlog, planDir)
 		}
 	}
-	if plan.Scheduler.Retention > 0 {
+	// the retention of templated layouts is applied from the manifest once the upload is recorded,
+	// a dry run lists the candidates itself
+	if plan.Scheduler.Retention > 0 && key == "" && !dryRun(ctx) {
 		err = applyRetention(planDir, plan.Scheduler.Retention)
 		if err != nil {
 			return "", errors.Wrap(err, "retention job failed")
 		}
 	}
-	_, filename := filepath.Split(file)
-	distPath := filepath.Join(planDir, filename)
 	t2 := time.Now()
 	msg := fmt.Sprintf("Local backup finished filename:`%v`, filepath:`%v`, Duration: %v",
 		file, distPath, t2.Sub(t1))
 	return msg, nil
 }
 
-func dump(plan config.Plan, tmpPath string, ts time.Time) (string, string, error) {
+// localDistPath is where localBackup copies an archive
+func localDistPath(storagePath string, file string, key string, plan config.Plan) string {
+	if key != "" {
+		return filepath.Join(storagePath, filepath.FromSlash(key))
+	}
+	return filepath.Join(fmt.Sprintf("%v/%v", storagePath, plan.Name), filepath.Base(file))
+}
+
+// localPlanDir is the dir of the local archive, where the log is copied and the retention applied
+func localPlanDir(storagePath string, file string, key string, plan config.Plan) string {
+	if key != "" {
+		return filepath.Dir(localDistPath(storagePath, file, key, plan))
+	}
+	return fmt.Sprintf("%v/%v", storagePath, plan.Name)
+}
+
+func dump(plan config.Plan, conf *config.AppConfig, store *db.StatusStore, ts time.Time, job *jobs.Job) (string, string, int64, *db.Validation, error) {
+	ctx := job.Context()
 	retryCount := 0.0
-	archive := fmt.Sprintf("%v/%v-%v.gz", tmpPath, plan.Name, ts.Unix())
-	mlog := fmt.Sprintf("%v/%v-%v.log", tmpPath, plan.Name, ts.Unix())
-	dumpCmd := BuildDumpCmd(archive, plan.Target)
+	archive, mlog := archivePaths(plan, conf.TmpPath, ts)
+	dumpCmd, err := BuildDumpCmd(archive, plan.Target)
+	if err != nil {
+		return archive, mlog, 0, nil, err
+	}
+
+	if plan.Validation != nil {
+		if err := checkValidation(*plan.Validation); err != nil {
+			return archive, mlog, 0, nil, err
+		}
+	}
+
+	// fail before writing a partial archive
+	dataSize, err := checkDiskSpace(plan, conf, store)
+	if err != nil {
+		return archive, mlog, 0, nil, err
+	}
 	timeout := time.Duration(plan.Scheduler.Timeout) * time.Minute
 
-	log.WithField("plan", plan.Name).Debugf("dump cmd: %v", strings.Replace(dumpCmd, fmt.Sprintf(`-p "%v"`, plan.Target.Password), "-p xxxx", -1))
-	output, retryCount, err := runDump(dumpCmd, plan.Retry, archive, retryCount, timeout)
+	log.WithField("plan", plan.Name).Debugf("dump cmd: %v", redact.String(strings.Join(dumpCmd, " ")))
+	// the log is written as mongodump runs, and kept when it fails. It is redacted like the job log
+	// since it is kept next to the archive.
+	logFile, err := os.Create(mlog)
 	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return archive, mlog, errors.Wrapf(err, "after %v retries, mongodump log %v", retryCount, ex)
+		return archive, mlog, 0, nil, errors.Wrapf(err, "creating log %v failed", mlog)
 	}
+	defer logFile.Close()
+	logLines := redact.NewWriter(logFile)
+	defer logLines.Flush()
+
+	job.SetStage("dump")
+	stopWatch := watchFile(archive, job.SetBytes)
+	output, retryCount, err := runDump(ctx, dumpCmd, plan.Retry, archive, logLines, retryCount, timeout)
+	stopWatch()
+	if err != nil {
+		return archive, mlog, 0, nil, errors.Wrapf(err, "after %v retries, mongodump failed, see %v", retryCount, mlog)
+	}
+	var validation *db.Validation
 	if plan.Validation != nil {
-		backupResult := getDumpedDocMap(string(output))
-		isValidate, validateErr := ValidateBackup(archive, plan, backupResult)
-		if !isValidate || validateErr != nil {
-			client, ctx, mongoErr := GetMongoClient(BuildUri(plan.Validation.Database))
-			if mongoErr != nil {
-				if validateErr != nil {
-					combinedError := fmt.Errorf("backup validation failed: %v; additionally, failed to get mongo client for cleanup: %v", validateErr, mongoErr)
-					return archive, mlog, combinedError
-				}
-				return archive, mlog, errors.Wrapf(mongoErr, "Failed to validate backup, failed to get mongo client for cleanup")
-			}
-			defer Dispose(client, ctx)
-			if cleanErr := cleanMongo(plan.Validation.Database.Database, client); cleanErr != nil {
-				if validateErr != nil {
-					combinedError := fmt.Errorf("backup validation failed: %v; additionally, failed to clean mongo validation database: %v", validateErr, cleanErr)
-					return archive, mlog, combinedError
-				}
-				return archive, mlog, errors.Wrapf(cleanErr, "Failed to validate backup, failed to clean mongo validation database")
-			}
-			if validateErr != nil {
-				return archive, mlog, errors.Wrapf(validateErr, "backup validation failed")
-			}
+		job.SetStage("validation")
+		if validation, err = validate(ctx, plan, conf, archive, getDumpedDocMap(string(output))); err != nil {
+			return archive, mlog, 0, nil, err
 		}
 	}
-	logToFile(mlog, output)
+	return archive, mlog, dataSize, validation, nil
+}
 
-	return archive, mlog, nil
+// validate checks an archive in the validation database, then in the other validation targets
+// whose results are reported without failing the validation
+func validate(ctx context.Context, plan config.Plan, conf *config.AppConfig, archive string, backupResult map[string]string) (*db.Validation, error) {
+	validation, err := validateOn(ctx, plan, conf, archive, backupResult)
+	if err != nil {
+		return validation, err
+	}
+	for _, target := range plan.Validation.Targets {
+		if err := ctx.Err(); err != nil {
+			return validation, errors.Wrap(err, "validation cancelled")
+		}
+		validation.Targets = append(validation.Targets, validateTarget(ctx, plan, conf, archive, backupResult, target))
+	}
+	return validation, nil
 }
 
+func validateTarget(ctx context.Context, plan config.Plan, conf *config.AppConfig, archive string, backupResult map[string]string,
+	target config.ValidationTarget) db.Validation {
+	validation := *plan.Validation
+	validation.Database = target.Database
+	validation.Ephemeral = target.Ephemeral
+	validation.Targets = nil
+	plan.Validation = &validation
+
+	log.WithField("plan", plan.Name).Infof("Validation: restoring into target %v", target.Label)
+	res, err := validateOn(ctx, plan, conf, archive, backupResult)
+	if res == nil {
+		res = &db.Validation{Collections: make([]db.CollectionValidation, 0)}
+	}
+	res.Label = target.Label
+	if err != nil {
+		res.Status = "failed"
+		res.Error = redact.Error(err)
+		log.WithField("plan", plan.Name).Warnf("Validation: target %v failed %v", target.Label, res.Error)
+	}
+	return *res
+}
+
+// validateOn restores an archive into the validation database, or into an ephemeral mongod,
+// and drops the restored data when the checks fail
+func validateOn(ctx context.Context, plan config.Plan, conf *config.AppConfig, archive string, backupResult map[string]string) (*db.Validation, error) {
+	if plan.Validation.Ephemeral != nil {
+		mongod, err := startEphemeral(plan, conf.TmpPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "starting the validation mongod failed")
+		}
+		defer mongod.Stop()
+		// the rest of the validation runs against the ephemeral mongod
+		ephemeral := *plan.Validation
+		ephemeral.Database = mongod.target(ephemeral.Database)
+		plan.Validation = &ephemeral
+	}
+
+	validation, validateErr := ValidateBackup(ctx, archive, plan, backupResult)
+	if validateErr == nil {
+		return validation, nil
+	}
+	client, clientCtx, mongoErr := GetMongoClient(BuildUri(plan.Validation.Database))
+	if mongoErr != nil {
+		combinedError := fmt.Errorf("backup validation failed: %v; additionally, failed to get mongo client for cleanup: %v", validateErr, mongoErr)
+		return validation, combinedError
+	}
+	defer Dispose(client, clientCtx)
+	// the restored data is dropped even when the job was cancelled
+	if cleanErr := cleanMongo(context.Background(), plan.Validation.Database.Database, client); cleanErr != nil {
+		combinedError := fmt.Errorf("backup validation failed: %v; additionally, failed to clean mongo validation database: %v", validateErr, cleanErr)
+		return validation, combinedError
+	}
+	return validation, errors.Wrapf(validateErr, "backup validation failed")
+}
+
+// archivePaths returns the temporary archive and mongodump log paths of a run
+func archivePaths(plan config.Plan, tmpPath string, ts time.Time) (string, string) {
+	archive := fmt.Sprintf("%v/%v-%v.gz", tmpPath, plan.Name, ts.Unix())
+	mlog := fmt.Sprintf("%v/%v-%v.log", tmpPath, plan.Name, ts.Unix())
+	return archive, mlog
+}
+
+// getDumpedDocMap lists the dumped collections by db.collection with their document count
 func getDumpedDocMap(output string) map[string]string {
 	result := map[string]string{}
-	dbDocCapRegex := `done dumping\s[\w,-]*\.(\S*)\s\((\d*).document`
+	dbDocCapRegex := `done dumping\s([\w,-]*\.\S*)\s\((\d*).document`
 	reg := regexp.MustCompile(dbDocCapRegex)
 	lines := strings.Split(output, "\n")
 
@@ -115,70 +221,104 @@ func getDumpedDocMap(output string) map[string]string {
 	return result
 }
 
-func runDump(dumpCmd string, retryPlan config.Retry, archive string, retryAttempt float64, timeout time.Duration) ([]byte, float64, error) {
+// runDump returns the mongodump log, written to stderr by the mongo tools and copied to mlog as it runs
+func runDump(ctx context.Context, dumpCmd []string, retryPlan config.Retry, archive string, mlog io.Writer, retryAttempt float64, timeout time.Duration) ([]byte, float64, error) {
 	duration := float32(0)
-	output, err := sh.Command("/bin/sh", "-c", dumpCmd).SetTimeout(timeout).CombinedOutput()
+	_, output, err := runCmdOutput(ctx, timeout, nil, mlog, dumpCmd...)
 	if err != nil {
 		// Try and clean up tmp file after an error
 		os.Remove(archive)
 		retryAttempt++
-		if retryAttempt > float64(retryPlan.Attempts) {
+		// a cancelled dump is not retried
+		if retryAttempt > float64(retryPlan.Attempts) || ctx.Err() != nil {
 			return nil, retryAttempt - 1, err
 		}
 		duration = retryPlan.BackoffFactor * float32(math.Pow(2, retryAttempt)) * float32(time.Second)
-		time.Sleep(time.Duration(duration))
+		select {
+		case <-time.After(time.Duration(duration)):
+		case <-ctx.Done():
+			return nil, retryAttempt - 1, err
+		}
 		log.Debugf("retrying dump: %v after %v second", retryAttempt, duration)
-		return runDump(dumpCmd, retryPlan, archive, retryAttempt, timeout)
+		return runDump(ctx, dumpCmd, retryPlan, archive, mlog, retryAttempt, timeout)
 	}
 	return output, retryAttempt, nil
 }
 
-func logToFile(file string, data []byte) error {
-	if len(data) > 0 {
-		err := os.WriteFile(file, data, 0644)
-		if err != nil {
-			return errors.Wrapf(err, "writing log %v failed", file)
+// watchFile reports the size of a growing file every second, until the returned stop is called
+func watchFile(file string, report func(int64)) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				if fi, err := os.Stat(file); err == nil {
+					report(fi.Size())
+				}
+				return
+			case <-ticker.C:
+				if fi, err := os.Stat(file); err == nil {
+					report(fi.Size())
+				}
+			}
 		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
 	}
+}
 
+func applyRetention(path string, retention int) error {
+	files, err := retentionCandidates(path, retention)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return errors.Wrapf(err, "removing old file %v failed", file)
+		}
+	}
 	return nil
 }
 
-func applyRetention(path string, retention int) error {
-	// Function to delete files based on retention policy
-	deleteFiles := func(pattern string) error {
+// retentionCandidates lists the archives and logs exceeding the retention, oldest last
+func retentionCandidates(path string, retention int) ([]string, error) {
+	candidates := make([]string, 0)
+
+	// Function to find files based on retention policy
+	findFiles := func(pattern string) error {
 		files, err := filepath.Glob(filepath.Join(path, pattern))
 		if err != nil {
 			return err
 		}
 		sort.Sort(sort.Reverse(sort.StringSlice(files)))
 		if len(files) > retention {
-			for _, file := range files[retention:] {
-				if err := os.Remove(file); err != nil {
-					return err
-				}
-			}
+			candidates = append(candidates, files[retention:]...)
 		}
 		return nil
 	}
 
 	log.Debug("applying retention to *.gz* files")
-	if err := deleteFiles("*.gz*"); err != nil {
-		return errors.Wrapf(err, "removing old gz files from %v failed", path)
+	if err := findFiles("*.gz*"); err != nil {
+		return nil, errors.Wrapf(err, "listing old gz files from %v failed", path)
 	}
 
 	log.Debug("applying retention to *.log files")
-	if err := deleteFiles("*.log"); err != nil {
-		return errors.Wrapf(err, "removing old log files from %v failed", path)
+	if err := findFiles("*.log"); err != nil {
+		return nil, errors.Wrapf(err, "listing old log files from %v failed", path)
 	}
 
-	return nil
+	return candidates, nil
 }
 
 // TmpCleanup remove files older than one day
 func TmpCleanup(path string) error {
-	rm := fmt.Sprintf("find %v -not -name \"mgob.db\" -mtime +%v -type f -delete", path, 1)
-	err := sh.Command("/bin/sh", "-c", rm).Run()
+	_, _, err := runCmd(0, "find", path, "-not", "-name", "mgob.db", "-mtime", "+1", "-type", "f", "-delete")
 	if err != nil {
 		return errors.Wrapf(err, "%v cleanup failed", path)
 	}
@@ -1,38 +1,96 @@
 package backup
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"path/filepath"
-	"strings"
+	"io"
 	"time"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
 
 	"github.com/stefanprodan/mgob/pkg/config"
 )
 
-func rcloneUpload(file string, plan config.Plan) (string, error) {
+func rcloneUpload(ctx context.Context, file string, key string, plan config.Plan) (string, error) {
+	stdout, stderr, err := runCmdContext(ctx, time.Duration(plan.Scheduler.Timeout)*time.Minute, nil, rcloneUploadCmd(file, key, plan)...)
+	output := flatten(append(stdout, stderr...))
 
-	fileName := filepath.Base(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "Rclone uploading %v to %v:%v failed %v", file, plan.Name, plan.Rclone.Bucket, output)
+	}
 
+	return output, nil
+}
+
+func rcloneUploadCmd(file string, key string, plan config.Plan) []string {
 	configSection := plan.Rclone.ConfigSection
 	if configSection == "" {
 		configSection = plan.Name
 	}
 
-	upload := fmt.Sprintf("rclone --config=\"%v\" copy %v %v:%v/%v",
-		plan.Rclone.ConfigFilePath, file, configSection, plan.Rclone.Bucket, fileName)
+	return []string{"rclone", fmt.Sprintf("--config=%v", plan.Rclone.ConfigFilePath), "copy", file,
+		fmt.Sprintf("%v:%v/%v", configSection, plan.Rclone.Bucket, objectName(file, key))}
+}
+
+// rcloneReplace overwrites the object of a rotated archive, unlike copy the copyto target is the object itself
+func rcloneReplace(ctx context.Context, file string, key string, plan config.Plan) (string, error) {
+	stdout, stderr, err := runCmdContext(ctx, time.Duration(plan.Scheduler.Timeout)*time.Minute, nil, rcloneReplaceCmd(file, key, plan)...)
+	output := flatten(append(stdout, stderr...))
 
-	result, err := sh.Command("/bin/sh", "-c", upload).SetTimeout(time.Duration(plan.Scheduler.Timeout) * time.Minute).CombinedOutput()
-	output := ""
-	if len(result) > 0 {
-		output = strings.Replace(string(result), "\n", " ", -1)
+	if err != nil {
+		return "", errors.Wrapf(err, "Rclone replacing %v in %v:%v failed %v", key, plan.Name, plan.Rclone.Bucket, output)
 	}
 
+	return output, nil
+}
+
+func rcloneReplaceCmd(file string, key string, plan config.Plan) []string {
+	d := rcloneDestination{plan: plan}
+	return []string{"rclone", fmt.Sprintf("--config=%v", plan.Rclone.ConfigFilePath), "copyto", file,
+		fmt.Sprintf("%v/%v", d.remote(), key)}
+}
+
+type rcloneDestination struct {
+	plan config.Plan
+}
+
+func (d *rcloneDestination) Name() string {
+	return "rclone"
+}
+
+func (d *rcloneDestination) remote() string {
+	configSection := d.plan.Rclone.ConfigSection
+	if configSection == "" {
+		configSection = d.plan.Name
+	}
+	return fmt.Sprintf("%v:%v", configSection, d.plan.Rclone.Bucket)
+}
+
+func (d *rcloneDestination) List() ([]RemoteArchive, error) {
+	stdout, _, err := runCmd(0, "rclone", fmt.Sprintf("--config=%v", d.plan.Rclone.ConfigFilePath),
+		"lsjson", "-R", "--files-only", d.remote())
 	if err != nil {
-		return "", errors.Wrapf(err, "Rclone uploading %v to %v:%v failed %v", file, plan.Name, plan.Rclone.Bucket, output)
+		return nil, errors.Wrapf(err, "Rclone listing %v failed", d.remote())
 	}
 
-	return strings.Replace(output, "\n", " ", -1), nil
+	var items []struct {
+		Path    string    `json:"Path"`
+		Size    int64     `json:"Size"`
+		ModTime time.Time `json:"ModTime"`
+	}
+	if err := json.Unmarshal(stdout, &items); err != nil {
+		return nil, errors.Wrapf(err, "Rclone listing %v failed", d.remote())
+	}
+
+	objects := make([]RemoteArchive, 0, len(items))
+	for _, item := range items {
+		objects = append(objects, RemoteArchive{Key: item.Path, Size: item.Size, Modified: item.ModTime.UTC()})
+	}
+	return objects, nil
+}
+
+func (d *rcloneDestination) Open(key string) (io.ReadCloser, error) {
+	return streamCmd("rclone", fmt.Sprintf("--config=%v", d.plan.Rclone.ConfigFilePath),
+		"cat", fmt.Sprintf("%v/%v", d.remote(), key))
 }
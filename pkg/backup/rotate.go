@@ -0,0 +1,489 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+// RotateOptions points to the secret key able to decrypt the existing archives
+type RotateOptions struct {
+	KeyFile        string `json:"keyFile"`
+	PassphraseFile string `json:"passphraseFile"`
+}
+
+type RotateFileResult struct {
+	Destination string        `json:"destination"`
+	File        string        `json:"file"`
+	Status      string        `json:"status"`
+	Error       string        `json:"error,omitempty"`
+	Duration    time.Duration `json:"duration"`
+}
+
+type RotateReport struct {
+	Plan       string             `json:"plan"`
+	Recipients []string           `json:"recipients"`
+	Rotated    int                `json:"rotated"`
+	Failed     int                `json:"failed"`
+	Files      []RotateFileResult `json:"files"`
+	Duration   time.Duration      `json:"duration"`
+}
+
+// Rotate re-encrypts the archives of a plan found on its destinations to the current recipients.
+// The job stage is the destination being rotated, cancelling the job stops the rotation between two archives.
+func Rotate(plan config.Plan, conf *config.AppConfig, store *db.StatusStore, opts RotateOptions, job *jobs.Job) (RotateReport, error) {
+	t1 := time.Now()
+	ctx := job.Context()
+	report := RotateReport{
+		Plan:  plan.Name,
+		Files: make([]RotateFileResult, 0),
+	}
+
+	if plan.Encryption == nil || plan.Encryption.Gpg == nil {
+		return report, errors.Errorf("Plan %v has no gpg encryption configured", plan.Name)
+	}
+	if !conf.HasGpg {
+		return report, errors.New("GPG configuration is present, but no GPG binary is found")
+	}
+
+	if opts.KeyFile != "" {
+		output, err := gpgImportSecretKey(opts.KeyFile, opts.PassphraseFile)
+		if err != nil {
+			return report, err
+		}
+		log.WithField("plan", plan.Name).Debugf("Key rotation: import output: %v", output)
+	}
+
+	rotated := make(map[string]int64)
+
+	if conf.StoragePath != "" && plan.Scheduler.Retention != 0 {
+		job.SetStage("local")
+		files, err := filepath.Glob(filepath.Join(conf.StoragePath, plan.Name, "*.encrypted"))
+		if err != nil {
+			return report, errors.Wrapf(err, "listing encrypted archives of %v failed", plan.Name)
+		}
+		keys, err := encryptedArchiveKeys(plan, store, "local")
+		if err != nil {
+			return report, err
+		}
+		for _, key := range keys {
+			files = append(files, filepath.Join(conf.StoragePath, filepath.FromSlash(key)))
+		}
+		// a templated key may land in the plan dir
+		files = uniquePaths(files)
+		for i, file := range files {
+			if ctx.Err() != nil {
+				break
+			}
+			t2 := time.Now()
+			_, name := filepath.Split(file)
+			log.WithField("plan", plan.Name).Infof("Key rotation: local %v/%v `%v` started", i+1, len(files), name)
+			res := RotateFileResult{Destination: "local", File: name, Status: "rotated"}
+			recipients, err := rotateLocalFile(ctx, file, conf.TmpPath, plan, opts)
+			if err != nil {
+				res.Status = "failed"
+				res.Error = redact.Error(err)
+				report.Failed++
+				log.WithField("plan", plan.Name).Errorf("Key rotation: local `%v` failed %v", name, err)
+			} else {
+				report.Recipients = recipients
+				report.Rotated++
+				if fi, err := os.Stat(file); err == nil {
+					rotated[name] = fi.Size()
+				}
+			}
+			res.Duration = time.Since(t2)
+			report.Files = append(report.Files, res)
+		}
+	}
+
+	if plan.SFTP != nil && ctx.Err() == nil {
+		job.SetStage("sftp")
+		results, recipients, err := rotateSftp(ctx, conf.TmpPath, plan, store, opts)
+		if err != nil {
+			return report, err
+		}
+		for _, res := range results {
+			if res.Status == "rotated" {
+				report.Rotated++
+				report.Recipients = recipients
+				if _, ok := rotated[res.File]; !ok {
+					rotated[res.File] = 0
+				}
+			} else {
+				report.Failed++
+			}
+			report.Files = append(report.Files, res)
+		}
+	}
+
+	uploads := rotateUploads(conf)
+	for _, dest := range Destinations(plan, conf) {
+		upload, ok := uploads[dest.Name()]
+		if !ok || ctx.Err() != nil {
+			// local and sftp are rotated above
+			continue
+		}
+		job.SetStage(dest.Name())
+		results, recipients, err := rotateRemote(ctx, dest, upload, conf.TmpPath, plan, store, opts)
+		if err != nil {
+			return report, err
+		}
+		for _, res := range results {
+			if res.Status == "rotated" {
+				report.Rotated++
+				report.Recipients = recipients
+				if _, ok := rotated[res.File]; !ok {
+					rotated[res.File] = 0
+				}
+			} else {
+				report.Failed++
+			}
+			report.Files = append(report.Files, res)
+		}
+	}
+
+	if store != nil {
+		for name, size := range rotated {
+			if err := updateRotatedArchive(store, plan.Name, name, size, report.Recipients); err != nil {
+				log.WithField("plan", plan.Name).Errorf("Key rotation: manifest update failed %v", err)
+			}
+		}
+	}
+
+	report.Duration = time.Since(t1)
+	// the archives rotated before the cancellation are recorded above
+	if err := cancelled(ctx); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+func rotateLocalFile(ctx context.Context, file string, tmpPath string, plan config.Plan, opts RotateOptions) ([]string, error) {
+	_, name := filepath.Split(file)
+	decrypted := filepath.Join(tmpPath, strings.TrimSuffix(name, ".encrypted"))
+	defer os.Remove(decrypted)
+
+	if _, err := gpgDecrypt(ctx, file, decrypted, opts.PassphraseFile); err != nil {
+		return nil, err
+	}
+
+	reEncrypted := fmt.Sprintf("%v.rotating", file)
+	_, recipients, err := gpgEncrypt(ctx, decrypted, reEncrypted, plan)
+	if err != nil {
+		os.Remove(reEncrypted)
+		return nil, err
+	}
+
+	if err := os.Rename(reEncrypted, file); err != nil {
+		os.Remove(reEncrypted)
+		return nil, errors.Wrapf(err, "replacing %v failed", file)
+	}
+
+	return recipients, nil
+}
+
+func rotateSftp(ctx context.Context, tmpPath string, plan config.Plan, store *db.StatusStore, opts RotateOptions) ([]RotateFileResult, []string, error) {
+	sshCon, sftpClient, err := sftpConnect(plan)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer sshCon.Close()
+	defer sftpClient.Close()
+
+	names, err := sftpEncryptedArchives(sftpClient, plan, store)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var recipients []string
+	results := make([]RotateFileResult, 0, len(names))
+	for i, name := range names {
+		if ctx.Err() != nil {
+			break
+		}
+		t1 := time.Now()
+		log.WithField("plan", plan.Name).Infof("Key rotation: sftp %v/%v `%v` started", i+1, len(names), name)
+		res := RotateFileResult{Destination: "sftp", File: path.Base(name), Status: "rotated"}
+		r, err := rotateSftpFile(ctx, sftpClient, path.Join(plan.SFTP.Dir, name), tmpPath, plan, opts)
+		if err != nil {
+			res.Status = "failed"
+			res.Error = redact.Error(err)
+			log.WithField("plan", plan.Name).Errorf("Key rotation: sftp `%v` failed %v", name, err)
+		} else {
+			recipients = r
+		}
+		res.Duration = time.Since(t1)
+		results = append(results, res)
+	}
+
+	return results, recipients, nil
+}
+
+// sftpEncryptedArchives lists the encrypted archives of a plan in the SFTP dir, which may be shared with
+// other plans, and the ones of a templated layout
+func sftpEncryptedArchives(client *sftp.Client, plan config.Plan, store *db.StatusStore) ([]string, error) {
+	list, err := client.ReadDir(plan.SFTP.Dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "SFTP reading %v dir failed", plan.SFTP.Dir)
+	}
+
+	names := make([]string, 0)
+	for _, item := range list {
+		if !item.IsDir() && strings.HasSuffix(item.Name(), ".encrypted") && isPlanArchive(plan, item.Name()) {
+			names = append(names, item.Name())
+		}
+	}
+	keys, err := encryptedArchiveKeys(plan, store, "sftp")
+	if err != nil {
+		return nil, err
+	}
+	// a templated key may land in the SFTP dir
+	return uniquePaths(append(names, keys...)), nil
+}
+
+// uniquePaths drops the paths listed twice, keeping the first one
+func uniquePaths(paths []string) []string {
+	seen := make(map[string]bool, len(paths))
+	result := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if clean := filepath.Clean(p); !seen[clean] {
+			seen[clean] = true
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// encryptedArchiveKeys lists the encrypted archives of a templated layout kept on a destination
+func encryptedArchiveKeys(plan config.Plan, store *db.StatusStore, destination string) ([]string, error) {
+	keys := make([]string, 0)
+	if !hasLayout(plan) || store == nil {
+		return keys, nil
+	}
+
+	archives, err := store.GetArchives(plan.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, archive := range archives {
+		if archive.Key != "" && archive.Encrypted && hasDestination(archive, destination) {
+			keys = append(keys, archive.Key)
+		}
+	}
+	return keys, nil
+}
+
+func rotateSftpFile(ctx context.Context, client *sftp.Client, remote string, tmpPath string, plan config.Plan, opts RotateOptions) ([]string, error) {
+	name := path.Base(remote)
+	local := filepath.Join(tmpPath, name)
+	defer os.Remove(local)
+
+	if err := sftpDownload(client, remote, local); err != nil {
+		return nil, err
+	}
+
+	recipients, err := rotateLocalFile(ctx, local, tmpPath, plan, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sftpReplace(client, local, remote); err != nil {
+		return nil, err
+	}
+
+	return recipients, nil
+}
+
+// sftpReplace uploads next to the remote file then renames over it, so the archive is never left half written
+func sftpReplace(client *sftp.Client, local string, remote string) error {
+	staging := fmt.Sprintf("%v.rotating", remote)
+	if err := sftpPut(client, local, staging); err != nil {
+		client.Remove(staging)
+		return err
+	}
+
+	if err := client.PosixRename(staging, remote); err != nil {
+		// fallback for servers without the posix-rename extension
+		if err := client.Remove(remote); err != nil {
+			client.Remove(staging)
+			return errors.Wrapf(err, "SFTP removing %v failed", remote)
+		}
+		if err := client.Rename(staging, remote); err != nil {
+			return errors.Wrapf(err, "SFTP renaming %v failed", staging)
+		}
+	}
+
+	return nil
+}
+
+// rotateUpload puts a rotated archive back under its listed key, the object stores replace it in place
+type rotateUpload func(ctx context.Context, file string, key string, plan config.Plan) (string, error)
+
+func rotateUploads(conf *config.AppConfig) map[string]rotateUpload {
+	return map[string]rotateUpload{
+		"s3": func(ctx context.Context, file string, key string, plan config.Plan) (string, error) {
+			return s3Upload(ctx, file, key, plan, conf.UseAwsCli)
+		},
+		"gcloud": gCloudUpload,
+		"azure":  azureReplace,
+		"rclone": rcloneReplace,
+	}
+}
+
+// rotateRemote re-encrypts the encrypted archives of a plan listed on an object store
+func rotateRemote(ctx context.Context, dest Destination, upload rotateUpload, tmpPath string, plan config.Plan, store *db.StatusStore,
+	opts RotateOptions) ([]RotateFileResult, []string, error) {
+	archives, err := ListArchives(plan, store, dest)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := make([]string, 0)
+	for _, archive := range archives {
+		if archive.Encrypted {
+			keys = append(keys, archive.Key)
+		}
+	}
+
+	var recipients []string
+	results := make([]RotateFileResult, 0, len(keys))
+	for i, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		t1 := time.Now()
+		log.WithField("plan", plan.Name).Infof("Key rotation: %v %v/%v `%v` started", dest.Name(), i+1, len(keys), key)
+		res := RotateFileResult{Destination: dest.Name(), File: path.Base(key), Status: "rotated"}
+		r, err := rotateRemoteFile(ctx, dest, upload, key, tmpPath, plan, opts)
+		if err != nil {
+			res.Status = "failed"
+			res.Error = redact.Error(err)
+			log.WithField("plan", plan.Name).Errorf("Key rotation: %v `%v` failed %v", dest.Name(), key, err)
+		} else {
+			recipients = r
+		}
+		res.Duration = time.Since(t1)
+		results = append(results, res)
+	}
+
+	return results, recipients, nil
+}
+
+func rotateRemoteFile(ctx context.Context, dest Destination, upload rotateUpload, key string, tmpPath string, plan config.Plan,
+	opts RotateOptions) ([]string, error) {
+	dir, err := os.MkdirTemp(tmpPath, "rotate-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Creating a temp dir in %v failed", tmpPath)
+	}
+	defer os.RemoveAll(dir)
+
+	local := filepath.Join(dir, path.Base(key))
+	if _, err := download(ctx, dest, key, local); err != nil {
+		return nil, err
+	}
+
+	recipients, err := rotateLocalFile(ctx, local, dir, plan, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := upload(ctx, local, key, plan); err != nil {
+		return nil, err
+	}
+
+	return recipients, nil
+}
+
+func sftpDownload(client *sftp.Client, remote string, local string) error {
+	sf, err := client.Open(remote)
+	if err != nil {
+		return errors.Wrapf(err, "SFTP opening %v failed", remote)
+	}
+	defer sf.Close()
+
+	f, err := os.Create(local)
+	if err != nil {
+		return errors.Wrapf(err, "Creating file %v failed", local)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, sf); err != nil {
+		return errors.Wrapf(err, "SFTP downloading %v failed", remote)
+	}
+
+	return nil
+}
+
+func sftpPut(client *sftp.Client, local string, remote string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return errors.Wrapf(err, "Opening file %v failed", local)
+	}
+	defer f.Close()
+
+	sf, err := client.Create(remote)
+	if err != nil {
+		return errors.Wrapf(err, "SFTP creating file %v failed", remote)
+	}
+	defer sf.Close()
+
+	if _, err := io.Copy(sf, f); err != nil {
+		return errors.Wrapf(err, "SFTP upload file %v failed", remote)
+	}
+
+	return nil
+}
+
+func updateRotatedArchive(store *db.StatusStore, plan string, name string, size int64, recipients []string) error {
+	archive, err := store.GetArchive(plan, name)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if archive == nil {
+		archive = &db.Archive{
+			Plan:      plan,
+			Name:      name,
+			Timestamp: archiveTimestamp(name, now),
+		}
+	}
+	archive.Encrypted = true
+	archive.Recipients = recipients
+	archive.RotatedAt = &now
+	// each destination holds a different ciphertext after the rotation
+	archive.Checksum = ""
+	if size > 0 {
+		archive.Size = size
+	}
+
+	return store.PutArchive(archive)
+}
+
+// archiveTimestamp parses the unix time from archive names like plan-1494056760.gz
+func archiveTimestamp(name string, fallback time.Time) time.Time {
+	matches := regexp.MustCompile(`-(\d+)\.gz`).FindStringSubmatch(name)
+	if matches == nil {
+		return fallback
+	}
+	unix, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return fallback
+	}
+	return time.Unix(unix, 0).UTC()
+}
@@ -0,0 +1,300 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+func Test_archiveTimestamp(t *testing.T) {
+	fallback := time.Now().UTC()
+
+	ts := archiveTimestamp("mongo-test-1494056760.gz.encrypted", fallback)
+	assert.Equal(t, int64(1494056760), ts.Unix())
+
+	ts = archiveTimestamp("unknown.encrypted", fallback)
+	assert.Equal(t, fallback, ts)
+}
+
+// testGpgHome points gpg to a temp keyring holding a key without passphrase for each uid
+func testGpgHome(t *testing.T, uids ...string) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	// the agent socket path must stay short
+	home, err := os.MkdirTemp("", "gpg")
+	assert.NoError(t, err)
+	t.Setenv("GNUPGHOME", home)
+	t.Cleanup(func() {
+		runCmd(0, "gpgconf", "--kill", "gpg-agent")
+		os.RemoveAll(home)
+	})
+
+	for _, uid := range uids {
+		_, stderr, err := runCmd(0, "gpg", "--batch", "--passphrase", "", "--quick-gen-key", uid, "default", "default", "never")
+		if !assert.NoError(t, err, string(stderr)) {
+			t.FailNow()
+		}
+	}
+}
+
+// testGpgSubkey is the id of the encryption subkey of uid
+func testGpgSubkey(t *testing.T, uid string) string {
+	stdout, _, err := runCmd(0, "gpg", "--batch", "--with-colons", "--list-keys", uid)
+	assert.NoError(t, err)
+	for _, line := range strings.Split(string(stdout), "\n") {
+		if fields := strings.Split(line, ":"); fields[0] == "sub" {
+			return fields[4]
+		}
+	}
+	t.Fatalf("no subkey found for %v", uid)
+	return ""
+}
+
+// testEncryptedTo tells if file is encrypted to the subkey of uid
+func testEncryptedTo(t *testing.T, file string, uid string) bool {
+	stdout, stderr, _ := runCmd(0, "gpg", "--batch", "--list-packets", file)
+	return strings.Contains(string(append(stdout, stderr...)), "keyid "+testGpgSubkey(t, uid))
+}
+
+func testGpgPlan(recipient string) config.Plan {
+	return config.Plan{
+		Name:       "mongo-test",
+		Encryption: &config.Encryption{Gpg: &config.Gpg{Recipients: []string{recipient}}},
+	}
+}
+
+func testEncryptedArchive(t *testing.T, file string, recipient string) {
+	plain := strings.TrimSuffix(file, ".encrypted")
+	assert.NoError(t, os.WriteFile(plain, []byte("archive"), 0644))
+	_, _, err := gpgEncrypt(context.Background(), plain, file, testGpgPlan(recipient))
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(plain))
+}
+
+func Test_rotateLocalFile(t *testing.T) {
+	testGpgHome(t, "old@example.com", "new@example.com")
+	storage := t.TempDir()
+	tmp := t.TempDir()
+
+	file := filepath.Join(storage, "mongo-test-1494056760.gz.encrypted")
+	testEncryptedArchive(t, file, "old@example.com")
+	assert.True(t, testEncryptedTo(t, file, "old@example.com"))
+
+	recipients, err := rotateLocalFile(context.Background(), file, tmp, testGpgPlan("new@example.com"), RotateOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"new@example.com"}, recipients)
+	assert.True(t, testEncryptedTo(t, file, "new@example.com"))
+	assert.False(t, testEncryptedTo(t, file, "old@example.com"))
+	assert.NoFileExists(t, file+".rotating")
+
+	decrypted := filepath.Join(tmp, "check.gz")
+	_, err = gpgDecrypt(context.Background(), file, decrypted, "")
+	assert.NoError(t, err)
+	content, err := os.ReadFile(decrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, "archive", string(content))
+	assert.NoError(t, os.Remove(decrypted))
+
+	entries, err := os.ReadDir(tmp)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func Test_rotateLocalFile_failed(t *testing.T) {
+	testGpgHome(t, "new@example.com")
+	storage := t.TempDir()
+	tmp := t.TempDir()
+
+	file := filepath.Join(storage, "mongo-test-1494056760.gz.encrypted")
+	assert.NoError(t, os.WriteFile(file, []byte("not encrypted"), 0644))
+
+	_, err := rotateLocalFile(context.Background(), file, tmp, testGpgPlan("new@example.com"), RotateOptions{})
+	assert.ErrorContains(t, err, "Decrypting")
+
+	// the archive is left as it was
+	content, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "not encrypted", string(content))
+	assert.NoFileExists(t, file+".rotating")
+	entries, err := os.ReadDir(tmp)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func Test_rotateRemote(t *testing.T) {
+	testGpgHome(t, "old@example.com", "new@example.com")
+	root := t.TempDir()
+	tmp := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "backups"), 0755))
+
+	rotatedKey := "backups/mongo-test-1494056760.gz.encrypted"
+	testEncryptedArchive(t, filepath.Join(root, filepath.FromSlash(rotatedKey)), "old@example.com")
+	failedKey := "backups/mongo-test-1494056761.gz.encrypted"
+	assert.NoError(t, os.WriteFile(filepath.Join(root, filepath.FromSlash(failedKey)), []byte("not encrypted"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "backups", "mongo-test-1494056762.gz"), []byte("archive"), 0644))
+
+	// a local storage stands for the object store, the archives are listed under the storage root
+	plan := testGpgPlan("new@example.com")
+	plan.Archive = &config.Archive{Layout: "backups/{{.Plan}}-{{.Time.Unix}}{{.Ext}}"}
+	dest := &localDestination{root: root, plan: plan}
+	uploaded := make([]string, 0)
+	upload := func(ctx context.Context, file string, key string, plan config.Plan) (string, error) {
+		uploaded = append(uploaded, key)
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return "", os.WriteFile(filepath.Join(root, filepath.FromSlash(key)), content, 0644)
+	}
+
+	results, recipients, err := rotateRemote(context.Background(), dest, upload, tmp, plan, nil, RotateOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"new@example.com"}, recipients)
+	assert.Equal(t, []string{rotatedKey}, uploaded)
+	if assert.Len(t, results, 2) {
+		for _, res := range results {
+			assert.Equal(t, dest.Name(), res.Destination)
+			if res.File == "mongo-test-1494056760.gz.encrypted" {
+				assert.Equal(t, "rotated", res.Status)
+			} else {
+				assert.Equal(t, "failed", res.Status)
+				assert.Contains(t, res.Error, "Decrypting")
+			}
+		}
+	}
+	assert.True(t, testEncryptedTo(t, filepath.Join(root, filepath.FromSlash(rotatedKey)), "new@example.com"))
+
+	entries, err := os.ReadDir(tmp)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func Test_rotateRemoteFile_uploadFailed(t *testing.T) {
+	testGpgHome(t, "old@example.com", "new@example.com")
+	root := t.TempDir()
+	tmp := t.TempDir()
+
+	key := "mongo-test-1494056760.gz.encrypted"
+	testEncryptedArchive(t, filepath.Join(root, key), "old@example.com")
+
+	plan := testGpgPlan("new@example.com")
+	dest := &localDestination{root: root, plan: plan}
+	upload := func(ctx context.Context, file string, key string, plan config.Plan) (string, error) {
+		return "", errors.New("upload refused")
+	}
+
+	_, err := rotateRemoteFile(context.Background(), dest, upload, key, tmp, plan, RotateOptions{})
+	assert.ErrorContains(t, err, "upload refused")
+	assert.True(t, testEncryptedTo(t, filepath.Join(root, key), "old@example.com"))
+
+	entries, err := os.ReadDir(tmp)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// posixRenameless hides the posix-rename support of the in-memory server, the request is then handled as a rename
+type posixRenameless struct {
+	sftp.FileCmder
+}
+
+func testSftpClient(t *testing.T, handlers sftp.Handlers) *sftp.Client {
+	c1, c2 := net.Pipe()
+	server := sftp.NewRequestServer(c1, handlers)
+	go server.Serve()
+	client, err := sftp.NewClientPipe(c2, c2)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client
+}
+
+func Test_sftpReplace(t *testing.T) {
+	posix := sftp.InMemHandler()
+	rename := sftp.InMemHandler()
+	rename.FileCmd = posixRenameless{rename.FileCmd}
+
+	for name, handlers := range map[string]sftp.Handlers{"posix-rename": posix, "rename fallback": rename} {
+		client := testSftpClient(t, handlers)
+		remote := "/mongo-test-1494056760.gz.encrypted"
+		f, err := client.Create(remote)
+		assert.NoError(t, err, name)
+		_, err = f.Write([]byte("old"))
+		assert.NoError(t, err, name)
+		f.Close()
+
+		local := filepath.Join(t.TempDir(), "mongo-test-1494056760.gz.encrypted")
+		assert.NoError(t, os.WriteFile(local, []byte("rotated"), 0644), name)
+
+		assert.NoError(t, sftpReplace(client, local, remote), name)
+
+		f, err = client.Open(remote)
+		assert.NoError(t, err, name)
+		content, err := io.ReadAll(f)
+		assert.NoError(t, err, name)
+		f.Close()
+		assert.Equal(t, "rotated", string(content), name)
+		_, err = client.Stat(remote + ".rotating")
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
+
+func Test_sftpEncryptedArchives(t *testing.T) {
+	client := testSftpClient(t, sftp.InMemHandler())
+	assert.NoError(t, client.Mkdir("/backups"))
+	for _, name := range []string{"mongo-test-1494056760.gz.encrypted", "mongo-test-1494056760.gz", "mongo-test-staging-1494056760.gz.encrypted", "other-1494056760.gz.encrypted"} {
+		f, err := client.Create("/backups/" + name)
+		assert.NoError(t, err)
+		f.Close()
+	}
+
+	plan := config.Plan{Name: "mongo-test", SFTP: &config.SFTP{Dir: "/backups"}}
+	names, err := sftpEncryptedArchives(client, plan, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mongo-test-1494056760.gz.encrypted"}, names)
+}
+
+func Test_sftpEncryptedArchives_templatedKeys(t *testing.T) {
+	bolt, err := db.Open(filepath.Join(t.TempDir(), "mgob.db"))
+	assert.NoError(t, err)
+	defer bolt.Close()
+	store, err := db.NewStatusStore(bolt)
+	assert.NoError(t, err)
+
+	client := testSftpClient(t, sftp.InMemHandler())
+	assert.NoError(t, client.Mkdir("/backups"))
+	f, err := client.Create("/backups/mongo-test-1494056760.gz.encrypted")
+	assert.NoError(t, err)
+	f.Close()
+
+	// the templated key lands in the SFTP dir, where the archive is also listed by name
+	plan := config.Plan{Name: "mongo-test", SFTP: &config.SFTP{Dir: "/backups"},
+		Archive: &config.Archive{Layout: "{{.Plan}}-{{.Time.Unix}}{{.Ext}}"}}
+	assert.NoError(t, store.PutArchive(&db.Archive{Plan: plan.Name, Name: "mongo-test-1494056760.gz.encrypted",
+		Key: "mongo-test-1494056760.gz.encrypted", Encrypted: true, Destinations: []string{"sftp"}}))
+
+	names, err := sftpEncryptedArchives(client, plan, store)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mongo-test-1494056760.gz.encrypted"}, names)
+}
+
+func Test_uniquePaths(t *testing.T) {
+	assert.Equal(t, []string{"/s/p/a.gz", "/s/b.gz"}, uniquePaths([]string{"/s/p/a.gz", "/s/b.gz", "/s/p/../p/a.gz"}))
+}
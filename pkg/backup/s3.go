@@ -1,123 +1,117 @@
 package backup
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/url"
-	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
 
 	"github.com/stefanprodan/mgob/pkg/config"
 )
 
-func s3Upload(file string, plan config.Plan, useAwsCli bool) (string, error) {
+func s3Upload(ctx context.Context, file string, key string, plan config.Plan, useAwsCli bool) (string, error) {
+	aws, err := useAws(plan, useAwsCli)
+	if err != nil {
+		return "", err
+	}
 
+	if aws {
+		return awsUpload(ctx, file, key, plan)
+	}
+
+	return minioUpload(ctx, file, key, plan)
+}
+
+// useAws tells if the aws cli is used instead of the minio client
+func useAws(plan config.Plan, useAwsCli bool) (bool, error) {
 	s3Url, err := url.Parse(plan.S3.URL)
 
 	if err != nil {
-		return "", errors.Wrapf(err, "invalid S3 url for plan %v: %s", plan.Name, plan.S3.URL)
-	}
-
-	if useAwsCli && strings.HasSuffix(s3Url.Hostname(), "amazonaws.com") {
-		return awsUpload(file, plan)
+		return false, errors.Wrapf(err, "invalid S3 url for plan %v: %s", plan.Name, plan.S3.URL)
 	}
 
-	return minioUpload(file, plan)
+	return useAwsCli && strings.HasSuffix(s3Url.Hostname(), "amazonaws.com"), nil
 }
 
-func awsUpload(file string, plan config.Plan) (string, error) {
+func awsUpload(ctx context.Context, file string, key string, plan config.Plan) (string, error) {
 
 	output := ""
 	if len(plan.S3.AccessKey) > 0 && len(plan.S3.SecretKey) > 0 {
 		// Let's use credentials given
-		configure := fmt.Sprintf("aws configure set aws_access_key_id %v && aws configure set aws_secret_access_key %v",
-			plan.S3.AccessKey, plan.S3.SecretKey)
-
-		result, err := sh.Command("/bin/sh", "-c", configure).CombinedOutput()
-		if len(result) > 0 {
-			output += strings.Replace(string(result), "\n", " ", -1)
-		}
-		if err != nil {
-			return "", errors.Wrapf(err, "aws configure for plan %v failed %s", plan.Name, output)
+		for _, configure := range awsConfigureCmds(plan) {
+			stdout, stderr, err := runCmdContext(ctx, 0, nil, configure...)
+			output += flatten(append(stdout, stderr...))
+			if err != nil {
+				return "", errors.Wrapf(err, "aws configure for plan %v failed %s", plan.Name, output)
+			}
 		}
 	}
 
-	fileName := filepath.Base(file)
-
-	encrypt := ""
-	if len(plan.S3.KmsKeyId) > 0 {
-		encrypt = fmt.Sprintf(" --sse aws:kms --sse-kms-key-id %v", plan.S3.KmsKeyId)
+	stdout, stderr, err := runCmdContext(ctx, time.Duration(plan.Scheduler.Timeout)*time.Minute, nil, awsUploadCmd(file, key, plan)...)
+	output += flatten(append(stdout, stderr...))
+	if err != nil {
+		return "", errors.Wrapf(err, "S3 uploading %v to %v/%v failed %v", file, plan.Name, plan.S3.Bucket, output)
 	}
 
-	storage := ""
-	if len(plan.S3.StorageClass) > 0 {
-		storage = fmt.Sprintf(" --storage-class %v", plan.S3.StorageClass)
+	if strings.Contains(output, "<ERROR>") {
+		return "", errors.Errorf("S3 upload failed %v", output)
 	}
 
-	upload := fmt.Sprintf("aws --quiet s3 cp %v s3://%v/%v%v%v",
-		file, plan.S3.Bucket, fileName, encrypt, storage)
+	return output, nil
+}
 
-	result, err := sh.Command("/bin/sh", "-c", upload).SetTimeout(time.Duration(plan.Scheduler.Timeout) * time.Minute).CombinedOutput()
-	if len(result) > 0 {
-		output += strings.Replace(string(result), "\n", " ", -1)
+func awsConfigureCmds(plan config.Plan) [][]string {
+	return [][]string{
+		{"aws", "configure", "set", "aws_access_key_id", plan.S3.AccessKey},
+		{"aws", "configure", "set", "aws_secret_access_key", plan.S3.SecretKey},
 	}
-	if err != nil {
-		return "", errors.Wrapf(err, "S3 uploading %v to %v/%v failed %v", file, plan.Name, plan.S3.Bucket, output)
+}
+
+func awsUploadCmd(file string, key string, plan config.Plan) []string {
+	cmd := []string{"aws", "--quiet", "s3", "cp", file, fmt.Sprintf("s3://%v/%v", plan.S3.Bucket, objectName(file, key))}
+
+	if len(plan.S3.KmsKeyId) > 0 {
+		cmd = append(cmd, "--sse", "aws:kms", "--sse-kms-key-id", plan.S3.KmsKeyId)
 	}
 
-	if strings.Contains(output, "<ERROR>") {
-		return "", errors.Errorf("S3 upload failed %v", output)
+	if len(plan.S3.StorageClass) > 0 {
+		cmd = append(cmd, "--storage-class", plan.S3.StorageClass)
 	}
 
-	return strings.Replace(output, "\n", " ", -1), nil
+	return cmd
 }
 
-func minioUpload(file string, plan config.Plan) (string, error) {
+func minioUpload(ctx context.Context, file string, key string, plan config.Plan) (string, error) {
 
 	// Try the new mc alias set command first
-	register := fmt.Sprintf("mc alias set %v %v %v %v --api %v",
-		plan.Name, plan.S3.URL, plan.S3.AccessKey, plan.S3.SecretKey, plan.S3.API)
-
-	result, err := sh.Command("/bin/sh", "-c", register).CombinedOutput()
-	output := ""
-	if len(result) > 0 {
-		output = strings.Replace(string(result), "\n", " ", -1)
-	}
+	stdout, stderr, err := runCmdContext(ctx, 0, nil, minioAliasCmd(plan)...)
+	output := flatten(append(stdout, stderr...))
 
 	// If the new command fails, fallback to the old mc config host add
 	if err != nil {
-		registerFallback := fmt.Sprintf("mc config host add %v %v %v %v --api %v",
-			plan.Name, plan.S3.URL, plan.S3.AccessKey, plan.S3.SecretKey, plan.S3.API)
-
-		result, err = sh.Command("/bin/sh", "-c", registerFallback).CombinedOutput()
-		if len(result) > 0 {
-			output = strings.Replace(string(result), "\n", " ", -1)
-		}
+		stdout, stderr, err = runCmdContext(ctx, 0, nil, minioHostAddCmd(plan)...)
+		output = flatten(append(stdout, stderr...))
 		if err != nil {
 			return "", errors.Wrapf(err, "mc alias set and mc config host add both failed for plan %v: %s", plan.Name, output)
 		}
 	}
 
 	if plan.S3.CreateBucketIfNeeded {
-		err := minioCreateBucket(plan)
+		err := minioCreateBucket(ctx, plan)
 		if err != nil {
 			return "", err
 		}
 	}
 
-	fileName := filepath.Base(file)
-
-	upload := fmt.Sprintf("mc --quiet cp %v %v/%v/%v",
-		file, plan.Name, plan.S3.Bucket, fileName)
-
-	result, err = sh.Command("/bin/sh", "-c", upload).SetTimeout(time.Duration(plan.Scheduler.Timeout) * time.Minute).CombinedOutput()
-	output = ""
-	if len(result) > 0 {
-		output = strings.Replace(string(result), "\n", " ", -1)
-	}
+	stdout, stderr, err = runCmdContext(ctx, time.Duration(plan.Scheduler.Timeout)*time.Minute, nil, minioUploadCmd(file, key, plan)...)
+	output = flatten(append(stdout, stderr...))
 
 	if err != nil {
 		return "", errors.Wrapf(err, "S3 uploading %v to %v/%v failed %v", file, plan.Name, plan.S3.Bucket, output)
@@ -127,13 +121,25 @@ func minioUpload(file string, plan config.Plan) (string, error) {
 		return "", errors.Errorf("S3 upload failed %v", output)
 	}
 
-	return strings.Replace(output, "\n", " ", -1), nil
+	return output, nil
 }
 
-func minioCreateBucket(plan config.Plan) error {
-	listbucket := fmt.Sprintf("mc --quiet ls %v/%v", plan.Name, plan.S3.Bucket)
+func minioAliasCmd(plan config.Plan) []string {
+	return []string{"mc", "alias", "set", plan.Name, plan.S3.URL, plan.S3.AccessKey, plan.S3.SecretKey, "--api", plan.S3.API}
+}
+
+func minioHostAddCmd(plan config.Plan) []string {
+	return []string{"mc", "config", "host", "add", plan.Name, plan.S3.URL, plan.S3.AccessKey, plan.S3.SecretKey, "--api", plan.S3.API}
+}
+
+func minioUploadCmd(file string, key string, plan config.Plan) []string {
+	return []string{"mc", "--quiet", "cp", file, fmt.Sprintf("%v/%v/%v", plan.Name, plan.S3.Bucket, objectName(file, key))}
+}
 
-	_, err := sh.Command("/bin/sh", "-c", listbucket).CombinedOutput()
+func minioCreateBucket(ctx context.Context, plan config.Plan) error {
+	bucket := fmt.Sprintf("%v/%v", plan.Name, plan.S3.Bucket)
+
+	_, _, err := runCmdContext(ctx, 0, nil, "mc", "--quiet", "ls", bucket)
 
 	if err == nil {
 		// nothing to do
@@ -141,18 +147,94 @@ func minioCreateBucket(plan config.Plan) error {
 	}
 
 	// bucket does not seem to exist, try to create it
-	createbucket := fmt.Sprintf("mc --quiet mb %v/%v", plan.Name, plan.S3.Bucket)
+	stdout, stderr, err := runCmdContext(ctx, 0, nil, "mc", "--quiet", "mb", bucket)
+
+	if err != nil {
+		return errors.Wrapf(err, "S3 creation of bucket %v failed %v", bucket, flatten(append(stdout, stderr...)))
+	}
+
+	return nil
+}
+
+type s3Destination struct {
+	plan      config.Plan
+	useAwsCli bool
+}
+
+func (d *s3Destination) Name() string {
+	return "s3"
+}
+
+var awsListRegex = regexp.MustCompile(`^(\S+ \S+)\s+(\d+)\s+(.+)$`)
+
+func (d *s3Destination) List() ([]RemoteArchive, error) {
+	aws, err := useAws(d.plan, d.useAwsCli)
+	if err != nil {
+		return nil, err
+	}
 
-	result, err := sh.Command("/bin/sh", "-c", createbucket).CombinedOutput()
+	objects := make([]RemoteArchive, 0)
+	if aws {
+		stdout, _, err := runCmd(0, "aws", "s3", "ls", fmt.Sprintf("s3://%v/", d.plan.S3.Bucket), "--recursive")
+		if err != nil {
+			return nil, errors.Wrapf(err, "S3 listing %v failed", d.plan.S3.Bucket)
+		}
+		for _, line := range strings.Split(string(stdout), "\n") {
+			matches := awsListRegex.FindStringSubmatch(strings.TrimSpace(line))
+			if matches == nil {
+				continue
+			}
+			size, _ := strconv.ParseInt(matches[2], 10, 64)
+			modified, _ := time.ParseInLocation("2006-01-02 15:04:05", matches[1], time.Local)
+			objects = append(objects, RemoteArchive{Key: matches[3], Size: size, Modified: modified.UTC()})
+		}
+		return objects, nil
+	}
 
+	if err := minioAlias(d.plan); err != nil {
+		return nil, err
+	}
+	stdout, _, err := runCmd(0, "mc", "--quiet", "ls", "--recursive", "--json", fmt.Sprintf("%v/%v", d.plan.Name, d.plan.S3.Bucket))
 	if err != nil {
-		output := ""
-		if len(result) > 0 {
-			output = strings.ReplaceAll(string(result), "\n", " ")
+		return nil, errors.Wrapf(err, "S3 listing %v failed", d.plan.S3.Bucket)
+	}
+	for _, line := range strings.Split(string(stdout), "\n") {
+		var item struct {
+			Type         string    `json:"type"`
+			Key          string    `json:"key"`
+			Size         int64     `json:"size"`
+			LastModified time.Time `json:"lastModified"`
 		}
+		if json.Unmarshal([]byte(line), &item) != nil || item.Type != "file" {
+			continue
+		}
+		objects = append(objects, RemoteArchive{Key: item.Key, Size: item.Size, Modified: item.LastModified.UTC()})
+	}
+	return objects, nil
+}
 
-		return errors.Wrapf(err, "S3 creation of bucket %v/%v failed %v", plan.Name, plan.S3.Bucket, output)
+func (d *s3Destination) Open(key string) (io.ReadCloser, error) {
+	aws, err := useAws(d.plan, d.useAwsCli)
+	if err != nil {
+		return nil, err
 	}
 
+	if aws {
+		return streamCmd("aws", "s3", "cp", fmt.Sprintf("s3://%v/%v", d.plan.S3.Bucket, key), "-")
+	}
+
+	if err := minioAlias(d.plan); err != nil {
+		return nil, err
+	}
+	return streamCmd("mc", "--quiet", "cat", fmt.Sprintf("%v/%v/%v", d.plan.Name, d.plan.S3.Bucket, key))
+}
+
+// minioAlias registers the plan alias, falling back to mc config host add for old clients
+func minioAlias(plan config.Plan) error {
+	if _, _, err := runCmd(0, minioAliasCmd(plan)...); err != nil {
+		if _, _, err := runCmd(0, minioHostAddCmd(plan)...); err != nil {
+			return errors.Wrapf(err, "mc alias set and mc config host add both failed for plan %v", plan.Name)
+		}
+	}
 	return nil
 }
@@ -1,11 +1,13 @@
 package backup
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -15,8 +17,67 @@ import (
 	"github.com/stefanprodan/mgob/pkg/config"
 )
 
-func sftpUpload(file string, plan config.Plan) (string, error) {
+func sftpUpload(ctx context.Context, file string, key string, plan config.Plan) (string, error) {
 	t1 := time.Now()
+	dstPath := filepath.Join(plan.SFTP.Dir, objectName(file, key))
+	// the upload goes through the sftp client, not a tool, a dry run records its equivalent
+	if record(ctx, []string{"sftp", "put", file, fmt.Sprintf("%v@%v:%v/%v", plan.SFTP.Username, plan.SFTP.Host, plan.SFTP.Port, dstPath)}) {
+		return "", nil
+	}
+
+	sshCon, sftpClient, err := sftpConnect(plan)
+	if err != nil {
+		return "", err
+	}
+	defer sshCon.Close()
+	defer sftpClient.Close()
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "Opening file %v failed", file)
+	}
+	defer f.Close()
+
+	if key != "" {
+		if err := sftpClient.MkdirAll(filepath.Dir(dstPath)); err != nil {
+			return "", errors.Wrapf(err, "SFTP %v:%v creating dir %v failed", plan.SFTP.Host, plan.SFTP.Port, filepath.Dir(dstPath))
+		}
+	}
+	sf, err := sftpClient.Create(dstPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "SFTP %v:%v creating file %v failed", plan.SFTP.Host, plan.SFTP.Port, dstPath)
+	}
+
+	_, err = io.Copy(sf, contextReader{ctx, f})
+	if err != nil {
+		sf.Close()
+		sftpClient.Remove(dstPath)
+		return "", errors.Wrapf(err, "SFTP %v:%v upload file %v failed", plan.SFTP.Host, plan.SFTP.Port, dstPath)
+	}
+	sf.Close()
+
+	//listSftpBackups(sftpClient, plan.SFTP.Dir)
+
+	t2 := time.Now()
+	msg := fmt.Sprintf("SFTP upload finished `%v` -> `%v` Duration: %v",
+		file, dstPath, t2.Sub(t1))
+	return msg, nil
+}
+
+func listSftpBackups(client *sftp.Client, dir string) error {
+	list, err := client.ReadDir(fmt.Sprintf("/%v", dir))
+	if err != nil {
+		return errors.Wrapf(err, "SFTP reading %v dir failed", dir)
+	}
+
+	for _, item := range list {
+		fmt.Println(item.Name())
+	}
+
+	return nil
+}
+
+func sftpConnect(plan config.Plan) (*ssh.Client, *sftp.Client, error) {
 	var ams []ssh.AuthMethod
 	if plan.SFTP.Password != "" {
 		ams = append(ams, ssh.Password(plan.SFTP.Password))
@@ -25,7 +86,7 @@ func sftpUpload(file string, plan config.Plan) (string, error) {
 	if plan.SFTP.PrivateKey != "" {
 		key, err := os.ReadFile(plan.SFTP.PrivateKey)
 		if err != nil {
-			return "", errors.Wrapf(err, "Reading privateKey from file %s", plan.SFTP.PrivateKey)
+			return nil, nil, errors.Wrapf(err, "Reading privateKey from file %s", plan.SFTP.PrivateKey)
 		}
 
 		var signer ssh.Signer
@@ -33,12 +94,12 @@ func sftpUpload(file string, plan config.Plan) (string, error) {
 		case plan.SFTP.PrivateKey != "" && plan.SFTP.Passphrase != "":
 			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(plan.SFTP.Passphrase))
 			if err != nil {
-				return "", errors.Wrapf(err, "Parsing private key from file %s", plan.SFTP.PrivateKey)
+				return nil, nil, errors.Wrapf(err, "Parsing private key from file %s", plan.SFTP.PrivateKey)
 			}
 		case plan.SFTP.PrivateKey != "":
 			signer, err = ssh.ParsePrivateKey(key)
 			if err != nil {
-				return "", errors.Wrapf(err, "Parsing private key from file %s", plan.SFTP.PrivateKey)
+				return nil, nil, errors.Wrapf(err, "Parsing private key from file %s", plan.SFTP.PrivateKey)
 			}
 		}
 		ams = append(ams, ssh.PublicKeys(signer))
@@ -54,52 +115,76 @@ func sftpUpload(file string, plan config.Plan) (string, error) {
 
 	sshCon, err := ssh.Dial("tcp", fmt.Sprintf("%v:%v", plan.SFTP.Host, plan.SFTP.Port), sshConf)
 	if err != nil {
-		return "", errors.Wrapf(err, "SSH dial to %v:%v failed", plan.SFTP.Host, plan.SFTP.Port)
+		return nil, nil, errors.Wrapf(err, "SSH dial to %v:%v failed", plan.SFTP.Host, plan.SFTP.Port)
 	}
-	defer sshCon.Close()
 
 	sftpClient, err := sftp.NewClient(sshCon)
 	if err != nil {
-		return "", errors.Wrapf(err, "SFTP client init %v:%v failed", plan.SFTP.Host, plan.SFTP.Port)
+		sshCon.Close()
+		return nil, nil, errors.Wrapf(err, "SFTP client init %v:%v failed", plan.SFTP.Host, plan.SFTP.Port)
 	}
-	defer sftpClient.Close()
 
-	f, err := os.Open(file)
-	if err != nil {
-		return "", errors.Wrapf(err, "Opening file %v failed", file)
-	}
-	defer f.Close()
+	return sshCon, sftpClient, nil
+}
 
-	_, fname := filepath.Split(file)
-	dstPath := filepath.Join(plan.SFTP.Dir, fname)
-	sf, err := sftpClient.Create(dstPath)
+type sftpDestination struct {
+	plan config.Plan
+}
+
+func (d *sftpDestination) Name() string {
+	return "sftp"
+}
+
+func (d *sftpDestination) List() ([]RemoteArchive, error) {
+	sshCon, sftpClient, err := sftpConnect(d.plan)
 	if err != nil {
-		return "", errors.Wrapf(err, "SFTP %v:%v creating file %v failed", plan.SFTP.Host, plan.SFTP.Port, dstPath)
+		return nil, err
 	}
+	defer sshCon.Close()
+	defer sftpClient.Close()
 
-	_, err = io.Copy(sf, f)
-	if err != nil {
-		return "", errors.Wrapf(err, "SFTP %v:%v upload file %v failed", plan.SFTP.Host, plan.SFTP.Port, dstPath)
+	objects := make([]RemoteArchive, 0)
+	walker := sftpClient.Walk(d.plan.SFTP.Dir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, errors.Wrapf(err, "SFTP listing %v failed", d.plan.SFTP.Dir)
+		}
+		info := walker.Stat()
+		if info.IsDir() {
+			continue
+		}
+		key := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), d.plan.SFTP.Dir), "/")
+		objects = append(objects, RemoteArchive{Key: key, Size: info.Size(), Modified: info.ModTime().UTC()})
 	}
-	sf.Close()
+	return objects, nil
+}
 
-	//listSftpBackups(sftpClient, plan.SFTP.Dir)
+// sftpReader closes the ssh connection along with the remote file
+type sftpReader struct {
+	*sftp.File
+	sshCon     *ssh.Client
+	sftpClient *sftp.Client
+}
 
-	t2 := time.Now()
-	msg := fmt.Sprintf("SFTP upload finished `%v` -> `%v` Duration: %v",
-		file, dstPath, t2.Sub(t1))
-	return msg, nil
+func (r *sftpReader) Close() error {
+	err := r.File.Close()
+	r.sftpClient.Close()
+	r.sshCon.Close()
+	return err
 }
 
-func listSftpBackups(client *sftp.Client, dir string) error {
-	list, err := client.ReadDir(fmt.Sprintf("/%v", dir))
+func (d *sftpDestination) Open(key string) (io.ReadCloser, error) {
+	sshCon, sftpClient, err := sftpConnect(d.plan)
 	if err != nil {
-		return errors.Wrapf(err, "SFTP reading %v dir failed", dir)
+		return nil, err
 	}
 
-	for _, item := range list {
-		fmt.Println(item.Name())
+	remote := filepath.Join(d.plan.SFTP.Dir, key)
+	f, err := sftpClient.Open(remote)
+	if err != nil {
+		sftpClient.Close()
+		sshCon.Close()
+		return nil, errors.Wrapf(err, "SFTP opening %v failed", remote)
 	}
-
-	return nil
+	return &sftpReader{File: f, sshCon: sshCon, sftpClient: sftpClient}, nil
 }
@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+// snapshots are kept apart from the plan archives, out of reach of the glob retention
+const snapshotDir = "snapshots"
+
+// Snapshot dumps a restore target into a pinned archive of the plan local storage before a restore.
+// The namespaces of info are dumped, the target database or all databases when there are none.
+// The archive is encrypted like the plan backups, info is recorded in its manifest.
+func Snapshot(ctx context.Context, plan config.Plan, conf *config.AppConfig, store *db.StatusStore, target config.Target, info db.Snapshot) (*db.Archive, error) {
+	if store == nil {
+		return nil, errors.New("snapshots need the backup manifest")
+	}
+	if conf.StoragePath == "" {
+		return nil, errors.New("snapshots need a storage path")
+	}
+
+	t1 := time.Now()
+	ts := t1.UTC()
+	name := fmt.Sprintf("%v-snapshot-%v.gz", plan.Name, ts.Unix())
+	key := path.Join(plan.Name, snapshotDir, name)
+	file := filepath.Join(conf.StoragePath, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, errors.Wrapf(err, "creating dir %v failed", filepath.Dir(file))
+	}
+
+	if len(info.Namespaces) > 0 {
+		// the namespaces hold their database
+		target.Database = ""
+	}
+	info.Database = target.Database
+	dumpCmd, err := BuildDumpCmd(file, target)
+	if err != nil {
+		return nil, err
+	}
+	for _, ns := range info.Namespaces {
+		dumpCmd = append(dumpCmd, "--nsInclude", ns)
+	}
+	log.WithField("plan", plan.Name).Debugf("snapshot cmd: %v", redact.String(strings.Join(dumpCmd, " ")))
+	timeout := time.Duration(plan.Scheduler.Timeout) * time.Minute
+	if _, _, err := runCmdContext(ctx, timeout, nil, dumpCmd...); err != nil {
+		os.Remove(file)
+		return nil, errors.Wrap(err, "mongodump of the restore target failed")
+	}
+
+	archive := &db.Archive{
+		Plan:         plan.Name,
+		Timestamp:    ts,
+		Destinations: []string{"local"},
+		Pinned:       true,
+		Snapshot:     &info,
+	}
+	if plan.Encryption != nil {
+		encryptedFile := fmt.Sprintf("%v.encrypted", file)
+		output, recipients, err := encrypt(ctx, file, encryptedFile, plan, conf)
+		if err != nil {
+			os.Remove(file)
+			return nil, err
+		}
+		removeUnencrypted(file, encryptedFile)
+		file = encryptedFile
+		name = fmt.Sprintf("%v.encrypted", name)
+		key = fmt.Sprintf("%v.encrypted", key)
+		archive.Encrypted = true
+		archive.Recipients = recipients
+		log.WithField("plan", plan.Name).Infof("Snapshot encryption finished %v", output)
+	}
+	archive.Name = name
+	archive.Key = key
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "stat file %v failed", file)
+	}
+	checksum, err := fileChecksum(file)
+	if err != nil {
+		return nil, err
+	}
+
+	archive.Size = fi.Size()
+	archive.Checksum = checksum
+	if err := store.PutArchive(archive); err != nil {
+		os.Remove(file)
+		return nil, err
+	}
+
+	log.WithField("plan", plan.Name).Infof("Snapshot %v of the restore target finished in %v", file, time.Since(t1))
+	return archive, nil
+}
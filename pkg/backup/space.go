@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// number of manifest entries used to compute the compression ratio
+const compressionHistory = 5
+
+// free space kept on top of the estimated archive size
+const spaceMargin = 1.1
+
+// InsufficientSpaceError is returned when a path can't hold the estimated archive
+type InsufficientSpaceError struct {
+	Path      string
+	Required  uint64
+	Available uint64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("insufficient disk space in %v: %v required, %v available",
+		e.Path, humanize.Bytes(e.Required), humanize.Bytes(e.Available))
+}
+
+type targetStats struct {
+	DataSize    float64 `bson:"dataSize"`
+	StorageSize float64 `bson:"storageSize"`
+}
+
+// checkDiskSpace estimates the archive size from the target dbStats and the plan compression history,
+// then makes sure the temp and storage paths can hold it. The data size is returned to be recorded
+// in the manifest, zero if the target stats are not available.
+func checkDiskSpace(plan config.Plan, conf *config.AppConfig, store *db.StatusStore) (int64, error) {
+	stats, err := getTargetStats(plan.Target)
+	if err != nil {
+		log.WithField("plan", plan.Name).Warnf("Disk space check skipped, target stats failed %v", err)
+		return 0, nil
+	}
+
+	ratio := defaultCompressionRatio(stats, plan.Target.NoGzip)
+	if store != nil {
+		archives, err := store.GetArchives(plan.Name)
+		if err != nil {
+			log.WithField("plan", plan.Name).Warnf("Compression history lookup failed %v", err)
+		} else if r, ok := compressionRatio(archives); ok {
+			ratio = r
+		}
+	}
+
+	estimate := uint64(stats.DataSize * ratio * spaceMargin)
+	log.WithField("plan", plan.Name).Debugf("Archive size estimated at %v, data size %v, compression ratio %.2f",
+		humanize.Bytes(estimate), humanize.Bytes(uint64(stats.DataSize)), ratio)
+
+	required := map[string]uint64{conf.TmpPath: estimate}
+	if plan.Encryption != nil {
+		// the archive and its encrypted copy are both in the temp dir until the encryption finishes
+		required[conf.TmpPath] += estimate
+	}
+	if conf.StoragePath != "" && plan.Scheduler.Retention != 0 {
+		required[conf.StoragePath] += estimate
+	}
+
+	if err := checkFreeSpace(required); err != nil {
+		return 0, err
+	}
+
+	return int64(stats.DataSize), nil
+}
+
+// compressionRatio averages the archive to data size ratio of the latest manifest entries
+func compressionRatio(archives []*db.Archive) (float64, bool) {
+	sum := 0.0
+	count := 0
+	for _, archive := range archives {
+		if archive.DataSize <= 0 || archive.Size <= 0 {
+			continue
+		}
+		sum += float64(archive.Size) / float64(archive.DataSize)
+		count++
+		if count == compressionHistory {
+			break
+		}
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return sum / float64(count), true
+}
+
+// defaultCompressionRatio is used without history, the storage engine compression
+// is a conservative guess of what gzip achieves
+func defaultCompressionRatio(stats targetStats, noGzip bool) float64 {
+	if noGzip || stats.DataSize <= 0 || stats.StorageSize <= 0 || stats.StorageSize > stats.DataSize {
+		return 1
+	}
+	return stats.StorageSize / stats.DataSize
+}
+
+// getTargetStats sums up the dbStats of the dumped databases
+func getTargetStats(target config.Target) (targetStats, error) {
+	var stats targetStats
+
+	uri := target.Uri
+	if uri == "" {
+		uri = BuildUri(target)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return stats, errors.Wrap(err, "connecting to target failed")
+	}
+	defer client.Disconnect(context.Background())
+
+	databases := []string{target.Database}
+	if target.Database == "" {
+		if databases, err = client.ListDatabaseNames(ctx, bson.D{}); err != nil {
+			return stats, errors.Wrap(err, "listing databases failed")
+		}
+	}
+
+	for _, name := range databases {
+		if name == "local" {
+			// mongodump skips the local database
+			continue
+		}
+		var s targetStats
+		if err := client.Database(name).RunCommand(ctx, bson.D{{Key: "dbStats", Value: 1}}).Decode(&s); err != nil {
+			return stats, errors.Wrapf(err, "dbStats on %v failed", name)
+		}
+		stats.DataSize += s.DataSize
+		stats.StorageSize += s.StorageSize
+	}
+
+	return stats, nil
+}
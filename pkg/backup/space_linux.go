@@ -0,0 +1,48 @@
+//go:build linux
+
+package backup
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// checkFreeSpace compares the required bytes per path with the free space,
+// paths on the same filesystem are summed up
+func checkFreeSpace(required map[string]uint64) error {
+	type device struct {
+		path      string
+		required  uint64
+		available uint64
+	}
+	devices := make(map[uint64]*device)
+
+	for path, bytes := range required {
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(path, &fs); err != nil {
+			return errors.Wrapf(err, "reading free space of %v failed", path)
+		}
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil {
+			return errors.Wrapf(err, "stat %v failed", path)
+		}
+		dev := uint64(st.Dev)
+		if d, ok := devices[dev]; ok {
+			d.required += bytes
+			continue
+		}
+		devices[dev] = &device{
+			path:      path,
+			required:  bytes,
+			available: uint64(fs.Bavail) * uint64(fs.Bsize),
+		}
+	}
+
+	for _, d := range devices {
+		if d.required > d.available {
+			return &InsufficientSpaceError{Path: d.path, Required: d.required, Available: d.available}
+		}
+	}
+	return nil
+}
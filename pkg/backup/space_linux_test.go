@@ -0,0 +1,18 @@
+package backup
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_checkFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, checkFreeSpace(map[string]uint64{dir: 1}))
+
+	err := checkFreeSpace(map[string]uint64{dir: math.MaxUint64})
+	var spaceErr *InsufficientSpaceError
+	assert.ErrorAs(t, err, &spaceErr)
+	assert.Equal(t, dir, spaceErr.Path)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package backup
+
+// checkFreeSpace can't read the free space on this platform, the check is skipped
+func checkFreeSpace(required map[string]uint64) error {
+	return nil
+}
@@ -0,0 +1,29 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_compressionRatio(t *testing.T) {
+	archives := []*db.Archive{
+		{Size: 30, DataSize: 100},
+		{Size: 10, DataSize: 0},
+		{Size: 50, DataSize: 100},
+	}
+	ratio, ok := compressionRatio(archives)
+	assert.True(t, ok)
+	assert.InDelta(t, 0.4, ratio, 0.0001)
+
+	_, ok = compressionRatio([]*db.Archive{{Size: 10}})
+	assert.False(t, ok)
+}
+
+func Test_defaultCompressionRatio(t *testing.T) {
+	stats := targetStats{DataSize: 1000, StorageSize: 250}
+	assert.Equal(t, 0.25, defaultCompressionRatio(stats, false))
+	assert.Equal(t, 1.0, defaultCompressionRatio(stats, true))
+	assert.Equal(t, 1.0, defaultCompressionRatio(targetStats{DataSize: 100, StorageSize: 200}, false))
+}
@@ -2,65 +2,78 @@ package backup
 
 import (
 	"fmt"
+	"net/url"
+
+	"github.com/pkg/errors"
 
 	"github.com/stefanprodan/mgob/pkg/config"
 )
 
-func BuildDumpCmd(archive string, target config.Target) string {
+func BuildDumpCmd(archive string, target config.Target) ([]string, error) {
 	return buildCmd("mongodump", archive, target, "")
 }
 
-func BuildRestoreCmd(archive string, target config.Target, restore config.Target) string {
+func BuildRestoreCmd(archive string, target config.Target, restore config.Target) ([]string, error) {
 	if target.Database != restore.Database {
-		cmd := buildCmd("mongorestore", archive, restore, target.Database)
-		cmd += fmt.Sprintf("--nsFrom %v.* --nsTo %v.* ", target.Database, restore.Database)
-		return cmd
+		cmd, err := buildCmd("mongorestore", archive, restore, target.Database)
+		if err != nil {
+			return nil, err
+		}
+		cmd = append(cmd,
+			"--nsFrom", fmt.Sprintf("%v.*", target.Database),
+			"--nsTo", fmt.Sprintf("%v.*", restore.Database))
+		return cmd, nil
 	}
 	return buildCmd("mongorestore", archive, restore, "")
 
 }
 
 // command: mongodump | mongorestore
-func buildCmd(command string, archive string, target config.Target, overrideDBName string) string {
-	cmd := fmt.Sprintf("%v --archive=%v ", command, archive)
+func buildCmd(command string, archive string, target config.Target, overrideDBName string) ([]string, error) {
+	cmd := []string{command, fmt.Sprintf("--archive=%v", archive)}
 	if !target.NoGzip {
-		cmd += "--gzip "
+		cmd = append(cmd, "--gzip")
 	}
 	// using uri (New in version 3.4.6)
 	// host/port/username/password are incompatible with uri
 	// https://docs.mongodb.com/manual/reference/program/mongodump/#cmdoption-mongodump-uri
 	// use older host/port
 	if target.Uri != "" {
-		cmd += fmt.Sprintf(`--uri "%v" `, target.Uri)
+		cmd = append(cmd, "--uri", target.Uri)
 	} else {
-		cmd += fmt.Sprintf("--host %v --port %v ", target.Host, target.Port)
+		cmd = append(cmd, "--host", target.Host, "--port", fmt.Sprintf("%v", target.Port))
 
 		if target.Username != "" && target.Password != "" {
-			cmd += fmt.Sprintf(`-u "%v" -p "%v" `, target.Username, target.Password)
+			cmd = append(cmd, "-u", target.Username, "-p", target.Password)
 		}
 	}
 
 	if target.Database != "" {
 		if command == "mongodump" && target.Uri == "" {
-			cmd += fmt.Sprintf("--db %v ", target.Database)
+			cmd = append(cmd, "--db", target.Database)
 		} else {
 			if overrideDBName != "" {
-				cmd += fmt.Sprintf("--nsInclude %v.* ", overrideDBName)
+				cmd = append(cmd, "--nsInclude", fmt.Sprintf("%v.*", overrideDBName))
 			} else {
-				cmd += fmt.Sprintf("--nsInclude %v.* ", target.Database)
+				cmd = append(cmd, "--nsInclude", fmt.Sprintf("%v.*", target.Database))
 			}
 		}
 	}
 
 	if target.Params != "" {
-		cmd += fmt.Sprintf("%v ", target.Params)
+		params, err := splitArgs(target.Params)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing target params failed")
+		}
+		cmd = append(cmd, params...)
 	}
-	return cmd
+	return cmd, nil
 }
 
 func BuildUri(target config.Target) string {
 	if target.Username != "" && target.Password != "" {
-		return fmt.Sprintf("mongodb://%v:%v@%v:%v", target.Username, target.Password, target.Host, target.Port)
+		// escape the credentials, a password containing @ or / would break the uri
+		return fmt.Sprintf("mongodb://%v@%v:%v", url.UserPassword(target.Username, target.Password), target.Host, target.Port)
 	}
 	return fmt.Sprintf("mongodb://%v:%v", target.Host, target.Port)
 }
@@ -2,53 +2,429 @@ package backup
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/stefanprodan/mgob/pkg/archive"
 	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/redact"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func ValidateBackup(archive string, plan config.Plan, backupResult map[string]string) (bool, error) {
-	output, err := RunRestore(archive, plan)
+// default number of documents compared per collection by the sample checksum
+const defaultSampleSize = 100
+
+// ValidateBackup restores an archive into the validation database and compares every collection
+// with the archive, the report is returned with the error when a check failed
+func ValidateBackup(ctx context.Context, archivePath string, plan config.Plan, backupResult map[string]string) (*db.Validation, error) {
+	t1 := time.Now()
+	output, err := RunRestore(ctx, archivePath, plan)
 	if err != nil {
 		log.WithField("plan", plan.Name).Error("Validation: Failed to execute restore command. restore failed, cleaning up")
-		return false, errors.Wrapf(err, "failed to execute restore command")
+		return nil, errors.Wrapf(err, "failed to execute restore command")
 	}
+	warnings := restoreWarnings(string(output))
 	if err := CheckIfAnyFailure(string(output)); err != nil {
-		return false, errors.Wrapf(err, "failed to restore backup")
+		return &db.Validation{Status: "failed", Warnings: warnings, Collections: make([]db.CollectionValidation, 0)},
+			errors.Wrapf(err, "failed to restore backup")
+	}
+	client, clientCtx, err := GetMongoClient(BuildUri(plan.Validation.Database))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get mongo client")
+	}
+	defer Dispose(client, clientCtx)
+	collectionNames, err := getRestoreCollectionNames(ctx, plan.Validation.Database.Database, client)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get collection names")
+	}
+	if err = checkRetoreDatabase(backupResult, restoredNamespaces(plan, collectionNames)); err != nil {
+		return nil, errors.Wrapf(err, "failed to run validation check against restore database")
+	}
+	restoreDuration := time.Since(t1)
+	report, err := validateCollections(ctx, archivePath, plan, client, backupResult)
+	if report != nil {
+		report.RestoreDuration = restoreDuration
+		report.Warnings = warnings
+		report.Version = serverVersion(ctx, client)
+	}
+	if err != nil {
+		return report, errors.Wrapf(err, "failed to compare the restore database with the backup")
+	}
+	if failures := validationFailures(report); len(failures) > 0 {
+		return report, errors.Errorf("validation failed: %v", strings.Join(failures, "; "))
+	}
+	log.WithField("plan", plan.Name).Infof("Validation: %v collections passed", len(report.Collections))
+	if err = cleanMongo(ctx, plan.Validation.Database.Database, client); err != nil {
+		return report, errors.Wrapf(err, "failed to clean mongo validation database")
+	}
+
+	return report, nil
+}
+
+func checkValidation(validation config.Validation) error {
+	switch validation.Checksum {
+	case "", "dbHash", "sample":
+	default:
+		return errors.Errorf("unknown validation checksum %v, use dbHash or sample", validation.Checksum)
+	}
+
+	labels := make(map[string]bool)
+	for _, target := range validation.Targets {
+		if target.Label == "" {
+			return errors.New("validation targets need a label")
+		}
+		if labels[target.Label] {
+			return errors.Errorf("validation target %v is defined twice", target.Label)
+		}
+		labels[target.Label] = true
+		if target.Ephemeral == nil && target.Database.Host == "" && target.Database.Uri == "" {
+			return errors.Errorf("validation target %v needs a database or an ephemeral mongod", target.Label)
+		}
+	}
+	return nil
+}
+
+var (
+	// restoreWarningRegex matches the mongorestore log lines worth reporting, like index build errors
+	restoreWarningRegex   = regexp.MustCompile(`(?i)warning|error|fail|deprecated|incompatib|not supported|skipping`)
+	restoreSummaryRegex   = regexp.MustCompile(`document\(s\) restored successfully|\(\d+ documents?, 0 failures\)`)
+	restoreTimestampRegex = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\S+\s+`)
+)
+
+// restoreWarnings extracts the warnings and errors of a mongorestore log, without their timestamp
+func restoreWarnings(output string) []string {
+	warnings := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || restoreSummaryRegex.MatchString(line) || !restoreWarningRegex.MatchString(line) {
+			continue
+		}
+		warnings = append(warnings, restoreTimestampRegex.ReplaceAllString(line, ""))
+	}
+	return warnings
+}
+
+// serverVersion returns the version of a MongoDB server, empty if buildInfo fails
+func serverVersion(ctx context.Context, client *mongo.Client) string {
+	var info struct {
+		Version string `bson:"version"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info); err != nil {
+		return ""
+	}
+	return info.Version
+}
+
+// validateCollections compares the document counts and the indexes of the archived collections
+// with the restored ones and, if the plan asks for it, their content with the target. The target
+// keeps changing after the dump, a content difference is a warning and not a failure.
+func validateCollections(ctx context.Context, archivePath string, plan config.Plan, client *mongo.Client, backupResult map[string]string) (*db.Validation, error) {
+	contents, err := archive.ReadFile(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	checksum := plan.Validation.Checksum
+	if err := checkValidation(*plan.Validation); err != nil {
+		return nil, err
+	}
+
+	if plan.Scheduler.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(plan.Scheduler.Timeout)*time.Minute)
+		defer cancel()
+	}
+
+	var source *mongo.Client
+	if checksum != "" {
+		uri := plan.Target.Uri
+		if uri == "" {
+			uri = BuildUri(plan.Target)
+		}
+		var sourceCtx context.Context
+		if source, sourceCtx, err = GetMongoClient(uri); err != nil {
+			return nil, err
+		}
+		defer Dispose(source, sourceCtx)
+	}
+
+	collections := validatedCollections(contents)
+	report := &db.Validation{
+		Status:      "passed",
+		Checksum:    checksum,
+		Collections: make([]db.CollectionValidation, 0, len(collections)),
+	}
+
+	// the hashes are keyed by db.collection, the archive may hold several databases
+	sourceHashes, restoredHashes := make(map[string]string), make(map[string]string)
+	if checksum == "dbHash" {
+		for database, names := range collectionsByDatabase(collections) {
+			if err := collectHashes(ctx, source.Database(database), names, database, sourceHashes); err != nil {
+				return nil, err
+			}
+			restoredDb := client.Database(restoredDatabase(plan, database))
+			if err := collectHashes(ctx, restoredDb, names, database, restoredHashes); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sampleSize := plan.Validation.SampleSize
+	if sampleSize <= 0 {
+		sampleSize = defaultSampleSize
+	}
+
+	for _, c := range collections {
+		cv := db.CollectionValidation{Collection: c.Namespace(), Dumped: -1, Archived: c.Documents, Indexes: len(c.Indexes)}
+		if n, ok := backupResult[c.Namespace()]; ok {
+			if cv.Dumped, err = strconv.ParseInt(n, 10, 64); err != nil {
+				cv.Dumped = -1
+			}
+		}
+
+		restored := client.Database(restoredDatabase(plan, c.Database)).Collection(c.Collection)
+		if cv.Restored, err = restored.EstimatedDocumentCount(ctx); err != nil {
+			return report, errors.Wrapf(err, "counting documents of %v failed", c.Namespace())
+		}
+		cv.Errors = append(cv.Errors, compareCounts(cv)...)
+
+		indexes, err := listIndexes(ctx, restored)
+		if err != nil {
+			return report, err
+		}
+		cv.Errors = append(cv.Errors, compareIndexes(c.Indexes, indexes)...)
+
+		switch checksum {
+		case "dbHash":
+			cv.Checksum = "match"
+			if sourceHashes[c.Namespace()] != restoredHashes[c.Namespace()] {
+				cv.Checksum = "mismatch"
+				cv.Warnings = append(cv.Warnings, "dbHash differs from the target")
+			}
+		case "sample":
+			sampled, mismatches, err := sampleChecksum(ctx, source.Database(c.Database).Collection(c.Collection), restored, sampleSize)
+			if err != nil {
+				return report, err
+			}
+			cv.Sampled = sampled
+			cv.Checksum = "match"
+			if mismatches > 0 {
+				cv.Checksum = "mismatch"
+				cv.Warnings = append(cv.Warnings, fmt.Sprintf("%v of %v sampled documents differ from the target", mismatches, sampled))
+			}
+		}
+
+		if len(cv.Errors) > 0 {
+			report.Status = "failed"
+		}
+		report.Collections = append(report.Collections, cv)
+	}
+	return report, nil
+}
+
+// validatedCollections skips the oplog, the views and the system collections, which hold no comparable documents
+func validatedCollections(contents *archive.Contents) []archive.Collection {
+	result := make([]archive.Collection, 0, len(contents.Collections))
+	for _, c := range contents.Collections {
+		if c.Database == "" || c.Type == "view" || strings.HasPrefix(c.Collection, "system.") {
+			continue
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// restoredDatabase is where mongorestore puts a database of the archive, see BuildRestoreCmd
+func restoredDatabase(plan config.Plan, database string) string {
+	if plan.Target.Database != plan.Validation.Database.Database {
+		return plan.Validation.Database.Database
+	}
+	return database
+}
+
+// restoredNamespaces names the restored collections by the db.collection they were dumped from
+func restoredNamespaces(plan config.Plan, collectionNames []string) []string {
+	database := plan.Target.Database
+	if database == "" {
+		database = plan.Validation.Database.Database
+	}
+	namespaces := make([]string, 0, len(collectionNames))
+	for _, name := range collectionNames {
+		namespaces = append(namespaces, database+"."+name)
+	}
+	return namespaces
+}
+
+func collectionsByDatabase(collections []archive.Collection) map[string][]string {
+	result := make(map[string][]string)
+	for _, c := range collections {
+		result[c.Database] = append(result[c.Database], c.Collection)
+	}
+	return result
+}
+
+func compareCounts(cv db.CollectionValidation) []string {
+	errs := make([]string, 0)
+	if cv.Dumped >= 0 && cv.Dumped != cv.Archived {
+		errs = append(errs, fmt.Sprintf("mongodump reported %v documents, the archive holds %v", cv.Dumped, cv.Archived))
 	}
-	client, ctx, err := GetMongoClient(BuildUri(plan.Validation.Database))
+	if cv.Restored != cv.Archived {
+		errs = append(errs, fmt.Sprintf("%v documents restored out of %v", cv.Restored, cv.Archived))
+	}
+	return errs
+}
+
+// compareIndexes matches the indexes by name, then compares their keys and options
+func compareIndexes(expected []bson.M, restored []bson.M) []string {
+	byName := make(map[string]bson.M)
+	for _, idx := range restored {
+		byName[fmt.Sprint(idx["name"])] = idx
+	}
+
+	errs := make([]string, 0)
+	for _, idx := range expected {
+		name := fmt.Sprint(idx["name"])
+		got, ok := byName[name]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("index %v is missing", name))
+			continue
+		}
+		if indexSignature(idx) != indexSignature(got) {
+			errs = append(errs, fmt.Sprintf("index %v differs, expected %v got %v", name, indexSignature(idx), indexSignature(got)))
+		}
+	}
+	return errs
+}
+
+var indexOptions = []string{"unique", "sparse", "expireAfterSeconds", "partialFilterExpression", "collation"}
+
+// indexSignature formats the key and the options of an index, the numbers of both sides are
+// normalized since the archive metadata and the server don't always agree on their type
+func indexSignature(idx bson.M) string {
+	parts := []string{fmt.Sprint(normalizeNumbers(idx["key"]))}
+	for _, option := range indexOptions {
+		if v, ok := idx[option]; ok && v != false {
+			parts = append(parts, fmt.Sprintf("%v:%v", option, normalizeNumbers(v)))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func normalizeNumbers(v interface{}) interface{} {
+	switch value := v.(type) {
+	case int32:
+		return float64(value)
+	case int64:
+		return float64(value)
+	case int:
+		return float64(value)
+	case bson.M:
+		result := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			result[k] = normalizeNumbers(item)
+		}
+		return result
+	case bson.D:
+		result := make(map[string]interface{}, len(value))
+		for _, e := range value {
+			result[e.Key] = normalizeNumbers(e.Value)
+		}
+		return result
+	case bson.A:
+		result := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			result = append(result, normalizeNumbers(item))
+		}
+		return result
+	}
+	return v
+}
+
+func listIndexes(ctx context.Context, collection *mongo.Collection) ([]bson.M, error) {
+	cursor, err := collection.Indexes().List(ctx)
 	if err != nil {
-		return false, errors.Wrapf(err, "failed to get mongo client")
+		return nil, errors.Wrapf(err, "listing indexes of %v failed", collection.Name())
 	}
-	defer Dispose(client, ctx)
-	collectionNames, err := getRestoreCollectionNames(plan.Validation.Database.Database, client)
+	indexes := make([]bson.M, 0)
+	if err := cursor.All(ctx, &indexes); err != nil {
+		return nil, errors.Wrapf(err, "listing indexes of %v failed", collection.Name())
+	}
+	return indexes, nil
+}
+
+// collectHashes adds the dbHash of the given collections of a database to hashes, keyed by db.collection
+func collectHashes(ctx context.Context, database *mongo.Database, collections []string, source string, hashes map[string]string) error {
+	result, err := dbHash(ctx, database, collections)
 	if err != nil {
-		return false, errors.Wrapf(err, "failed to get collection names")
+		return err
+	}
+	for name, hash := range result {
+		hashes[source+"."+name] = hash
+	}
+	return nil
+}
+
+// dbHash returns the md5 of the given collections of a database
+func dbHash(ctx context.Context, database *mongo.Database, collections []string) (map[string]string, error) {
+	var res struct {
+		Collections map[string]string `bson:"collections"`
+	}
+	cmd := bson.D{{Key: "dbHash", Value: 1}, {Key: "collections", Value: collections}}
+	if err := database.RunCommand(ctx, cmd).Decode(&res); err != nil {
+		return nil, errors.Wrapf(err, "dbHash of %v failed", database.Name())
 	}
-	if err = checkRetoreDatabase(backupResult, collectionNames); err != nil {
-		return false, errors.Wrapf(err, "failed to run validation check against restore database")
+	return res.Collections, nil
+}
+
+// sampleChecksum compares the hash of random restored documents with the same documents of the target
+func sampleChecksum(ctx context.Context, source *mongo.Collection, restored *mongo.Collection, size int) (int, int, error) {
+	cursor, err := restored.Aggregate(ctx, mongo.Pipeline{{{Key: "$sample", Value: bson.D{{Key: "size", Value: size}}}}})
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "sampling %v failed", restored.Name())
 	}
-	if err = cleanMongo(plan.Validation.Database.Database, client); err != nil {
-		return false, errors.Wrapf(err, "failed to clean mongo validation database")
+	defer cursor.Close(ctx)
+
+	sampled, mismatches := 0, 0
+	for cursor.Next(ctx) {
+		sampled++
+		doc, err := source.FindOne(ctx, bson.D{{Key: "_id", Value: cursor.Current.Lookup("_id")}}).DecodeBytes()
+		if err == mongo.ErrNoDocuments {
+			mismatches++
+			continue
+		}
+		if err != nil {
+			return sampled, mismatches, errors.Wrapf(err, "reading %v from the target failed", source.Name())
+		}
+		if sha256.Sum256(doc) != sha256.Sum256(cursor.Current) {
+			mismatches++
+		}
 	}
+	return sampled, mismatches, cursor.Err()
+}
 
-	return true, nil
+func validationFailures(report *db.Validation) []string {
+	failures := make([]string, 0)
+	for _, cv := range report.Collections {
+		for _, e := range cv.Errors {
+			failures = append(failures, fmt.Sprintf("%v: %v", cv.Collection, e))
+		}
+	}
+	return failures
 }
 
 func CheckIfAnyFailure(output string) error {
 	numberOfFailedCaptureRegex := `(\d+)\sdocument\(s\)\srestored\ssuccessfully\.\s(\d+)\sdocument\(s\)\sfailed`
 	reg := regexp.MustCompile(numberOfFailedCaptureRegex)
 	matches := reg.FindStringSubmatch(output)
-	if reg.NumSubexp() == 2 {
+	if matches != nil {
 		if matches[1] == "0" || matches[2] != "0" {
 			return errors.New(fmt.Sprintf("mongorestore failed with %v failed documents", matches[1]))
 		}
@@ -62,8 +438,8 @@ func Dispose(client *mongo.Client, ctx context.Context) {
 	}
 }
 
-func getRestoreCollectionNames(databaseName string, client *mongo.Client) ([]string, error) {
-	collectionNames, err := client.Database(databaseName).ListCollectionNames(context.TODO(), bson.M{})
+func getRestoreCollectionNames(ctx context.Context, databaseName string, client *mongo.Client) ([]string, error) {
+	collectionNames, err := client.Database(databaseName).ListCollectionNames(ctx, bson.M{})
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get collection names in database %v", databaseName)
 	}
@@ -86,23 +462,29 @@ func checkRetoreDatabase(backupResult map[string]string, collectionNames []strin
 	return nil
 }
 
-func RunRestore(archive string, plan config.Plan) ([]byte, error) {
-	restoreCmd := BuildRestoreCmd(archive, plan.Target, plan.Validation.Database)
-	log.WithField("plan", plan.Name).Infof("Validation: restore backup with : %v", restoreCmd)
-	output, err := sh.Command("/bin/sh", "-c", restoreCmd).SetTimeout(time.Duration(plan.Scheduler.Timeout) * time.Minute).CombinedOutput()
+func RunRestore(ctx context.Context, archivePath string, plan config.Plan) ([]byte, error) {
+	restoreCmd, err := BuildRestoreCmd(archivePath, plan.Target, plan.Validation.Database)
 	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return nil, errors.Wrapf(err, "mongorestore log %v", ex)
+		return nil, err
+	}
+	log.WithField("plan", plan.Name).Infof("Validation: restore backup with : %v", redact.String(strings.Join(restoreCmd, " ")))
+	return ExecRestore(ctx, plan, restoreCmd)
+}
+
+// ExecRestore runs a mongorestore command with the plan timeout and returns its log,
+// mongorestore is killed when ctx is cancelled
+func ExecRestore(ctx context.Context, plan config.Plan, restoreCmd []string) ([]byte, error) {
+	// the mongo tools write their log to stderr
+	_, output, err := runCmdContext(ctx, time.Duration(plan.Scheduler.Timeout)*time.Minute, nil, restoreCmd...)
+	if err != nil {
+		return nil, errors.Wrap(err, "mongorestore failed")
 	}
 	log.WithField("plan", plan.Name).Debugf("restore output: %v", string(output))
 	return output, nil
 }
 
-func cleanMongo(dbName string, client *mongo.Client) error {
-	err := client.Database(dbName).Drop(context.TODO())
+func cleanMongo(ctx context.Context, dbName string, client *mongo.Client) error {
+	err := client.Database(dbName).Drop(ctx)
 	if err != nil {
 		return errors.Wrapf(err, "failed to drop database %v", dbName)
 	}
@@ -112,10 +494,10 @@ func cleanMongo(dbName string, client *mongo.Client) error {
 func GetMongoClient(uri string) (*mongo.Client, context.Context, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	log.Infof("Validation: connect to %v", uri)
+	log.Infof("Validation: connect to %v", redact.String(uri))
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
 	if err != nil {
-		return nil, ctx, errors.Wrapf(err, "failed to connect to mongo with uri %v", uri)
+		return nil, ctx, errors.Wrapf(err, "failed to connect to mongo with uri %v", redact.String(uri))
 	}
 	return client, ctx, nil
 }
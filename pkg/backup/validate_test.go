@@ -4,6 +4,11 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/stefanprodan/mgob/pkg/archive"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
 )
 
 func Test_checkIfAnyFailure_No_Failure(t *testing.T) {
@@ -67,3 +72,95 @@ func Test_checkRetoreDatabase_Mismatch_In_Restore(t *testing.T) {
 
 	assert.Error(t, checkRetoreDatabase(backupResult, collectionNames))
 }
+
+func Test_checkIfAnyFailure_No_Summary(t *testing.T) {
+	assert.NoError(t, CheckIfAnyFailure("2022-09-15T19:18:00.068+0000	preparing collections to restore from"))
+}
+
+func Test_compareCounts(t *testing.T) {
+	assert.Empty(t, compareCounts(db.CollectionValidation{Dumped: 3, Archived: 3, Restored: 3}))
+	// the dump log doesn't always report the counts
+	assert.Empty(t, compareCounts(db.CollectionValidation{Dumped: -1, Archived: 3, Restored: 3}))
+	assert.Len(t, compareCounts(db.CollectionValidation{Dumped: 4, Archived: 3, Restored: 3}), 1)
+	assert.Len(t, compareCounts(db.CollectionValidation{Dumped: 3, Archived: 3, Restored: 2}), 1)
+}
+
+func Test_compareIndexes(t *testing.T) {
+	expected := []bson.M{
+		{"v": int32(2), "name": "_id_", "key": bson.M{"_id": int32(1)}},
+		{"v": int32(2), "name": "email_1", "key": bson.M{"email": float64(1)}, "unique": true},
+		{"v": int32(2), "name": "ts_1", "key": bson.M{"ts": int32(1)}, "expireAfterSeconds": int32(3600)},
+	}
+	restored := []bson.M{
+		{"v": int32(2), "name": "_id_", "key": bson.M{"_id": int32(1)}},
+		{"v": int32(2), "name": "email_1", "key": bson.M{"email": int32(1)}, "unique": true},
+		{"v": int32(2), "name": "ts_1", "key": bson.M{"ts": int32(1)}, "expireAfterSeconds": int64(3600)},
+	}
+	assert.Empty(t, compareIndexes(expected, restored))
+
+	restored[1] = bson.M{"v": int32(2), "name": "email_1", "key": bson.M{"email": int32(1)}}
+	errs := compareIndexes(expected, restored[:2])
+	assert.Len(t, errs, 2)
+	assert.Contains(t, errs[0], "email_1 differs")
+	assert.Contains(t, errs[1], "ts_1 is missing")
+}
+
+func Test_validatedCollections(t *testing.T) {
+	contents := &archive.Contents{Collections: []archive.Collection{
+		{Database: "test", Collection: "users"},
+		{Database: "test", Collection: "active_users", Type: "view"},
+		{Database: "test", Collection: "system.views"},
+		{Database: "", Collection: "oplog"},
+		{Database: "other", Collection: "orders"},
+	}}
+
+	collections := validatedCollections(contents)
+	assert.Equal(t, map[string][]string{"test": {"users"}, "other": {"orders"}}, collectionsByDatabase(collections))
+}
+
+func Test_restoredNamespaces(t *testing.T) {
+	plan := config.Plan{Target: config.Target{Database: "test"}, Validation: &config.Validation{Database: config.Target{Database: "test_restore"}}}
+	assert.Equal(t, []string{"test.users", "test.orders"}, restoredNamespaces(plan, []string{"users", "orders"}))
+	assert.Equal(t, "test_restore", restoredDatabase(plan, "test"))
+
+	plan.Validation.Database.Database = "test"
+	assert.Equal(t, "test", restoredDatabase(plan, "test"))
+}
+
+func Test_checkValidation(t *testing.T) {
+	assert.NoError(t, checkValidation(config.Validation{}))
+	assert.NoError(t, checkValidation(config.Validation{Checksum: "dbHash"}))
+	assert.NoError(t, checkValidation(config.Validation{Checksum: "sample", SampleSize: 10}))
+	assert.Error(t, checkValidation(config.Validation{Checksum: "md5"}))
+
+	assert.NoError(t, checkValidation(config.Validation{Targets: []config.ValidationTarget{
+		{Label: "7.0", Ephemeral: &config.Ephemeral{Binary: "/opt/mongodb-7.0/bin/mongod"}},
+		{Label: "8.0", Database: config.Target{Uri: "mongodb://mongo8:27017"}},
+	}}))
+	assert.Error(t, checkValidation(config.Validation{Targets: []config.ValidationTarget{{Database: config.Target{Host: "mongo8"}}}}))
+	assert.Error(t, checkValidation(config.Validation{Targets: []config.ValidationTarget{{Label: "8.0"}}}))
+}
+
+func Test_restoreWarnings(t *testing.T) {
+	output := `2024-05-12T03:00:00.068+0000	preparing collections to restore from
+	2024-05-12T03:00:00.078+0000	reading metadata for test_restore.users from archive '/tmp/test-1.gz'
+	2024-05-12T03:00:00.096+0000	finished restoring test_restore.users (1520 documents, 0 failures)
+	2024-05-12T03:00:00.097+0000	restoring indexes for collection test_restore.users from metadata
+	2024-05-12T03:00:00.098+0000	index: test_restore.users.geo_1 - error creating index: "2d" index version 1 is not supported
+	2024-05-12T03:00:00.099+0000	finished restoring test_restore.orders (10 documents, 2 failures)
+	2024-05-12T03:00:00.100+0000	1530 document(s) restored successfully. 2 document(s) failed to restore.
+	`
+	assert.Equal(t, []string{
+		`index: test_restore.users.geo_1 - error creating index: "2d" index version 1 is not supported`,
+		"finished restoring test_restore.orders (10 documents, 2 failures)",
+	}, restoreWarnings(output))
+	assert.Empty(t, restoreWarnings("2024-05-12T03:00:00.068+0000	preparing collections to restore from"))
+}
+
+func Test_validationFailures(t *testing.T) {
+	report := &db.Validation{Collections: []db.CollectionValidation{
+		{Collection: "users"},
+		{Collection: "orders", Errors: []string{"index total_1 is missing"}},
+	}}
+	assert.Equal(t, []string{"orders: index total_1 is missing"}, validationFailures(report))
+}
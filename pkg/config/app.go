@@ -1,15 +1,18 @@
 package config
 
 type AppConfig struct {
-	LogLevel    string `json:"log_level"`
-	JSONLog     bool   `json:"json_log"`
-	Host        string `json:"host"`
-	Port        int    `json:"port"`
-	ConfigPath  string `json:"config_path"`
-	StoragePath string `json:"storage_path"`
-	TmpPath     string `json:"tmp_path"`
-	DataPath    string `json:"data_path"`
-	Version     string `json:"version"`
-	UseAwsCli   bool   `json:"use_aws_cli"`
-	HasGpg      bool   `json:"has_gpg"`
+	LogLevel            string `json:"log_level"`
+	JSONLog             bool   `json:"json_log"`
+	Host                string `json:"host"`
+	Port                int    `json:"port"`
+	ConfigPath          string `json:"config_path"`
+	StoragePath         string `json:"storage_path"`
+	TmpPath             string `json:"tmp_path"`
+	DataPath            string `json:"data_path"`
+	Version             string `json:"version"`
+	UseAwsCli           bool   `json:"use_aws_cli"`
+	HasGpg              bool   `json:"has_gpg"`
+	AgeIdentityFile     string `json:"age_identity_file"`
+	RestoreConfirmation bool   `json:"restore_confirmation"`
+	AuthConfig          string `json:"auth_config"`
 }
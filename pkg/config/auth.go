@@ -0,0 +1,289 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+// Roles of the API callers, each one includes the rights of the previous ones
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleLevels = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// DefaultAllow are the paths served without authentication when the auth file has no allow list
+var DefaultAllow = []string{"/health", "/metrics"}
+
+// Auth configures the authentication of the HTTP API, every request outside of Allow needs
+// a bearer token, a basic auth user or a verified client certificate
+type Auth struct {
+	Tokens []Token  `yaml:"tokens"`
+	Users  []User   `yaml:"users"`
+	TLS    *TLS     `yaml:"tls"`
+	Allow  []string `yaml:"allow"`
+}
+
+// Token is a static bearer token, the content of TokenFile takes precedence over the inline value
+type Token struct {
+	Name      string  `yaml:"name"`
+	Token     string  `yaml:"token"`
+	TokenFile string  `yaml:"tokenFile"`
+	Roles     []Grant `yaml:"roles"`
+}
+
+// User is a basic auth user, PasswordHash is a bcrypt hash such as the ones of htpasswd -B
+type User struct {
+	Username     string  `yaml:"username"`
+	PasswordHash string  `yaml:"passwordHash"`
+	Roles        []Grant `yaml:"roles"`
+}
+
+// TLS serves the API over HTTPS, with ClientCAFile the client certificates signed by these CAs
+// authenticate the requests by their common name
+type TLS struct {
+	CertFile          string   `yaml:"certFile"`
+	KeyFile           string   `yaml:"keyFile"`
+	ClientCAFile      string   `yaml:"clientCAFile"`
+	RequireClientCert bool     `yaml:"requireClientCert"`
+	Clients           []Client `yaml:"clients"`
+}
+
+// Client is a client certificate accepted by its common name, any certificate signed by
+// the client CA is accepted when no client is listed
+type Client struct {
+	Name  string  `yaml:"name"`
+	Roles []Grant `yaml:"roles"`
+}
+
+// Grant gives a role on every plan, or when scoped only on the plans listed and on the plans
+// carrying all the labels
+type Grant struct {
+	Role   string            `yaml:"role"`
+	Plans  []string          `yaml:"plans"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+// AdminRoles are the roles of the callers defined without roles
+var AdminRoles = []Grant{{Role: RoleAdmin}}
+
+// Has tells if the grant role includes role
+func (g Grant) Has(role string) bool {
+	return roleLevels[g.Role] >= roleLevels[role] && roleLevels[role] > 0
+}
+
+// Scoped tells if the grant is restricted to some plans
+func (g Grant) Scoped() bool {
+	return len(g.Plans) > 0 || len(g.Labels) > 0
+}
+
+// Allows tells if the grant gives role on a plan, an empty plan stands for every plan.
+// The plan labels are only read for the grants scoped by labels.
+func (g Grant) Allows(role string, plan string, labels func() map[string]string) bool {
+	if !g.Has(role) {
+		return false
+	}
+	if !g.Scoped() {
+		return true
+	}
+	if plan == "" {
+		return false
+	}
+	for _, p := range g.Plans {
+		if p == plan {
+			return true
+		}
+	}
+	if len(g.Labels) == 0 {
+		return false
+	}
+	planLabels := labels()
+	for key, value := range g.Labels {
+		// viper lower cases the keys of the plans
+		if planLabels[strings.ToLower(key)] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadAuth reads the auth file and the token files it references
+func LoadAuth(file string) (*Auth, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "Reading %v failed", file)
+	}
+
+	auth := &Auth{}
+	if err := v.Unmarshal(auth); err != nil {
+		return nil, errors.Wrapf(err, "Parsing %v failed", file)
+	}
+	if auth.Allow == nil {
+		auth.Allow = DefaultAllow
+	}
+
+	for i := range auth.Tokens {
+		if err := readSecret(&auth.Tokens[i].Token, auth.Tokens[i].TokenFile); err != nil {
+			return nil, errors.Wrapf(err, "token %v", auth.Tokens[i].Name)
+		}
+		redact.Add(auth.Tokens[i].Token)
+		if len(auth.Tokens[i].Roles) == 0 {
+			auth.Tokens[i].Roles = AdminRoles
+		}
+	}
+	for i := range auth.Users {
+		if len(auth.Users[i].Roles) == 0 {
+			auth.Users[i].Roles = AdminRoles
+		}
+	}
+	if auth.TLS != nil {
+		for i := range auth.TLS.Clients {
+			if len(auth.TLS.Clients[i].Roles) == 0 {
+				auth.TLS.Clients[i].Roles = AdminRoles
+			}
+		}
+	}
+
+	if err := auth.check(); err != nil {
+		return nil, errors.Wrapf(err, "Validating %v failed", file)
+	}
+	return auth, nil
+}
+
+func (a *Auth) check() error {
+	names := make(map[string]bool)
+	unique := func(kind string, name string) error {
+		if name == "" {
+			return errors.Errorf("a %v has no name", kind)
+		}
+		if names[name] {
+			return errors.Errorf("%v %v: the name is already used", kind, name)
+		}
+		names[name] = true
+		return nil
+	}
+
+	for _, token := range a.Tokens {
+		if err := unique("token", token.Name); err != nil {
+			return err
+		}
+		if len(token.Token) < 16 {
+			return errors.Errorf("token %v is shorter than 16 characters", token.Name)
+		}
+		if err := checkRoles(token.Roles); err != nil {
+			return errors.Wrapf(err, "token %v", token.Name)
+		}
+	}
+	for _, user := range a.Users {
+		if err := unique("user", user.Username); err != nil {
+			return err
+		}
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return errors.Wrapf(err, "user %v has no valid bcrypt password hash", user.Username)
+		}
+		if err := checkRoles(user.Roles); err != nil {
+			return errors.Wrapf(err, "user %v", user.Username)
+		}
+	}
+
+	if a.TLS != nil {
+		if a.TLS.CertFile == "" || a.TLS.KeyFile == "" {
+			return errors.New("tls needs a certFile and a keyFile")
+		}
+		if a.TLS.ClientCAFile == "" && (a.TLS.RequireClientCert || len(a.TLS.Clients) > 0) {
+			return errors.New("tls client certificates need a clientCAFile")
+		}
+		for _, client := range a.TLS.Clients {
+			if err := unique("client", client.Name); err != nil {
+				return err
+			}
+			if err := checkRoles(client.Roles); err != nil {
+				return errors.Wrapf(err, "client %v", client.Name)
+			}
+		}
+	}
+
+	if len(a.Tokens) == 0 && len(a.Users) == 0 && (a.TLS == nil || a.TLS.ClientCAFile == "") {
+		return errors.New("no tokens, users or client CA are defined")
+	}
+
+	for _, p := range a.Allow {
+		if !strings.HasPrefix(p, "/") {
+			return errors.Errorf("allowed path %v is not absolute", p)
+		}
+	}
+	return nil
+}
+
+func checkRoles(roles []Grant) error {
+	for _, grant := range roles {
+		if _, ok := roleLevels[grant.Role]; !ok {
+			return errors.Errorf("unknown role %v, use viewer, operator or admin", grant.Role)
+		}
+		for key := range grant.Labels {
+			if key == "" {
+				return errors.Errorf("role %v has an empty label", grant.Role)
+			}
+		}
+	}
+	return nil
+}
+
+// Allowed tells if a request path is served without authentication, an allowed path
+// covers the paths below it
+func (a *Auth) Allowed(p string) bool {
+	p = path.Clean(p)
+	for _, allowed := range a.Allow {
+		allowed = strings.TrimSuffix(allowed, "/")
+		if p == allowed || strings.HasPrefix(p, allowed+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerTLS builds the TLS configuration of the HTTP server, nil when TLS is not enabled
+func (a *Auth) ServerTLS() (*tls.Config, error) {
+	if a == nil || a.TLS == nil {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(a.TLS.CertFile, a.TLS.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading the tls certificate failed")
+	}
+	conf := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if a.TLS.ClientCAFile == "" {
+		return conf, nil
+	}
+
+	pem, err := os.ReadFile(a.TLS.ClientCAFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading client CA file %v failed", a.TLS.ClientCAFile)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificate found in client CA file %v", a.TLS.ClientCAFile)
+	}
+	conf.ClientCAs = pool
+	conf.ClientAuth = tls.VerifyClientCertIfGiven
+	if a.TLS.RequireClientCert {
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
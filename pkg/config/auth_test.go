@@ -0,0 +1,140 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadAuth(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("0123456789abcdef0123\n"), 0600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	file := filepath.Join(dir, "auth.yml")
+	content := "tokens:\n" +
+		"  - name: ci\n" +
+		"    tokenFile: " + tokenFile + "\n" +
+		"users:\n" +
+		"  - username: ops\n" +
+		"    passwordHash: \"" + string(hash) + "\"\n" +
+		"    roles:\n" +
+		"      - role: operator\n" +
+		"        labels:\n" +
+		"          env: staging\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+
+	auth, err := LoadAuth(file)
+	if err != nil {
+		t.Fatalf("LoadAuth returned error: %v", err)
+	}
+	if len(auth.Tokens) != 1 || auth.Tokens[0].Token != "0123456789abcdef0123" {
+		t.Errorf("LoadAuth returned wrong tokens: got %+v", auth.Tokens)
+	}
+	if len(auth.Users) != 1 || auth.Users[0].Username != "ops" {
+		t.Fatalf("LoadAuth returned wrong users: got %+v", auth.Users)
+	}
+	if len(auth.Tokens[0].Roles) != 1 || auth.Tokens[0].Roles[0].Role != RoleAdmin {
+		t.Errorf("LoadAuth returned wrong default roles: got %+v", auth.Tokens[0].Roles)
+	}
+	roles := auth.Users[0].Roles
+	if len(roles) != 1 || roles[0].Role != RoleOperator || roles[0].Labels["env"] != "staging" {
+		t.Errorf("LoadAuth returned wrong user roles: got %+v", roles)
+	}
+	if strings.Join(auth.Allow, ",") != "/health,/metrics" {
+		t.Errorf("LoadAuth returned wrong allow list: got %v", auth.Allow)
+	}
+}
+
+func TestAuthCheck(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	token := Token{Name: "ci", Token: "0123456789abcdef"}
+
+	tests := []struct {
+		name string
+		auth Auth
+		ok   bool
+	}{
+		{"token", Auth{Tokens: []Token{token}}, true},
+		{"user", Auth{Users: []User{{Username: "ops", PasswordHash: string(hash)}}}, true},
+		{"client CA", Auth{TLS: &TLS{CertFile: "cert", KeyFile: "key", ClientCAFile: "ca"}}, true},
+		{"empty", Auth{}, false},
+		{"tls only", Auth{TLS: &TLS{CertFile: "cert", KeyFile: "key"}}, false},
+		{"short token", Auth{Tokens: []Token{{Name: "ci", Token: "short"}}}, false},
+		{"plain password", Auth{Users: []User{{Username: "ops", PasswordHash: "secret"}}}, false},
+		{"duplicate name", Auth{Tokens: []Token{token}, Users: []User{{Username: "ci", PasswordHash: string(hash)}}}, false},
+		{"clients without CA", Auth{Tokens: []Token{token}, TLS: &TLS{CertFile: "cert", KeyFile: "key", Clients: []Client{{Name: "bot"}}}}, false},
+		{"relative allow", Auth{Tokens: []Token{token}, Allow: []string{"metrics"}}, false},
+		{"role", Auth{Tokens: []Token{{Name: "ci", Token: token.Token, Roles: []Grant{{Role: RoleViewer}}}}}, true},
+		{"unknown role", Auth{Tokens: []Token{{Name: "ci", Token: token.Token, Roles: []Grant{{Role: "root"}}}}}, false},
+	}
+	for _, test := range tests {
+		err := test.auth.check()
+		if test.ok && err != nil {
+			t.Errorf("check %v returned error: %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("check %v should return an error", test.name)
+		}
+	}
+}
+
+func TestAuthAllowed(t *testing.T) {
+	auth := Auth{Allow: DefaultAllow}
+
+	tests := map[string]bool{
+		"/health":            true,
+		"/metrics":           true,
+		"/metrics/":          true,
+		"/metricsx":          false,
+		"/metrics/../debug":  false,
+		"/storage/plan/file": false,
+		"/":                  false,
+	}
+	for p, expected := range tests {
+		if allowed := auth.Allowed(p); allowed != expected {
+			t.Errorf("Allowed(%q) returned %v, expected %v", p, allowed, expected)
+		}
+	}
+}
+
+func TestGrantAllows(t *testing.T) {
+	labels := func() map[string]string { return map[string]string{"env": "staging"} }
+
+	tests := []struct {
+		name    string
+		grant   Grant
+		role    string
+		plan    string
+		allowed bool
+	}{
+		{"admin on a plan", Grant{Role: RoleAdmin}, RoleOperator, "orders", true},
+		{"admin on every plan", Grant{Role: RoleAdmin}, RoleAdmin, "", true},
+		{"viewer backup", Grant{Role: RoleViewer}, RoleOperator, "orders", false},
+		{"listed plan", Grant{Role: RoleOperator, Plans: []string{"orders"}}, RoleOperator, "orders", true},
+		{"other plan", Grant{Role: RoleOperator, Plans: []string{"orders"}}, RoleOperator, "users", false},
+		{"scoped on every plan", Grant{Role: RoleAdmin, Plans: []string{"orders"}}, RoleViewer, "", false},
+		{"matching labels", Grant{Role: RoleViewer, Labels: map[string]string{"Env": "staging"}}, RoleViewer, "users", true},
+		{"other labels", Grant{Role: RoleViewer, Labels: map[string]string{"env": "prod"}}, RoleViewer, "users", false},
+		{"unknown role", Grant{Role: RoleAdmin}, "root", "orders", false},
+	}
+	for _, test := range tests {
+		if allowed := test.grant.Allows(test.role, test.plan, labels); allowed != test.allowed {
+			t.Errorf("Allows %v returned %v, expected %v", test.name, allowed, test.allowed)
+		}
+	}
+}
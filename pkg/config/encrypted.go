@@ -0,0 +1,122 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+)
+
+// ENC[age:<base64 ciphertext>] values allowed in any string field
+var encryptedRegex = regexp.MustCompile(`ENC\[age:([A-Za-z0-9+/=]+)\]`)
+
+var (
+	ageMu         sync.RWMutex
+	ageIdentities []age.Identity
+)
+
+// LoadAgeIdentities sets the identities used to decrypt the ENC[age:...] values,
+// from an age identity file and/or an AGE-SECRET-KEY-... string
+func LoadAgeIdentities(file string, key string) error {
+	identities := make([]age.Identity, 0)
+
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return errors.Wrapf(err, "Opening age identity file %v failed", file)
+		}
+		defer f.Close()
+
+		ids, err := age.ParseIdentities(f)
+		if err != nil {
+			return errors.Wrapf(err, "Parsing age identity file %v failed", file)
+		}
+		identities = append(identities, ids...)
+	}
+
+	if key != "" {
+		ids, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return errors.Wrap(err, "Parsing age identity failed")
+		}
+		identities = append(identities, ids...)
+	}
+
+	ageMu.Lock()
+	ageIdentities = identities
+	ageMu.Unlock()
+
+	return nil
+}
+
+// EncryptValue encrypts a plan value for an age recipient
+func EncryptValue(value string, recipient string) (string, error) {
+	r, err := age.ParseX25519Recipient(recipient)
+	if err != nil {
+		return "", errors.Wrapf(err, "Parsing age recipient %v failed", recipient)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		return "", errors.Wrap(err, "Encrypting value failed")
+	}
+	if _, err := io.WriteString(w, value); err != nil {
+		return "", errors.Wrap(err, "Encrypting value failed")
+	}
+	if err := w.Close(); err != nil {
+		return "", errors.Wrap(err, "Encrypting value failed")
+	}
+
+	return "ENC[age:" + base64.StdEncoding.EncodeToString(buf.Bytes()) + "]", nil
+}
+
+// decryptValues replaces the ENC[age:...] values found in the string fields of the plan
+func decryptValues(plan *Plan) error {
+	return walkStrings(reflect.ValueOf(plan).Elem(), decryptValue)
+}
+
+func decryptValue(value string) (string, error) {
+	if !strings.Contains(value, "ENC[age:") {
+		return value, nil
+	}
+
+	ageMu.RLock()
+	identities := ageIdentities
+	ageMu.RUnlock()
+
+	if len(identities) == 0 {
+		return "", errors.New("encrypted value found but no age identity is configured")
+	}
+
+	var err error
+	decrypted := encryptedRegex.ReplaceAllStringFunc(value, func(enc string) string {
+		if err != nil {
+			return enc
+		}
+		ciphertext, decodeErr := base64.StdEncoding.DecodeString(encryptedRegex.FindStringSubmatch(enc)[1])
+		if decodeErr != nil {
+			err = errors.Wrap(decodeErr, "decoding encrypted value failed")
+			return enc
+		}
+		r, decryptErr := age.Decrypt(bytes.NewReader(ciphertext), identities...)
+		if decryptErr != nil {
+			err = errors.Wrap(decryptErr, "decrypting value failed")
+			return enc
+		}
+		plaintext, readErr := io.ReadAll(r)
+		if readErr != nil {
+			err = errors.Wrap(readErr, "decrypting value failed")
+			return enc
+		}
+		return string(plaintext)
+	})
+	return decrypted, err
+}
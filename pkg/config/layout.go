@@ -0,0 +1,70 @@
+package config
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LayoutData is what the archive layout renders from
+type LayoutData struct {
+	Plan string
+	Time time.Time
+	Ext  string
+}
+
+// layoutCheckTime is where the layout is checked, no field but the seconds changes one second later
+var layoutCheckTime = time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+
+// RenderLayout renders the archive layout of a plan, the key is relative to the destination root
+func RenderLayout(plan Plan, data LayoutData) (string, error) {
+	tmpl, err := template.New("layout").Option("missingkey=error").Parse(plan.Archive.Layout)
+	if err != nil {
+		return "", errors.Wrapf(err, "parsing archive layout of plan %v failed", plan.Name)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", errors.Wrapf(err, "rendering archive layout of plan %v failed", plan.Name)
+	}
+
+	key := path.Clean(strings.TrimSpace(buf.String()))
+	if key == "." || strings.HasSuffix(buf.String(), "/") {
+		return "", errors.Errorf("archive layout of plan %v renders no file name", plan.Name)
+	}
+	if path.IsAbs(key) || key == ".." || strings.HasPrefix(key, "../") {
+		return "", errors.Errorf("archive layout of plan %v renders %v outside of the destination", plan.Name, key)
+	}
+
+	return key, nil
+}
+
+// validateLayout renders the layout for two backups a second apart. The manifest and the restores
+// find the archives by file name, two backups can't share one.
+func validateLayout(plan Plan) error {
+	if plan.Archive == nil || plan.Archive.Layout == "" {
+		return nil
+	}
+
+	data := LayoutData{Plan: plan.Name, Time: layoutCheckTime, Ext: ".gz"}
+	key, err := RenderLayout(plan, data)
+	if err != nil {
+		return err
+	}
+
+	data.Time = layoutCheckTime.Add(time.Second)
+	next, err := RenderLayout(plan, data)
+	if err != nil {
+		return err
+	}
+	if path.Base(next) == path.Base(key) {
+		return errors.Errorf("archive layout of plan %v renders the file name %v for every backup, "+
+			"the file name needs the timestamp such as {{.Plan}}-{{.Time.Unix}}{{.Ext}}", plan.Name, path.Base(key))
+	}
+
+	return nil
+}
@@ -12,24 +12,64 @@ import (
 )
 
 type Plan struct {
-	Name       string      `yaml:"name"`
-	Target     Target      `yaml:"target"`
-	Scheduler  Scheduler   `yaml:"scheduler"`
-	Retry      Retry       `yaml:"retry"`
-	Validation *Validation `yaml:"validation"`
-	Encryption *Encryption `yaml:"encryption"`
-	S3         *S3         `yaml:"s3"`
-	GCloud     *GCloud     `yaml:"gcloud"`
-	Rclone     *Rclone     `yaml:"rclone"`
-	Azure      *Azure      `yaml:"azure"`
-	SFTP       *SFTP       `yaml:"sftp"`
-	SMTP       *SMTP       `yaml:"smtp"`
-	Slack      *Slack      `yaml:"slack"`
-	Team       *Team       `yaml:"team"`
+	Name       string            `yaml:"name"`
+	Labels     map[string]string `yaml:"labels"`
+	Target     Target            `yaml:"target"`
+	Scheduler  Scheduler         `yaml:"scheduler"`
+	Retry      Retry             `yaml:"retry"`
+	Archive    *Archive          `yaml:"archive"`
+	Validation *Validation       `yaml:"validation"`
+	Restore    *Restore          `yaml:"restore"`
+	Refresh    *Refresh          `yaml:"refresh"`
+	Drill      *Drill            `yaml:"drill"`
+	Encryption *Encryption       `yaml:"encryption"`
+	S3         *S3               `yaml:"s3"`
+	GCloud     *GCloud           `yaml:"gcloud"`
+	Rclone     *Rclone           `yaml:"rclone"`
+	Azure      *Azure            `yaml:"azure"`
+	SFTP       *SFTP             `yaml:"sftp"`
+	SMTP       *SMTP             `yaml:"smtp"`
+	Slack      *Slack            `yaml:"slack"`
+	Team       *Team             `yaml:"team"`
+
+	// references is the plan as loaded with its ${file:} references unread, set when it has some
+	references *Plan
 }
 
+// Validation restores every dump into Database and compares it with the archive,
+// Checksum adds a content check against the target: dbHash or sample
 type Validation struct {
-	Database Target `yaml:"database"`
+	Database   Target             `yaml:"database"`
+	Ephemeral  *Ephemeral         `yaml:"ephemeral"`
+	Checksum   string             `yaml:"checksum"`
+	SampleSize int                `yaml:"sampleSize"`
+	Targets    []ValidationTarget `yaml:"targets"`
+}
+
+// ValidationTarget is another server the archive is restored into after the validation database,
+// such as a newer MongoDB version, its failures are reported without failing the backup
+type ValidationTarget struct {
+	Label     string     `yaml:"label"`
+	Database  Target     `yaml:"database"`
+	Ephemeral *Ephemeral `yaml:"ephemeral"`
+}
+
+// Drill restores an archive of the plan into the validation database on a schedule,
+// Pick chooses the latest, a random or the oldest archive found on Destination
+type Drill struct {
+	Cron           string `yaml:"cron"`
+	Destination    string `yaml:"destination"`
+	Pick           string `yaml:"pick"`
+	KeyFile        string `yaml:"keyFile"`
+	PassphraseFile string `yaml:"passphraseFile"`
+}
+
+// Ephemeral validates in a mongod started for each backup, with a temporary dbpath,
+// in place of the Database server. StartTimeout is in seconds.
+type Ephemeral struct {
+	Binary       string `yaml:"binary"`
+	Params       string `yaml:"params"`
+	StartTimeout int    `yaml:"startTimeout"`
 }
 
 type Target struct {
@@ -41,6 +81,9 @@ type Target struct {
 	Username string `yaml:"username"`
 	NoGzip   bool   `yaml:"noGzip"`
 	Params   string `yaml:"params"`
+	// secret files, read at run time and taking precedence over the inline values
+	UriFile      string `yaml:"uriFile"`
+	PasswordFile string `yaml:"passwordFile"`
 }
 
 type Scheduler struct {
@@ -54,6 +97,60 @@ type Retry struct {
 	BackoffFactor float32 `yaml:"backoffFactor"`
 }
 
+type Archive struct {
+	// Layout is a text/template rendering the archive path relative to the destination root,
+	// with .Plan, .Time and .Ext, e.g. {{.Plan}}/{{.Time.Format "2006/01/02"}}/{{.Plan}}-{{.Time.Unix}}{{.Ext}}
+	Layout string `yaml:"layout"`
+}
+
+type Restore struct {
+	Profiles []RestoreProfile `yaml:"profiles"`
+}
+
+// RestoreProfile masks the restored data, Salt keys the hash and fake values
+// so they can't be matched against the hash of a guessed value
+type RestoreProfile struct {
+	Name    string     `yaml:"name"`
+	Salt    string     `yaml:"salt"`
+	Masking []MaskRule `yaml:"masking"`
+}
+
+// MaskRule masks a collection field, like users.email or users.address.city.
+// Rule is hash, null or fake, Generator picks the fake values: name, email, phone or text
+type MaskRule struct {
+	Field     string `yaml:"field"`
+	Rule      string `yaml:"rule"`
+	Generator string `yaml:"generator"`
+}
+
+// Refresh turns a plan into a refresh job: the latest backup of the Source plan is restored into the plan target,
+// then the hooks run in order
+type Refresh struct {
+	Source         string      `yaml:"source"`
+	Destination    string      `yaml:"destination"`
+	Namespaces     []string    `yaml:"namespaces"`
+	NsMap          []NsMapping `yaml:"nsMap"`
+	Drop           bool        `yaml:"drop"`
+	Snapshot       bool        `yaml:"snapshot"`
+	Profile        string      `yaml:"profile"`
+	KeyFile        string      `yaml:"keyFile"`
+	PassphraseFile string      `yaml:"passphraseFile"`
+	Hooks          []Hook      `yaml:"hooks"`
+}
+
+// NsMapping is named after the mongorestore flags, viper decodes it by its mapstructure tags
+type NsMapping struct {
+	From string `yaml:"nsFrom" mapstructure:"nsFrom"`
+	To   string `yaml:"nsTo" mapstructure:"nsTo"`
+}
+
+// Hook is a command run without a shell, Timeout is in minutes
+type Hook struct {
+	Name    string `yaml:"name"`
+	Command string `yaml:"command"`
+	Timeout int    `yaml:"timeout"`
+}
+
 type Encryption struct {
 	Gpg *Gpg `yaml:"gpg"`
 }
@@ -73,6 +170,8 @@ type S3 struct {
 	KmsKeyId             string `yaml:"kmsKeyId"`
 	StorageClass         string `yaml:"storageClass" validate:"omitempty,oneof=STANDARD REDUCED_REDUNDANCY STANDARD_IA ONE-ZONE_IA INTELLIGENT_TIERING GLACIER DEEP_ARCHIVE"`
 	CreateBucketIfNeeded bool   `yaml:"createbucketifneeded"`
+	AccessKeyFile        string `yaml:"accessKeyFile"`
+	SecretKeyFile        string `yaml:"secretKeyFile"`
 }
 
 type GCloud struct {
@@ -87,8 +186,9 @@ type Rclone struct {
 }
 
 type Azure struct {
-	ContainerName    string `yaml:"containerName"`
-	ConnectionString string `yaml:"connectionString"`
+	ContainerName        string `yaml:"containerName"`
+	ConnectionString     string `yaml:"connectionString"`
+	ConnectionStringFile string `yaml:"connectionStringFile"`
 }
 
 type SFTP struct {
@@ -99,6 +199,9 @@ type SFTP struct {
 	Passphrase string `yaml:"passphrase"`
 	Port       int    `yaml:"port"`
 	Username   string `yaml:"username"`
+	// secret files, read at run time and taking precedence over the inline values
+	PasswordFile   string `yaml:"passwordFile"`
+	PassphraseFile string `yaml:"passphraseFile"`
 }
 
 type SMTP struct {
@@ -111,40 +214,63 @@ type SMTP struct {
 	Username           string   `yaml:"username"`
 	From               string   `yaml:"from"`
 	To                 []string `yaml:"to"`
+	PasswordFile       string   `yaml:"passwordFile"`
 }
 type Team struct {
-	WebhookURL string `yaml:"webhookUrl"`
-	WarnOnly   bool   `yaml:"warnOnly"`
-	ThemeColor string `yaml:"themeColor"`
+	WebhookURL     string `yaml:"webhookUrl"`
+	WarnOnly       bool   `yaml:"warnOnly"`
+	ThemeColor     string `yaml:"themeColor"`
+	WebhookURLFile string `yaml:"webhookUrlFile"`
 }
 type Slack struct {
 	URL      string `yaml:"url"`
 	Channel  string `yaml:"channel"`
 	Username string `yaml:"username"`
 	WarnOnly bool   `yaml:"warnOnly"`
+	URLFile  string `yaml:"urlFile"`
 }
 
+// LoadPlan reads a plan from the config dir. Each load has its own viper instance, the handlers
+// and the schedulers load plans concurrently.
 func LoadPlan(dir string, name string) (Plan, error) {
 	plan := Plan{}
+	v := viper.New()
 
 	// Set the paths to look for the config file in.
-	viper.AddConfigPath(dir)
+	v.AddConfigPath(dir)
 
 	// Set the name of the config file (without extension).
-	viper.SetConfigName(name)
-	setupViperEnv(name)
+	v.SetConfigName(name)
+	setupViperEnv(v, name)
 	// Try to read the config file.
-	if err := viper.ReadInConfig(); err != nil {
+	if err := v.ReadInConfig(); err != nil {
 		return plan, errors.Wrapf(err, "Reading %v failed", name)
 	}
 
 	// Unmarshal the read YAML into our struct.
-	if err := viper.Unmarshal(&plan); err != nil {
+	if err := v.Unmarshal(&plan); err != nil {
 		return plan, errors.Wrapf(err, "Parsing %v failed", name)
 	}
 
 	plan.Name = name
 
+	if err := validateLayout(plan); err != nil {
+		return plan, errors.Wrapf(err, "Validating %v failed", name)
+	}
+
+	if err := interpolate(&plan); err != nil {
+		return plan, errors.Wrapf(err, "Interpolating %v failed", name)
+	}
+
+	if err := decryptValues(&plan); err != nil {
+		return plan, errors.Wrapf(err, "Decrypting %v failed", name)
+	}
+
+	plan, err := ResolveSecrets(plan)
+	if err != nil {
+		return plan, errors.Wrapf(err, "Resolving secrets of %v failed", name)
+	}
+
 	return plan, nil
 }
 
@@ -169,31 +295,50 @@ func LoadPlans(dir string) ([]Plan, error) {
 		names[name] = true
 
 		// Set viper to read YAML configurations.
-		viper.Reset()
-		viper.SetConfigFile(path)
-		setupViperEnv(name)
+		v := viper.New()
+		v.SetConfigFile(path)
+		setupViperEnv(v, name)
 
 		// Try to read the config file.
-		if err := viper.ReadInConfig(); err != nil {
+		if err := v.ReadInConfig(); err != nil {
 			return nil, errors.Wrapf(err, "Reading %v failed", path)
 		}
 
 		// Unmarshal the read YAML into our struct.
-		if err := viper.Unmarshal(&plan); err != nil {
+		if err := v.Unmarshal(&plan); err != nil {
 			return nil, errors.Wrapf(err, "Parsing %v failed", path)
 		}
 
 		plan.Name = name
 
+		// dump the plan as read from disk, with the inline secrets masked and
+		// before references and encrypted values are resolved
 		if log.IsLevelEnabled(logrus.DebugLevel) {
-			planJSON, err := json.Marshal(plan)
+			planJSON, err := json.Marshal(plan.Redacted())
 			if err != nil {
-				return nil, errors.Wrapf(err, "Marshaling %v failed", plan)
+				return nil, errors.Wrapf(err, "Marshaling %v failed", plan.Name)
 			}
 
 			log.WithField("plan", plan.Name).Debugf("Loaded plan %v, plan JSON: %s", plan.Name, planJSON)
 		}
 
+		if err := validateLayout(plan); err != nil {
+			return nil, errors.Wrapf(err, "Validating %v failed", path)
+		}
+
+		if err := interpolate(&plan); err != nil {
+			return nil, errors.Wrapf(err, "Interpolating %v failed", path)
+		}
+
+		if err := decryptValues(&plan); err != nil {
+			return nil, errors.Wrapf(err, "Decrypting %v failed", path)
+		}
+
+		plan, err = ResolveSecrets(plan)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Resolving secrets of %v failed", path)
+		}
+
 		plans = append(plans, plan)
 	}
 
@@ -204,11 +349,20 @@ func LoadPlans(dir string) ([]Plan, error) {
 	return plans, nil
 }
 
-func setupViperEnv(planName string) {
-	viper.SetConfigType("yaml")
+// PlanLabels indexes the labels of the plans by plan name
+func PlanLabels(plans []Plan) map[string]map[string]string {
+	labels := make(map[string]map[string]string, len(plans))
+	for _, plan := range plans {
+		labels[plan.Name] = plan.Labels
+	}
+	return labels
+}
+
+func setupViperEnv(v *viper.Viper, planName string) {
+	v.SetConfigType("yaml")
 	// set upper case plan name as env prefix
 	envPrefix := strings.ReplaceAll(planName, "-", "_")
-	viper.SetEnvPrefix(envPrefix + "_") // will be uppercased automatically
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	viper.AutomaticEnv()
+	v.SetEnvPrefix(envPrefix + "_") // will be uppercased automatically
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
 }
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -62,3 +63,82 @@ func TestLoadPlans(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadPlan_concurrent(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"orders", "users"}
+	for _, name := range names {
+		content := fmt.Sprintf("target:\n  host: %v-host\n", name)
+		if err := os.WriteFile(filepath.Join(dir, name+".yml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write plan: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 100)
+	for i := 0; i < 100; i++ {
+		name := names[i%len(names)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			plan, err := LoadPlan(dir, name)
+			if err != nil {
+				errs <- err.Error()
+			} else if plan.Target.Host != name+"-host" {
+				errs <- fmt.Sprintf("plan %v has the target of another plan: %v", name, plan.Target.Host)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("LoadPlan returned %v", err)
+	}
+}
+
+func TestLoadPlan_refreshNsMap(t *testing.T) {
+	dir := t.TempDir()
+	content := "target:\n  host: staging\n" +
+		"refresh:\n" +
+		"  source: orders\n" +
+		"  nsMap:\n" +
+		"    - nsFrom: app.users\n" +
+		"      nsTo: app_staging.customers\n"
+	if err := os.WriteFile(filepath.Join(dir, "staging.yml"), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write plan: %v", err)
+	}
+
+	plan, err := LoadPlan(dir, "staging")
+	if err != nil {
+		t.Fatalf("LoadPlan returned error: %v", err)
+	}
+	nsMap := plan.Refresh.NsMap
+	if len(nsMap) != 1 || nsMap[0].From != "app.users" || nsMap[0].To != "app_staging.customers" {
+		t.Errorf("LoadPlan returned wrong nsMap: got %+v", nsMap)
+	}
+}
+
+func TestLoadPlan_archiveLayout(t *testing.T) {
+	dir := t.TempDir()
+	layouts := map[string]bool{
+		`"{{.Plan}}/{{.Time.Format \"2006/01/02\"}}/{{.Plan}}-{{.Time.Unix}}{{.Ext}}"`: true,
+		`"{{.Plan}}/{{.Time.Format \"20060102T150405\"}}{{.Ext}}"`:                     true,
+		`"{{.Plan}}/{{.Time.Format \"2006-01-02\"}}/backup{{.Ext}}"`:                   false,
+		`"{{.Plan}}/{{.Time.Format \"2006-01-02T15:04\"}}{{.Ext}}"`:                    false,
+		`"{{.Plan}}-{{.Time.Unix}}/backup{{.Ext}}"`:                                    false,
+	}
+	for layout, valid := range layouts {
+		content := "target:\n  host: mongo\narchive:\n  layout: " + layout + "\n"
+		if err := os.WriteFile(filepath.Join(dir, "orders.yml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write plan: %v", err)
+		}
+
+		_, err := LoadPlan(dir, "orders")
+		if valid && err != nil {
+			t.Errorf("LoadPlan returned error for layout %v: %v", layout, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("LoadPlan accepted layout %v", layout)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"regexp"
+
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+var uriPasswordRegex = regexp.MustCompile(`://[^:/@]*:([^@]+)@`)
+
+// SecretValues lists the values of every secret-bearing field of the plan
+func (p Plan) SecretValues() []string {
+	values := p.Target.SecretValues()
+	if p.Validation != nil {
+		values = append(values, p.Validation.Database.SecretValues()...)
+		for _, target := range p.Validation.Targets {
+			values = append(values, target.Database.SecretValues()...)
+		}
+	}
+	if p.Restore != nil {
+		for _, profile := range p.Restore.Profiles {
+			values = append(values, profile.Salt)
+		}
+	}
+	if p.S3 != nil {
+		values = append(values, p.S3.SecretKey)
+	}
+	if p.Azure != nil {
+		values = append(values, p.Azure.ConnectionString)
+	}
+	if p.SFTP != nil {
+		values = append(values, p.SFTP.Password, p.SFTP.Passphrase)
+	}
+	if p.SMTP != nil {
+		values = append(values, p.SMTP.Password)
+	}
+	if p.Slack != nil {
+		values = append(values, p.Slack.URL)
+	}
+	if p.Team != nil {
+		values = append(values, p.Team.WebhookURL)
+	}
+	return values
+}
+
+// SecretValues lists the password of a target, inline or in the uri
+func (target Target) SecretValues() []string {
+	values := []string{target.Password}
+	if matches := uriPasswordRegex.FindStringSubmatch(target.Uri); matches != nil {
+		values = append(values, matches[1])
+	}
+	return values
+}
+
+// Redacted returns a copy of the plan with the secret fields masked
+func (p Plan) Redacted() Plan {
+	p.Target = redactTarget(p.Target)
+	if p.Validation != nil {
+		validation := *p.Validation
+		validation.Database = redactTarget(validation.Database)
+		var targets []ValidationTarget
+		for _, target := range validation.Targets {
+			target.Database = redactTarget(target.Database)
+			targets = append(targets, target)
+		}
+		validation.Targets = targets
+		p.Validation = &validation
+	}
+	if p.Restore != nil {
+		restore := Restore{Profiles: make([]RestoreProfile, 0, len(p.Restore.Profiles))}
+		for _, profile := range p.Restore.Profiles {
+			profile.Salt = mask(profile.Salt)
+			restore.Profiles = append(restore.Profiles, profile)
+		}
+		p.Restore = &restore
+	}
+	if p.S3 != nil {
+		s3 := *p.S3
+		s3.SecretKey = mask(s3.SecretKey)
+		p.S3 = &s3
+	}
+	if p.Azure != nil {
+		azure := *p.Azure
+		azure.ConnectionString = mask(azure.ConnectionString)
+		p.Azure = &azure
+	}
+	if p.SFTP != nil {
+		sftp := *p.SFTP
+		sftp.Password = mask(sftp.Password)
+		sftp.Passphrase = mask(sftp.Passphrase)
+		p.SFTP = &sftp
+	}
+	if p.SMTP != nil {
+		smtp := *p.SMTP
+		smtp.Password = mask(smtp.Password)
+		p.SMTP = &smtp
+	}
+	if p.Slack != nil {
+		slack := *p.Slack
+		slack.URL = mask(slack.URL)
+		p.Slack = &slack
+	}
+	if p.Team != nil {
+		team := *p.Team
+		team.WebhookURL = mask(team.WebhookURL)
+		p.Team = &team
+	}
+	return p
+}
+
+func redactTarget(target Target) Target {
+	target.Password = mask(target.Password)
+	target.Uri = redact.String(target.Uri)
+	return target
+}
+
+func mask(value string) string {
+	if value == "" {
+		return value
+	}
+	return redact.Mask
+}
@@ -0,0 +1,290 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+// ${env:NAME} and ${file:/path} references allowed in any string field
+var referenceRegex = regexp.MustCompile(`\$\{(env|file):([^}]+)\}`)
+
+// ResolveSecrets reads the *File variants of the secret fields, the content of
+// a file takes precedence over the inline value. The plan is copied so the
+// files can be read again on every run without altering the loaded plan.
+// A plan with ${file:/path} references is copied from the plan as loaded and
+// its references are read again, so a rotated secret is used by the next run.
+func ResolveSecrets(plan Plan) (Plan, error) {
+	var err error
+
+	if plan.references != nil {
+		references := plan.references
+		plan = deepCopy(reflect.ValueOf(*references)).Interface().(Plan)
+		if err = walkStrings(reflect.ValueOf(&plan).Elem(), expandReferences); err != nil {
+			return plan, errors.Wrap(err, "file references")
+		}
+		if err = decryptValues(&plan); err != nil {
+			return plan, errors.Wrap(err, "file references")
+		}
+		plan.references = references
+	}
+
+	if plan.Target, err = resolveTarget(plan.Target); err != nil {
+		return plan, errors.Wrap(err, "target")
+	}
+
+	if plan.Validation != nil {
+		validation := *plan.Validation
+		if validation.Database, err = resolveTarget(validation.Database); err != nil {
+			return plan, errors.Wrap(err, "validation")
+		}
+		var targets []ValidationTarget
+		for _, target := range validation.Targets {
+			if target.Database, err = resolveTarget(target.Database); err != nil {
+				return plan, errors.Wrapf(err, "validation target %v", target.Label)
+			}
+			targets = append(targets, target)
+		}
+		validation.Targets = targets
+		plan.Validation = &validation
+	}
+
+	if plan.S3 != nil {
+		s3 := *plan.S3
+		if err = readSecret(&s3.AccessKey, s3.AccessKeyFile); err != nil {
+			return plan, errors.Wrap(err, "s3")
+		}
+		if err = readSecret(&s3.SecretKey, s3.SecretKeyFile); err != nil {
+			return plan, errors.Wrap(err, "s3")
+		}
+		plan.S3 = &s3
+	}
+
+	if plan.Azure != nil {
+		azure := *plan.Azure
+		if err = readSecret(&azure.ConnectionString, azure.ConnectionStringFile); err != nil {
+			return plan, errors.Wrap(err, "azure")
+		}
+		plan.Azure = &azure
+	}
+
+	if plan.SFTP != nil {
+		sftp := *plan.SFTP
+		if err = readSecret(&sftp.Password, sftp.PasswordFile); err != nil {
+			return plan, errors.Wrap(err, "sftp")
+		}
+		if err = readSecret(&sftp.Passphrase, sftp.PassphraseFile); err != nil {
+			return plan, errors.Wrap(err, "sftp")
+		}
+		plan.SFTP = &sftp
+	}
+
+	if plan.SMTP != nil {
+		smtp := *plan.SMTP
+		if err = readSecret(&smtp.Password, smtp.PasswordFile); err != nil {
+			return plan, errors.Wrap(err, "smtp")
+		}
+		plan.SMTP = &smtp
+	}
+
+	if plan.Slack != nil {
+		slack := *plan.Slack
+		if err = readSecret(&slack.URL, slack.URLFile); err != nil {
+			return plan, errors.Wrap(err, "slack")
+		}
+		plan.Slack = &slack
+	}
+
+	if plan.Team != nil {
+		team := *plan.Team
+		if err = readSecret(&team.WebhookURL, team.WebhookURLFile); err != nil {
+			return plan, errors.Wrap(err, "team")
+		}
+		plan.Team = &team
+	}
+
+	redact.Add(plan.SecretValues()...)
+
+	return plan, nil
+}
+
+func resolveTarget(target Target) (Target, error) {
+	if err := readSecret(&target.Uri, target.UriFile); err != nil {
+		return target, err
+	}
+	if err := readSecret(&target.Password, target.PasswordFile); err != nil {
+		return target, err
+	}
+	return target, nil
+}
+
+func readSecret(value *string, file string) error {
+	if file == "" {
+		return nil
+	}
+	content, err := readSecretFile(file)
+	if err != nil {
+		return err
+	}
+	*value = content
+	return nil
+}
+
+func readSecretFile(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "reading secret file %v failed", file)
+	}
+	// mounted secrets are often written with a trailing new line
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// interpolate replaces the ${env:NAME} and ${file:/path} references found in
+// the string fields of the plan. The plan with its ${file:} references unread
+// is kept for ResolveSecrets.
+func interpolate(plan *Plan) error {
+	if err := walkStrings(reflect.ValueOf(plan).Elem(), expandEnvReferences); err != nil {
+		return err
+	}
+
+	hasFiles := false
+	walkStrings(reflect.ValueOf(plan).Elem(), func(value string) (string, error) {
+		hasFiles = hasFiles || strings.Contains(value, "${file:")
+		return value, nil
+	})
+	plan.references = nil
+	if hasFiles {
+		references := deepCopy(reflect.ValueOf(*plan)).Interface().(Plan)
+		plan.references = &references
+	}
+
+	return walkStrings(reflect.ValueOf(plan).Elem(), expandReferences)
+}
+
+// deepCopy copies v with its own pointers, slices and maps, expanding the copy leaves v as it was
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Elem().Type())
+		c.Elem().Set(deepCopy(v.Elem()))
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(deepCopy(v.Field(i)))
+			}
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, key := range v.MapKeys() {
+			c.SetMapIndex(key, deepCopy(v.MapIndex(key)))
+		}
+		return c
+	}
+	return v
+}
+
+// walkStrings applies fn to every string reachable from v
+func walkStrings(v reflect.Value, fn func(string) (string, error)) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return walkStrings(v.Elem(), fn)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Field(i).CanSet() {
+				continue
+			}
+			if err := walkStrings(v.Field(i), fn); err != nil {
+				return errors.Wrap(err, v.Type().Field(i).Name)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := walkStrings(v.Index(i), fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		for _, key := range v.MapKeys() {
+			s, err := fn(v.MapIndex(key).String())
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(key, reflect.ValueOf(s).Convert(v.Type().Elem()))
+		}
+	case reflect.String:
+		s, err := fn(v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	}
+	return nil
+}
+
+func expandReferences(value string) (string, error) {
+	return expand(value, true)
+}
+
+// expandEnvReferences leaves the ${file:} references for ResolveSecrets
+func expandEnvReferences(value string) (string, error) {
+	return expand(value, false)
+}
+
+func expand(value string, files bool) (string, error) {
+	var err error
+	expanded := referenceRegex.ReplaceAllStringFunc(value, func(ref string) string {
+		if err != nil {
+			return ref
+		}
+		matches := referenceRegex.FindStringSubmatch(ref)
+		if matches[1] == "file" && !files {
+			return ref
+		}
+		switch matches[1] {
+		case "env":
+			env, ok := os.LookupEnv(matches[2])
+			if !ok {
+				err = errors.Errorf("environment variable %v is not set", matches[2])
+				return ref
+			}
+			return env
+		default:
+			content, fileErr := readSecretFile(matches[2])
+			if fileErr != nil {
+				err = fileErr
+				return ref
+			}
+			return content
+		}
+	})
+	return expanded, err
+}
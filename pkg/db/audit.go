@@ -0,0 +1,67 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// AuditEntry records an operation requested through the API, Requester is who prepared a confirmed restore
+type AuditEntry struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Action    string          `json:"action"`
+	Plan      string          `json:"plan,omitempty"`
+	Remote    string          `json:"remote"`
+	User      string          `json:"user,omitempty"`
+	Requester string          `json:"requester,omitempty"`
+	Token     string          `json:"token,omitempty"`
+	Status    string          `json:"status"`
+	Error     string          `json:"error,omitempty"`
+	Details   json.RawMessage `json:"details,omitempty"`
+}
+
+var auditBucket = []byte("audit_log")
+
+// AddAudit appends an entry to the audit log
+func (db *StatusStore) AddAudit(entry *AuditEntry) error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "Audit json marshal failed")
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(auditBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, buf)
+	})
+}
+
+// GetAudit loads the latest audit entries, newest first
+func (db *StatusStore) GetAudit(limit int) ([]*AuditEntry, error) {
+	entries := make([]*AuditEntry, 0)
+
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(auditBucket).Cursor()
+		for k, v := c.Last(); k != nil && (limit <= 0 || len(entries) < limit); k, v = c.Prev() {
+			var entry AuditEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return errors.Wrap(err, "Audit json unmarshal failed")
+			}
+			entries = append(entries, &entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Drill is the report of a restore drill,
+// TimeToRestore covers the download and the decryption of the archive and its restore
+type Drill struct {
+	Plan          string        `json:"plan"`
+	Timestamp     time.Time     `json:"timestamp"`
+	Destination   string        `json:"destination"`
+	Pick          string        `json:"pick"`
+	Archive       string        `json:"archive,omitempty"`
+	ArchiveTime   time.Time     `json:"archive_time,omitempty"`
+	Status        string        `json:"status"`
+	Error         string        `json:"error,omitempty"`
+	FetchDuration time.Duration `json:"fetch_duration"`
+	TimeToRestore time.Duration `json:"time_to_restore"`
+	Duration      time.Duration `json:"duration"`
+	Validation    *Validation   `json:"validation,omitempty"`
+}
+
+var drillBucket = []byte("drills")
+
+func drillKey(plan string, ts time.Time) []byte {
+	return []byte(fmt.Sprintf("%v/%020d", plan, ts.UnixNano()))
+}
+
+// AddDrill records a drill report
+func (db *StatusStore) AddDrill(drill *Drill) error {
+	buf, err := json.Marshal(drill)
+	if err != nil {
+		return errors.Wrap(err, "Drill json marshal failed")
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(drillBucket).Put(drillKey(drill.Plan, drill.Timestamp), buf)
+	})
+}
+
+// GetDrills loads the latest drill reports of a plan, newest first
+func (db *StatusStore) GetDrills(plan string, limit int) ([]*Drill, error) {
+	drills := make([]*Drill, 0)
+	// the keys of a plan sort between plan/ and plan0
+	start := []byte(plan + "/")
+	end := []byte(plan + "0")
+
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(drillBucket).Cursor()
+		k, v := c.Seek(end)
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil && string(k) >= string(start) && (limit <= 0 || len(drills) < limit); k, v = c.Prev() {
+			var drill Drill
+			if err := json.Unmarshal(v, &drill); err != nil {
+				return errors.Wrap(err, "Drill json unmarshal failed")
+			}
+			drills = append(drills, &drill)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Drills lookup for %v failed", plan)
+	}
+
+	return drills, nil
+}
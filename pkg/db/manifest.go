@@ -0,0 +1,163 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Archive is the manifest entry of a backup archive,
+// Key is the path relative to the destination root when the plan has a layout template.
+// Pinned archives are never removed by the retention.
+type Archive struct {
+	Plan         string      `json:"plan"`
+	Name         string      `json:"name"`
+	Key          string      `json:"key,omitempty"`
+	Timestamp    time.Time   `json:"timestamp"`
+	Size         int64       `json:"size"`
+	DataSize     int64       `json:"data_size,omitempty"`
+	Checksum     string      `json:"sha256,omitempty"`
+	Encrypted    bool        `json:"encrypted"`
+	Recipients   []string    `json:"recipients,omitempty"`
+	Destinations []string    `json:"destinations,omitempty"`
+	RotatedAt    *time.Time  `json:"rotated_at,omitempty"`
+	Pinned       bool        `json:"pinned,omitempty"`
+	Snapshot     *Snapshot   `json:"snapshot,omitempty"`
+	Validation   *Validation `json:"validation,omitempty"`
+}
+
+// Snapshot describes an archive of a restore target taken before the restore. Target is the address of
+// the target without credentials, Database the dumped database and Namespaces the dumped namespaces,
+// all databases were dumped when both are empty.
+type Snapshot struct {
+	Target     string   `json:"target,omitempty"`
+	Database   string   `json:"database,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Restore    string   `json:"restore"`
+}
+
+// Validation is the report of the validation restore of an archive, Checksum is the content check used.
+// Version is the version of the server restored into, Targets the reports of the other validation targets.
+type Validation struct {
+	Label           string                 `json:"label,omitempty"`
+	Version         string                 `json:"version,omitempty"`
+	Status          string                 `json:"status"`
+	Error           string                 `json:"error,omitempty"`
+	Checksum        string                 `json:"checksum,omitempty"`
+	RestoreDuration time.Duration          `json:"restore_duration"`
+	Warnings        []string               `json:"warnings,omitempty"`
+	Collections     []CollectionValidation `json:"collections"`
+	Targets         []Validation           `json:"targets,omitempty"`
+}
+
+// CollectionValidation compares a dumped collection with its restored copy,
+// Dumped is the count logged by mongodump and Archived the count read from the archive
+type CollectionValidation struct {
+	Collection string   `json:"collection"`
+	Dumped     int64    `json:"dumped"`
+	Archived   int64    `json:"archived"`
+	Restored   int64    `json:"restored"`
+	Indexes    int      `json:"indexes"`
+	Checksum   string   `json:"checksum,omitempty"`
+	Sampled    int      `json:"sampled,omitempty"`
+	Errors     []string `json:"errors,omitempty"`
+	Warnings   []string `json:"warnings,omitempty"`
+}
+
+var manifestBucket = []byte("archive_manifest")
+
+func archiveKey(plan string, name string) []byte {
+	return []byte(fmt.Sprintf("%v/%v", plan, name))
+}
+
+// PutArchive upserts an archive manifest entry
+func (db *StatusStore) PutArchive(archive *Archive) error {
+	buf, err := json.Marshal(archive)
+	if err != nil {
+		return errors.Wrap(err, "Manifest json marshal failed")
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(manifestBucket)
+		return b.Put(archiveKey(archive.Plan, archive.Name), buf)
+	})
+}
+
+// GetArchive loads an archive manifest entry, returns nil if not found
+func (db *StatusStore) GetArchive(plan string, name string) (*Archive, error) {
+	var archive *Archive
+
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(manifestBucket).Get(archiveKey(plan, name))
+		if v == nil {
+			return nil
+		}
+		archive = &Archive{}
+		return json.Unmarshal(v, archive)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Manifest lookup for %v/%v failed", plan, name)
+	}
+
+	return archive, nil
+}
+
+// GetArchives loads all manifest entries of a plan, newest first
+func (db *StatusStore) GetArchives(plan string) ([]*Archive, error) {
+	archives := make([]*Archive, 0)
+	prefix := []byte(plan + "/")
+
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(manifestBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+			var archive Archive
+			if err := json.Unmarshal(v, &archive); err != nil {
+				return errors.Wrap(err, "Manifest json unmarshal failed")
+			}
+			archives = append(archives, &archive)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].Timestamp.After(archives[j].Timestamp)
+	})
+
+	return archives, nil
+}
+
+// GetAllArchives loads the manifest entries of every plan
+func (db *StatusStore) GetAllArchives() ([]*Archive, error) {
+	archives := make([]*Archive, 0)
+
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(manifestBucket).ForEach(func(k, v []byte) error {
+			var archive Archive
+			if err := json.Unmarshal(v, &archive); err != nil {
+				return errors.Wrap(err, "Manifest json unmarshal failed")
+			}
+			archives = append(archives, &archive)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return archives, nil
+}
+
+// DeleteArchive removes an archive manifest entry
+func (db *StatusStore) DeleteArchive(plan string, name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(manifestBucket).Delete(archiveKey(plan, name))
+	})
+}
@@ -31,6 +31,21 @@ func NewStatusStore(store *Store) (*StatusStore, error) {
 		return nil, errors.Wrap(err, "Status store bucket init failed")
 	}
 
+	err = store.NewBucket(manifestBucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "Manifest bucket init failed")
+	}
+
+	err = store.NewBucket(auditBucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "Audit bucket init failed")
+	}
+
+	err = store.NewBucket(drillBucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "Drill bucket init failed")
+	}
+
 	return &StatusStore{store, bucket}, nil
 }
 
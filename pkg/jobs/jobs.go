@@ -0,0 +1,335 @@
+// Package jobs tracks the backups, restores, refreshes and drills run by the scheduler and the API.
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+const (
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateCancelled = "cancelled"
+)
+
+// maxLogSize bounds the log kept per job, the oldest lines are dropped above it
+const maxLogSize = 1024 * 1024
+
+// DestinationProgress is the upload state of an archive to a destination: pending, uploading, done or failed
+type DestinationProgress struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Info is a snapshot of a job, Bytes is the size of the archive dumped or fetched so far
+type Info struct {
+	ID           string                `json:"id"`
+	Kind         string                `json:"kind"`
+	Plan         string                `json:"plan"`
+	Trigger      string                `json:"trigger"`
+	State        string                `json:"state"`
+	Stage        string                `json:"stage,omitempty"`
+	Bytes        int64                 `json:"bytes"`
+	Destinations []DestinationProgress `json:"destinations,omitempty"`
+	Started      time.Time             `json:"started"`
+	Finished     *time.Time            `json:"finished,omitempty"`
+	Duration     time.Duration         `json:"duration"`
+	Error        string                `json:"error,omitempty"`
+	Result       interface{}           `json:"result,omitempty"`
+}
+
+// Job is a running or finished job, its methods do nothing on a nil job
+type Job struct {
+	mu        sync.Mutex
+	info      Info
+	ctx       context.Context
+	cancel    context.CancelFunc
+	cancelled bool
+
+	// log holds the redacted lines from logStart on, lines redacts the tool output before appending it
+	log      []byte
+	logStart int64
+	lines    *redact.Writer
+	logWait  chan struct{}
+}
+
+// jobLog is the writer behind Job.lines, the caller holds the job lock
+type jobLog struct {
+	j *Job
+}
+
+func (l jobLog) Write(p []byte) (int, error) {
+	l.j.appendLog(p)
+	return len(p), nil
+}
+
+type jobKey struct{}
+
+// FromContext returns the job of a context made by Job.Context, nil for the other ones
+func FromContext(ctx context.Context) *Job {
+	job, _ := ctx.Value(jobKey{}).(*Job)
+	return job
+}
+
+// ID returns the job id, empty for a nil job
+func (j *Job) ID() string {
+	if j == nil {
+		return ""
+	}
+	return j.info.ID
+}
+
+// Context is cancelled when the job is, the tools run with it write their output to the job log.
+// A nil job is never cancelled.
+func (j *Job) Context() context.Context {
+	if j == nil {
+		return context.Background()
+	}
+	return j.ctx
+}
+
+// Cancel asks a running job to stop, it returns false when the job has already finished
+func (j *Job) Cancel() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.info.Finished != nil {
+		return false
+	}
+	j.cancelled = true
+	j.cancel()
+	return true
+}
+
+// Cancelled tells whether the job was asked to stop
+func (j *Job) Cancelled() bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.cancelled
+}
+
+// SetStage records the current stage of the job
+func (j *Job) SetStage(stage string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.info.Stage = stage
+	j.appendLog([]byte(fmt.Sprintf("%v mgob: %v started\n", time.Now().UTC().Format(time.RFC3339), stage)))
+}
+
+// Write appends the output of a tool to the job log, the lines are redacted once complete
+func (j *Job) Write(p []byte) (int, error) {
+	if j == nil {
+		return len(p), nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.lines.Write(p)
+}
+
+// Log returns the log from offset and the offset of its end. The channel is closed on the next
+// write or when the job finishes, finished tells that nothing will be written anymore.
+func (j *Job) Log(offset int64) ([]byte, int64, <-chan struct{}, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if offset < j.logStart {
+		offset = j.logStart
+	}
+	end := j.logStart + int64(len(j.log))
+	if offset > end {
+		offset = end
+	}
+	data := append([]byte(nil), j.log[offset-j.logStart:]...)
+	return data, end, j.logWait, j.info.Finished != nil
+}
+
+// appendLog adds redacted lines to the log and wakes up its readers, the caller holds the lock
+func (j *Job) appendLog(lines []byte) {
+	j.log = append(j.log, lines...)
+	if over := len(j.log) - maxLogSize; over > 0 {
+		// drop whole lines
+		if i := bytes.IndexByte(j.log[over:], '\n'); i >= 0 {
+			over += i + 1
+		}
+		j.log = append([]byte(nil), j.log[over:]...)
+		j.logStart += int64(over)
+	}
+	close(j.logWait)
+	j.logWait = make(chan struct{})
+}
+
+// SetBytes records the bytes processed so far
+func (j *Job) SetBytes(n int64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.info.Bytes = n
+}
+
+// SetDestination records the upload state of a destination
+func (j *Job) SetDestination(name string, state string, bytes int64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := range j.info.Destinations {
+		if j.info.Destinations[i].Name == name {
+			j.info.Destinations[i].State = state
+			j.info.Destinations[i].Bytes = bytes
+			return
+		}
+	}
+	j.info.Destinations = append(j.info.Destinations, DestinationProgress{Name: name, State: state, Bytes: bytes})
+}
+
+// Finish ends the job with its result, the error message is redacted.
+// A cancelled job that didn't complete ends in the cancelled state.
+func (j *Job) Finish(result interface{}, err error) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer j.cancel()
+	j.lines.Flush()
+	now := time.Now().UTC()
+	j.info.Finished = &now
+	j.info.Duration = now.Sub(j.info.Started)
+	j.info.Result = result
+	j.info.State = StateSucceeded
+	if err != nil {
+		j.info.State = StateFailed
+		if j.cancelled {
+			j.info.State = StateCancelled
+		}
+		j.info.Error = redact.Error(err)
+	}
+	close(j.logWait)
+	j.logWait = make(chan struct{})
+}
+
+// Info returns a snapshot of the job
+func (j *Job) Info() Info {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	info := j.info
+	info.Destinations = append([]DestinationProgress(nil), j.info.Destinations...)
+	if info.Finished == nil {
+		info.Duration = time.Since(info.Started)
+	}
+	return info
+}
+
+func (j *Job) finished() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.info.Finished != nil
+}
+
+// Manager keeps the running jobs and the latest finished ones in memory
+type Manager struct {
+	mu    sync.Mutex
+	limit int
+	jobs  map[string]*Job
+}
+
+// NewManager keeps up to limit finished jobs
+func NewManager(limit int) *Manager {
+	return &Manager{
+		limit: limit,
+		jobs:  make(map[string]*Job),
+	}
+}
+
+// Start registers a running job, kind is backup, restore, refresh, drill or rotate and trigger is api, schedule or cli
+func (m *Manager) Start(kind string, plan string, trigger string) *Job {
+	if m == nil {
+		return nil
+	}
+	job := &Job{info: Info{
+		ID:      newID(),
+		Kind:    kind,
+		Plan:    plan,
+		Trigger: trigger,
+		State:   StateRunning,
+		Started: time.Now().UTC(),
+	}, logWait: make(chan struct{})}
+	job.lines = redact.NewWriter(jobLog{job})
+	ctx, cancel := context.WithCancel(context.Background())
+	job.ctx, job.cancel = context.WithValue(ctx, jobKey{}, job), cancel
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[job.info.ID] = job
+	m.trim()
+	return job
+}
+
+// Get finds a job by id
+func (m *Manager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// List returns the jobs, newest first
+func (m *Manager) List() []Info {
+	m.mu.Lock()
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	m.mu.Unlock()
+
+	result := make([]Info, 0, len(jobs))
+	for _, job := range jobs {
+		result = append(result, job.Info())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Started.After(result[j].Started)
+	})
+	return result
+}
+
+// trim drops the oldest finished jobs above the limit, running jobs are always kept
+func (m *Manager) trim() {
+	finished := make([]*Job, 0)
+	for _, job := range m.jobs {
+		if job.finished() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= m.limit {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].info.Started.Before(finished[j].info.Started)
+	})
+	for _, job := range finished[:len(finished)-m.limit] {
+		delete(m.jobs, job.info.ID)
+	}
+}
+
+func newID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -47,3 +47,83 @@ func New(namespace string, subsystem string) *BackupMetrics {
 
 	return prom
 }
+
+type RefreshMetrics struct {
+	Total     *prometheus.CounterVec
+	Documents *prometheus.GaugeVec
+	Latency   *prometheus.SummaryVec
+}
+
+func NewRefresh(namespace string, subsystem string) *RefreshMetrics {
+	prom := &RefreshMetrics{}
+
+	prom.Total = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "refresh_total",
+			Help:      "The total number of refreshes.",
+		},
+		[]string{"plan", "status"},
+	)
+
+	prom.Documents = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "refresh_documents",
+			Help:      "The number of documents restored by the last refresh.",
+		},
+		[]string{"plan", "status"},
+	)
+
+	prom.Latency = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "refresh_latency",
+			Help:      "Refresh duration in seconds, hooks included.",
+		},
+		[]string{"plan", "status"},
+	)
+
+	prometheus.MustRegister(prom.Total)
+	prometheus.MustRegister(prom.Documents)
+	prometheus.MustRegister(prom.Latency)
+
+	return prom
+}
+
+type DrillMetrics struct {
+	Total         *prometheus.CounterVec
+	TimeToRestore *prometheus.GaugeVec
+}
+
+func NewDrill(namespace string, subsystem string) *DrillMetrics {
+	prom := &DrillMetrics{}
+
+	prom.Total = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "drill_total",
+			Help:      "The total number of restore drills.",
+		},
+		[]string{"plan", "status"},
+	)
+
+	prom.TimeToRestore = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "drill_time_to_restore_seconds",
+			Help:      "Download and restore duration of the last restore drill.",
+		},
+		[]string{"plan", "status"},
+	)
+
+	prometheus.MustRegister(prom.Total)
+	prometheus.MustRegister(prom.TimeToRestore)
+
+	return prom
+}
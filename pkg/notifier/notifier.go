@@ -1,8 +1,14 @@
 package notifier
 
-import "github.com/stefanprodan/mgob/pkg/config"
+import (
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
 
 func SendNotification(subject string, body string, warn bool, plan config.Plan) error {
+	// bodies often carry wrapped errors with command lines and tool output
+	subject = redact.String(subject)
+	body = redact.String(body)
 
 	var err error
 	if plan.SMTP != nil {
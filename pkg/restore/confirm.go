@@ -0,0 +1,245 @@
+package restore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	backup "github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// ConfirmationTTL is how long a prepared restore waits for its confirmation
+const ConfirmationTTL = 5 * time.Minute
+
+// Request is a restore to prepare, Key is the archive name when no destination is given
+type Request struct {
+	Plan string `json:"plan"`
+	Source
+}
+
+// Summary describes what a prepared restore will do, namespaces are the ones written in the target
+type Summary struct {
+	Plan        string   `json:"plan"`
+	Destination string   `json:"destination"`
+	Archive     string   `json:"archive"`
+	Target      string   `json:"target"`
+	Database    string   `json:"database,omitempty"`
+	Namespaces  []string `json:"namespaces"`
+	Drop        bool     `json:"drop"`
+	Snapshot    bool     `json:"snapshot"`
+	Profile     string   `json:"profile,omitempty"`
+}
+
+// Prepare checks a restore request without touching the target and summarizes it
+func Prepare(plan config.Plan, conf *config.AppConfig, store *db.StatusStore, src Source) (Summary, error) {
+	summary := Summary{
+		Plan:        plan.Name,
+		Destination: src.Destination,
+		Archive:     src.Key,
+		Drop:        src.Drop,
+		Snapshot:    src.Snapshot,
+		Profile:     src.Profile,
+		Namespaces:  make([]string, 0),
+	}
+	if src.Key == "" {
+		return summary, errors.New("an archive is required")
+	}
+
+	if src.Destination == "" {
+		summary.Destination = "local"
+		if path.Base(src.Key) != src.Key {
+			return summary, errors.Errorf("archive %v is not a file name", src.Key)
+		}
+		file, err := backup.LocalArchivePath(plan, conf, store, src.Key)
+		if err != nil {
+			return summary, err
+		}
+		if _, err := os.Stat(file); err != nil {
+			return summary, errors.Wrapf(err, "archive %v not found", src.Key)
+		}
+	} else if _, err := backup.GetDestination(plan, conf, src.Destination); err != nil {
+		return summary, err
+	} else if err := backup.CheckKey(plan, store, src.Destination, src.Key); err != nil {
+		return summary, err
+	}
+
+	source, snapshot, err := sourceTarget(plan, store, path.Base(src.Key))
+	if err != nil {
+		return summary, err
+	}
+	target, err := restoreTarget(plan.Name, source, src.Options)
+	if err != nil {
+		return summary, err
+	}
+	if err := checkSnapshotTarget(path.Base(src.Key), snapshot, target, src.Options); err != nil {
+		return summary, err
+	}
+	if _, err := buildCmd(src.Key, source, target, src.Options); err != nil {
+		return summary, err
+	}
+	if src.Profile != "" {
+		if _, err := getProfile(plan, src.Profile); err != nil {
+			return summary, err
+		}
+	}
+
+	summary.Target = targetName(target)
+	summary.Database = target.Database
+	summary.Namespaces = affectedNamespaces(source, target, src.Options)
+	return summary, nil
+}
+
+// targetName is the address of a target without credentials
+func targetName(target config.Target) string {
+	if target.Uri == "" {
+		return fmt.Sprintf("%v:%v", target.Host, target.Port)
+	}
+	u, err := url.Parse(target.Uri)
+	if err != nil {
+		return "invalid uri"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+// targetAddress is the address of a target without credentials nor database, it tells the targets apart
+func targetAddress(target config.Target) string {
+	if target.Uri == "" {
+		return fmt.Sprintf("%v:%v", target.Host, target.Port)
+	}
+	u, err := url.Parse(target.Uri)
+	if err != nil {
+		return "invalid uri"
+	}
+	return fmt.Sprintf("%v://%v", u.Scheme, u.Host)
+}
+
+// affectedNamespaces maps the restored namespaces to the ones written in the target
+func affectedNamespaces(source config.Target, target config.Target, opts Options) []string {
+	namespaces := opts.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{"*.*"}
+		if source.Database != "" {
+			namespaces = []string{source.Database + ".*"}
+		}
+	}
+
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(ns string) {
+		if !seen[ns] {
+			seen[ns] = true
+			result = append(result, ns)
+		}
+	}
+
+	for _, ns := range namespaces {
+		mapped := ns
+		for _, rule := range opts.NsMap {
+			if rule.From == ns {
+				mapped = rule.To
+				break
+			}
+		}
+		if mapped == ns && target.Database != "" && strings.HasPrefix(ns, source.Database+".") {
+			mapped = target.Database + strings.TrimPrefix(ns, source.Database)
+		}
+		add(mapped)
+	}
+	for _, rule := range opts.NsMap {
+		add(rule.To)
+	}
+	return result
+}
+
+// Prepared is a restore waiting for its confirmation, Requester is the principal who prepared it
+type Prepared struct {
+	Plan      string
+	Requester string
+	Source    Source
+}
+
+type pendingRestore struct {
+	Prepared
+	expires time.Time
+}
+
+// Pending holds the prepared restores until they are confirmed or expire
+type Pending struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	restores map[string]pendingRestore
+}
+
+func NewPending(ttl time.Duration) *Pending {
+	return &Pending{
+		ttl:      ttl,
+		restores: make(map[string]pendingRestore),
+	}
+}
+
+// Add stores a prepared restore and returns its confirmation token
+func (p *Pending) Add(prepared Prepared) (string, time.Time, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "generating confirmation token failed")
+	}
+	token := hex.EncodeToString(buf)
+	expires := time.Now().Add(p.ttl)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.purge()
+	p.restores[token] = pendingRestore{Prepared: prepared, expires: expires}
+	return token, expires, nil
+}
+
+// Plan is the plan of a prepared restore, the restore stays pending
+func (p *Pending) Plan(token string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.purge()
+	pending, ok := p.restores[token]
+	return pending.Plan, ok
+}
+
+// Take removes a prepared restore, a token is valid once and until it expires
+func (p *Pending) Take(token string) (Prepared, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.purge()
+	pending, ok := p.restores[token]
+	if !ok {
+		return Prepared{}, false
+	}
+	delete(p.restores, token)
+	return pending.Prepared, true
+}
+
+func (p *Pending) purge() {
+	now := time.Now()
+	for token, pending := range p.restores {
+		if now.After(pending.expires) {
+			delete(p.restores, token)
+		}
+	}
+}
+
+// TokenID identifies a token in the audit log without disclosing it
+func TokenID(token string) string {
+	if len(token) < 8 {
+		return token
+	}
+	return token[:8]
+}
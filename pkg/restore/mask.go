@@ -0,0 +1,323 @@
+package restore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	backup "github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// documents updated per bulk write
+const maskBatchSize = 1000
+
+// MaskedField reports a masking rule applied to a restored collection
+type MaskedField struct {
+	Namespace string `json:"namespace"`
+	Field     string `json:"field"`
+	Rule      string `json:"rule"`
+	Documents int64  `json:"documents"`
+}
+
+type maskTask struct {
+	database   string
+	collection string
+	field      string
+	rule       config.MaskRule
+}
+
+// getProfile finds a restore profile of the plan and validates its rules
+func getProfile(plan config.Plan, name string) (*config.RestoreProfile, error) {
+	if plan.Restore != nil {
+		for i := range plan.Restore.Profiles {
+			if plan.Restore.Profiles[i].Name == name {
+				profile := &plan.Restore.Profiles[i]
+				return profile, checkProfile(*profile)
+			}
+		}
+	}
+	return nil, errors.Errorf("restore profile %v is not defined in plan %v", name, plan.Name)
+}
+
+func checkProfile(profile config.RestoreProfile) error {
+	for _, rule := range profile.Masking {
+		parts := strings.SplitN(rule.Field, ".", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.HasPrefix(parts[1], "_id") {
+			return errors.Errorf("profile %v: field %v is not in the collection.field form", profile.Name, rule.Field)
+		}
+		switch rule.Rule {
+		case "hash", "null":
+		case "fake":
+			switch rule.Generator {
+			case "", "name", "email", "phone", "text":
+			default:
+				return errors.Errorf("profile %v: unknown generator %v for %v", profile.Name, rule.Generator, rule.Field)
+			}
+		default:
+			return errors.Errorf("profile %v: unknown rule %v for %v, use hash, null or fake", profile.Name, rule.Rule, rule.Field)
+		}
+	}
+	return nil
+}
+
+// maskTasks matches the rules with the restored collections, found in the mongorestore log
+// or, without it, in the target database
+func maskTasks(profile config.RestoreProfile, collections []CollectionResult, database string) []maskTask {
+	namespaces := make([]string, 0)
+	for _, c := range collections {
+		namespaces = append(namespaces, c.Namespace)
+	}
+	if len(namespaces) == 0 && database != "" {
+		for _, rule := range profile.Masking {
+			namespaces = append(namespaces, database+"."+strings.SplitN(rule.Field, ".", 2)[0])
+		}
+	}
+
+	tasks := make([]maskTask, 0)
+	seen := make(map[string]bool)
+	for _, rule := range profile.Masking {
+		parts := strings.SplitN(rule.Field, ".", 2)
+		for _, ns := range namespaces {
+			nsParts := strings.SplitN(ns, ".", 2)
+			if len(nsParts) != 2 || nsParts[1] != parts[0] || seen[ns+"/"+parts[1]] {
+				continue
+			}
+			seen[ns+"/"+parts[1]] = true
+			tasks = append(tasks, maskTask{database: nsParts[0], collection: nsParts[1], field: parts[1], rule: rule})
+		}
+	}
+	return tasks
+}
+
+// mask applies the profile rules to the restored collections of the target
+func mask(ctx context.Context, plan config.Plan, target config.Target, profile config.RestoreProfile, tasks []maskTask) ([]MaskedField, error) {
+	masked := make([]MaskedField, 0, len(tasks))
+	if len(tasks) == 0 {
+		return masked, nil
+	}
+
+	uri := target.Uri
+	if uri == "" {
+		uri = backup.BuildUri(target)
+	}
+	if plan.Scheduler.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(plan.Scheduler.Timeout)*time.Minute)
+		defer cancel()
+	}
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return masked, errors.Wrap(err, "connecting to the restore target failed")
+	}
+	defer client.Disconnect(context.Background())
+
+	for _, task := range tasks {
+		t1 := time.Now()
+		collection := client.Database(task.database).Collection(task.collection)
+		var n int64
+		if task.rule.Rule == "null" && !strings.Contains(task.field, ".") {
+			n, err = maskNull(ctx, collection, task.field)
+		} else {
+			n, err = maskValues(ctx, collection, task, profile.Salt)
+		}
+		ns := fmt.Sprintf("%v.%v", task.database, task.collection)
+		if err != nil {
+			return masked, errors.Wrapf(err, "masking %v in %v failed", task.field, ns)
+		}
+		log.WithField("plan", plan.Name).Infof("Masked %v of %v documents in %v with %v in %v",
+			task.field, n, ns, task.rule.Rule, time.Since(t1))
+		masked = append(masked, MaskedField{Namespace: ns, Field: task.field, Rule: task.rule.Rule, Documents: n})
+	}
+	return masked, nil
+}
+
+func maskNull(ctx context.Context, collection *mongo.Collection, field string) (int64, error) {
+	res, err := collection.UpdateMany(ctx,
+		bson.M{field: bson.M{"$exists": true}},
+		bson.M{"$set": bson.M{field: nil}})
+	if err != nil {
+		return 0, err
+	}
+	return res.MatchedCount, nil
+}
+
+// maskValues rewrites the field of every document, the masked value depends only on the original one
+// so the references between collections masked with the same salt still match. The top level field
+// is rewritten as a whole, so the paths going through arrays of documents are masked in every element.
+func maskValues(ctx context.Context, collection *mongo.Collection, task maskTask, salt string) (int64, error) {
+	path := strings.Split(task.field, ".")
+	cursor, err := collection.Find(ctx,
+		bson.M{task.field: bson.M{"$exists": true, "$ne": nil}},
+		options.Find().SetProjection(bson.M{path[0]: 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var n int64
+	models := make([]mongo.WriteModel, 0, maskBatchSize)
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		if _, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+			return err
+		}
+		n += int64(len(models))
+		models = models[:0]
+		return nil
+	}
+
+	var skipped int64
+	for cursor.Next(ctx) {
+		value, err := cursor.Current.LookupErr(path[0])
+		if err != nil {
+			skipped++
+			continue
+		}
+		masked, ok := maskPath(task.rule, salt, value, path[1:])
+		if !ok {
+			// the filter matched a value the path can't reach, it would be left unmasked
+			skipped++
+			continue
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": cursor.Current.Lookup("_id")}).
+			SetUpdate(bson.M{"$set": bson.M{path[0]: masked}}))
+		if len(models) == maskBatchSize {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return n, err
+	}
+	if err := flush(); err != nil {
+		return n, err
+	}
+	if skipped > 0 {
+		return n, errors.Errorf("%v documents could not be masked", skipped)
+	}
+	return n, nil
+}
+
+// maskPath masks the value at path inside value, arrays are walked element by element. The
+// elements and fields out of the path are kept as they are, false when nothing was masked.
+func maskPath(rule config.MaskRule, salt string, value bson.RawValue, path []string) (interface{}, bool) {
+	if len(path) == 0 {
+		if value.Type == bsontype.Null || value.Type == bsontype.Undefined {
+			return value, false
+		}
+		if rule.Rule == "null" {
+			return nil, true
+		}
+		return maskValue(rule, salt, value), true
+	}
+
+	switch value.Type {
+	case bsontype.Array:
+		values, _ := value.Array().Values()
+		result := make(bson.A, 0, len(values))
+		masked := false
+		for _, v := range values {
+			m, ok := maskPath(rule, salt, v, path)
+			if !ok {
+				m = v
+			}
+			masked = masked || ok
+			result = append(result, m)
+		}
+		return result, masked
+	case bsontype.EmbeddedDocument:
+		elements, _ := value.Document().Elements()
+		result := make(bson.D, 0, len(elements))
+		masked := false
+		for _, e := range elements {
+			var m interface{} = e.Value()
+			if e.Key() == path[0] {
+				var ok bool
+				if m, ok = maskPath(rule, salt, e.Value(), path[1:]); !ok {
+					m = e.Value()
+				}
+				masked = masked || ok
+			}
+			result = append(result, bson.E{Key: e.Key(), Value: m})
+		}
+		return result, masked
+	}
+	return value, false
+}
+
+func maskValue(rule config.MaskRule, salt string, value bson.RawValue) interface{} {
+	if value.Type == bsontype.Array {
+		values, _ := value.Array().Values()
+		result := make([]interface{}, 0, len(values))
+		for _, v := range values {
+			result = append(result, maskValue(rule, salt, v))
+		}
+		return result
+	}
+
+	s := value.String()
+	if str, ok := value.StringValueOK(); ok {
+		s = str
+	}
+	sum := sha256.Sum256([]byte(salt + s))
+	if rule.Rule == "hash" {
+		return hex.EncodeToString(sum[:])
+	}
+	return fake(generatorFor(rule), sum)
+}
+
+// generatorFor guesses the fake values from the field name when no generator is set
+func generatorFor(rule config.MaskRule) string {
+	if rule.Generator != "" {
+		return rule.Generator
+	}
+	path := strings.Split(strings.ToLower(rule.Field), ".")
+	name := path[len(path)-1]
+	switch {
+	case strings.Contains(name, "mail"):
+		return "email"
+	case strings.Contains(name, "phone") || strings.Contains(name, "mobile"):
+		return "phone"
+	case strings.Contains(name, "name"):
+		return "name"
+	}
+	return "text"
+}
+
+var (
+	fakeFirstNames = []string{"Alex", "Sam", "Robin", "Charlie", "Jordan", "Taylor", "Morgan", "Casey", "Jamie", "Riley",
+		"Avery", "Quinn", "Parker", "Drew", "Reese", "Skyler"}
+	fakeLastNames = []string{"Smith", "Jones", "Brown", "Miller", "Davis", "Garcia", "Wilson", "Moore", "Clark", "Lewis",
+		"Walker", "Hall", "Young", "King", "Wright", "Scott"}
+)
+
+func fake(generator string, sum [32]byte) string {
+	switch generator {
+	case "name":
+		first := fakeFirstNames[binary.BigEndian.Uint32(sum[0:4])%uint32(len(fakeFirstNames))]
+		last := fakeLastNames[binary.BigEndian.Uint32(sum[4:8])%uint32(len(fakeLastNames))]
+		return fmt.Sprintf("%v %v", first, last)
+	case "email":
+		return fmt.Sprintf("user-%v@example.com", hex.EncodeToString(sum[:6]))
+	case "phone":
+		return fmt.Sprintf("+1555%07d", binary.BigEndian.Uint32(sum[0:4])%10000000)
+	}
+	return fmt.Sprintf("masked-%v", hex.EncodeToString(sum[:6]))
+}
@@ -0,0 +1,130 @@
+package restore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+func Test_getProfile(t *testing.T) {
+	plan := config.Plan{Name: "mongo-test", Restore: &config.Restore{Profiles: []config.RestoreProfile{
+		{Name: "staging", Masking: []config.MaskRule{{Field: "users.email", Rule: "hash"}}},
+		{Name: "invalid-rule", Masking: []config.MaskRule{{Field: "users.email", Rule: "shuffle"}}},
+		{Name: "invalid-field", Masking: []config.MaskRule{{Field: "email", Rule: "null"}}},
+		{Name: "invalid-generator", Masking: []config.MaskRule{{Field: "users.email", Rule: "fake", Generator: "iban"}}},
+	}}}
+
+	profile, err := getProfile(plan, "staging")
+	assert.NoError(t, err)
+	assert.Equal(t, "staging", profile.Name)
+
+	for _, name := range []string{"invalid-rule", "invalid-field", "invalid-generator", "missing"} {
+		_, err = getProfile(plan, name)
+		assert.Error(t, err, name)
+	}
+}
+
+func Test_maskTasks(t *testing.T) {
+	profile := config.RestoreProfile{Masking: []config.MaskRule{
+		{Field: "users.email", Rule: "hash"},
+		{Field: "users.address.city", Rule: "null"},
+		{Field: "payments.card", Rule: "null"},
+	}}
+	collections := []CollectionResult{{Namespace: "app_staging.users"}, {Namespace: "app_staging.orders"}}
+
+	tasks := maskTasks(profile, collections, "app_staging")
+	assert.Len(t, tasks, 2)
+	assert.Equal(t, maskTask{database: "app_staging", collection: "users", field: "email", rule: profile.Masking[0]}, tasks[0])
+	assert.Equal(t, "address.city", tasks[1].field)
+
+	// without the restore log the rules apply to the target database
+	tasks = maskTasks(profile, nil, "app")
+	assert.Len(t, tasks, 3)
+	assert.Equal(t, "payments", tasks[2].collection)
+	assert.Len(t, maskTasks(profile, nil, ""), 0)
+}
+
+func Test_maskValue(t *testing.T) {
+	value := func(v interface{}) bson.RawValue {
+		typ, data, err := bson.MarshalValue(v)
+		assert.NoError(t, err)
+		return bson.RawValue{Type: typ, Value: data}
+	}
+
+	hash := config.MaskRule{Field: "users.email", Rule: "hash"}
+	assert.Equal(t, maskValue(hash, "salt", value("jane@corp.com")), maskValue(hash, "salt", value("jane@corp.com")))
+	assert.NotEqual(t, maskValue(hash, "salt", value("jane@corp.com")), maskValue(hash, "other", value("jane@corp.com")))
+	assert.Len(t, maskValue(hash, "salt", value(int32(42))), 64)
+
+	email := config.MaskRule{Field: "users.email", Rule: "fake"}
+	assert.Regexp(t, `^user-[0-9a-f]{12}@example\.com$`, maskValue(email, "salt", value("jane@corp.com")))
+
+	name := config.MaskRule{Field: "profiles.name", Rule: "fake"}
+	assert.Regexp(t, `^\w+ \w+$`, maskValue(name, "salt", value("Jane Doe")))
+	assert.Equal(t, maskValue(name, "salt", value("Jane Doe")), maskValue(name, "salt", value("Jane Doe")))
+
+	phone := config.MaskRule{Field: "users.phones", Rule: "fake"}
+	phones := maskValue(phone, "salt", value(bson.A{"+33 1 23 45 67 89", "+33 6 12 34 56 78"}))
+	assert.Len(t, phones, 2)
+	assert.Regexp(t, `^\+1555\d{7}$`, phones.([]interface{})[0])
+}
+
+func Test_maskPath(t *testing.T) {
+	doc, err := bson.Marshal(bson.M{
+		"addresses": bson.A{
+			bson.M{"email": "jane@corp.com", "city": "Paris"},
+			bson.M{"city": "Lyon"},
+			bson.M{"email": nil, "city": "Nice"},
+			bson.M{"contacts": bson.A{bson.M{"email": "john@corp.com"}}},
+		},
+		"status": "active",
+	})
+	assert.NoError(t, err)
+
+	rule := config.MaskRule{Field: "users.addresses.email", Rule: "hash"}
+	masked, ok := maskPath(rule, "salt", bson.Raw(doc).Lookup("addresses"), []string{"email"})
+	assert.True(t, ok)
+
+	buf, err := bson.Marshal(bson.M{"addresses": masked})
+	assert.NoError(t, err)
+	var result struct {
+		Addresses []bson.M `bson:"addresses"`
+	}
+	assert.NoError(t, bson.Unmarshal(buf, &result))
+	assert.Len(t, result.Addresses, 4)
+	assert.Len(t, result.Addresses[0]["email"], 64)
+	assert.NotContains(t, result.Addresses[0]["email"], "jane")
+	assert.Equal(t, "Paris", result.Addresses[0]["city"])
+	assert.Equal(t, bson.M{"city": "Lyon"}, result.Addresses[1])
+	assert.Nil(t, result.Addresses[2]["email"])
+	assert.Equal(t, "Nice", result.Addresses[2]["city"])
+
+	nested, ok := maskPath(rule, "salt", bson.Raw(doc).Lookup("addresses"), []string{"contacts", "email"})
+	assert.True(t, ok)
+	buf, err = bson.Marshal(bson.M{"addresses": nested})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(buf), "john@corp.com")
+	assert.Contains(t, string(buf), "jane@corp.com")
+
+	null := config.MaskRule{Field: "users.addresses.email", Rule: "null"}
+	masked, ok = maskPath(null, "salt", bson.Raw(doc).Lookup("addresses"), []string{"email"})
+	assert.True(t, ok)
+	buf, err = bson.Marshal(bson.M{"addresses": masked})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(buf), "jane@corp.com")
+
+	// the path goes through a string, nothing can be masked
+	_, ok = maskPath(rule, "salt", bson.Raw(doc).Lookup("status"), []string{"email"})
+	assert.False(t, ok)
+}
+
+func Test_generatorFor(t *testing.T) {
+	assert.Equal(t, "email", generatorFor(config.MaskRule{Field: "users.contact.Email"}))
+	assert.Equal(t, "name", generatorFor(config.MaskRule{Field: "profiles.lastName"}))
+	assert.Equal(t, "phone", generatorFor(config.MaskRule{Field: "users.mobile"}))
+	assert.Equal(t, "text", generatorFor(config.MaskRule{Field: "users.notes"}))
+	assert.Equal(t, "name", generatorFor(config.MaskRule{Field: "users.notes", Generator: "name"}))
+}
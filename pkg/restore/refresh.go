@@ -0,0 +1,186 @@
+package restore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	backup "github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+// HookResult is the outcome of a post-restore hook
+type HookResult struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// RefreshResult is the restore made by a refresh job, followed by its hooks
+type RefreshResult struct {
+	Result
+	Source string       `json:"source"`
+	Hooks  []HookResult `json:"hooks"`
+}
+
+// Refresh restores the latest backup of the source plan into the target of a refresh plan and runs its hooks
+func Refresh(plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig, store *db.StatusStore, job *jobs.Job) (RefreshResult, error) {
+	t1 := time.Now()
+	res := RefreshResult{
+		Result: Result{
+			Result: backup.Result{
+				Plan:      plan.Name,
+				Timestamp: t1.UTC(),
+				Status:    500,
+			},
+			Collections: make([]CollectionResult, 0),
+		},
+		Hooks: make([]HookResult, 0),
+	}
+	if plan.Refresh == nil {
+		return res, errors.Errorf("plan %v is not a refresh job", plan.Name)
+	}
+	refresh := plan.Refresh
+	res.Source = refresh.Source
+
+	source, err := config.LoadPlan(conf.ConfigPath, refresh.Source)
+	if err != nil {
+		return res, errors.Wrapf(err, "loading source plan %v failed", refresh.Source)
+	}
+	if plan.Restore != nil {
+		// the masking profiles of the refresh plan take precedence
+		source.Restore = plan.Restore
+	}
+
+	archive, err := latestArchive(source, store, refresh.Destination)
+	if err != nil {
+		return res, err
+	}
+
+	target := plan.Target
+	opts := Options{
+		Target:     &target,
+		Namespaces: refresh.Namespaces,
+		Drop:       refresh.Drop,
+		Snapshot:   refresh.Snapshot,
+		Profile:    refresh.Profile,
+		Job:        job,
+	}
+	for _, rule := range refresh.NsMap {
+		opts.NsMap = append(opts.NsMap, NsRule{From: rule.From, To: rule.To})
+	}
+
+	log.WithField("plan", plan.Name).Infof("Refresh from %v archive %v started", source.Name, archive.Name)
+	var restored Result
+	if refresh.Destination == "" || refresh.Destination == "local" {
+		var file string
+		if file, err = backup.LocalArchivePath(source, conf, store, archive.Name); err == nil {
+			restored, err = Run(source, conf, modules, store, file, opts)
+		}
+	} else {
+		key := archive.Name
+		if archive.Key != "" {
+			key = archive.Key
+		}
+		restored, err = RunFrom(source, conf, modules, store, Source{
+			Destination: refresh.Destination,
+			Key:         key,
+			FetchOptions: backup.FetchOptions{
+				KeyFile:        refresh.KeyFile,
+				PassphraseFile: refresh.PassphraseFile,
+			},
+			Options: opts,
+		})
+	}
+	res.Result = restored
+	res.Plan = plan.Name
+	res.Status = 500
+	if err != nil {
+		res.Duration = time.Since(t1)
+		return res, errors.Wrapf(err, "restoring %v failed", archive.Name)
+	}
+
+	if err := job.Context().Err(); err != nil {
+		res.Duration = time.Since(t1)
+		return res, errors.Wrap(err, "refresh cancelled, the hooks were not run")
+	}
+	job.SetStage("hooks")
+	env := hookEnv(plan, source, archive.Name)
+	for _, hook := range refresh.Hooks {
+		hr, err := runHook(plan, hook, env)
+		res.Hooks = append(res.Hooks, hr)
+		if err != nil {
+			res.Duration = time.Since(t1)
+			return res, err
+		}
+	}
+
+	res.Status = 200
+	res.Duration = time.Since(t1)
+	return res, nil
+}
+
+// latestArchive finds the newest backup of a plan recorded on a destination, snapshots excluded
+func latestArchive(plan config.Plan, store *db.StatusStore, destination string) (*db.Archive, error) {
+	if store == nil {
+		return nil, errors.New("refresh jobs need the backup manifest")
+	}
+	if destination == "" {
+		destination = "local"
+	}
+
+	archives, err := store.GetArchives(plan.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, archive := range archives {
+		if archive.Pinned {
+			continue
+		}
+		for _, d := range archive.Destinations {
+			if d == destination {
+				return archive, nil
+			}
+		}
+	}
+	return nil, errors.Errorf("no backup of plan %v found on %v", plan.Name, destination)
+}
+
+// hookEnv describes the refresh to the hooks, the target uri includes its credentials
+func hookEnv(plan config.Plan, source config.Plan, archive string) []string {
+	uri := plan.Target.Uri
+	if uri == "" {
+		uri = backup.BuildUri(plan.Target)
+	}
+	return []string{
+		fmt.Sprintf("MGOB_PLAN=%v", plan.Name),
+		fmt.Sprintf("MGOB_SOURCE_PLAN=%v", source.Name),
+		fmt.Sprintf("MGOB_ARCHIVE=%v", archive),
+		fmt.Sprintf("MGOB_TARGET_URI=%v", uri),
+		fmt.Sprintf("MGOB_TARGET_DATABASE=%v", plan.Target.Database),
+	}
+}
+
+func runHook(plan config.Plan, hook config.Hook, env []string) (HookResult, error) {
+	t1 := time.Now()
+	res := HookResult{Name: hook.Name}
+	timeout := time.Duration(hook.Timeout) * time.Minute
+	if timeout == 0 {
+		timeout = time.Duration(plan.Scheduler.Timeout) * time.Minute
+	}
+
+	log.WithField("plan", plan.Name).Infof("Running hook %v", hook.Name)
+	output, err := backup.RunHook(hook.Command, timeout, env)
+	res.Duration = time.Since(t1)
+	log.WithField("plan", plan.Name).Debugf("Hook %v output: %v", hook.Name, redact.String(string(output)))
+	if err != nil {
+		res.Error = redact.Error(err)
+		return res, errors.Wrapf(err, "hook %v failed", hook.Name)
+	}
+	return res, nil
+}
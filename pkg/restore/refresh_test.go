@@ -0,0 +1,62 @@
+package restore
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+func Test_latestArchive(t *testing.T) {
+	bolt, err := db.Open(filepath.Join(t.TempDir(), "mgob.db"))
+	assert.NoError(t, err)
+	defer bolt.Close()
+	store, err := db.NewStatusStore(bolt)
+	assert.NoError(t, err)
+
+	plan := config.Plan{Name: "mongo-prod"}
+	ts := time.Date(2023, 4, 5, 0, 0, 0, 0, time.UTC)
+	for i, archive := range []*db.Archive{
+		{Name: "mongo-prod-1.gz", Destinations: []string{"local", "s3"}},
+		{Name: "mongo-prod-2.gz", Destinations: []string{"s3"}},
+		{Name: "mongo-prod-snapshot-3.gz", Destinations: []string{"local"}, Pinned: true},
+	} {
+		archive.Plan = plan.Name
+		archive.Timestamp = ts.Add(time.Duration(i) * time.Hour)
+		assert.NoError(t, store.PutArchive(archive))
+	}
+
+	archive, err := latestArchive(plan, store, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "mongo-prod-1.gz", archive.Name)
+
+	archive, err = latestArchive(plan, store, "s3")
+	assert.NoError(t, err)
+	assert.Equal(t, "mongo-prod-2.gz", archive.Name)
+
+	_, err = latestArchive(plan, store, "gcloud")
+	assert.Error(t, err)
+	_, err = latestArchive(plan, nil, "")
+	assert.Error(t, err)
+}
+
+func Test_Refresh_hook(t *testing.T) {
+	plan := config.Plan{
+		Name:   "staging-refresh",
+		Target: config.Target{Host: "staging", Port: 27017, Database: "app_staging"},
+	}
+	env := hookEnv(plan, config.Plan{Name: "mongo-prod"}, "mongo-prod-1.gz")
+	assert.Contains(t, env, "MGOB_TARGET_URI=mongodb://staging:27017")
+
+	res, err := runHook(plan, config.Hook{Name: "check", Command: `sh -c 'test "$MGOB_SOURCE_PLAN" = mongo-prod'`}, env)
+	assert.NoError(t, err)
+	assert.Equal(t, "check", res.Name)
+
+	res, err = runHook(plan, config.Hook{Name: "fail", Command: "false"}, env)
+	assert.Error(t, err)
+	assert.Contains(t, res.Error, "exited with code 1")
+}
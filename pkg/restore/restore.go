@@ -2,7 +2,11 @@ package restore
 
 import (
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -10,40 +14,335 @@ import (
 
 	backup "github.com/stefanprodan/mgob/pkg/backup"
 	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
+	"github.com/stefanprodan/mgob/pkg/redact"
 )
 
-func Run(plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig, backupPath string) (backup.Result, error) {
+// NsRule renames the restored namespaces, wildcards as in mongorestore --nsFrom/--nsTo
+type NsRule struct {
+	From string `json:"nsFrom"`
+	To   string `json:"nsTo"`
+}
+
+// Options of a restore, the plan target is used when no alternate target is given.
+// Namespaces limits the restore to some collections, with * wildcards like app.users or app.log_*.
+// Snapshot dumps the restored database of the target to a pinned archive first.
+// Profile names the plan restore profile masking the restored data.
+type Options struct {
+	Target         *config.Target `json:"target,omitempty"`
+	Namespaces     []string       `json:"namespaces,omitempty"`
+	NsMap          []NsRule       `json:"nsMap,omitempty"`
+	Drop           bool           `json:"drop"`
+	NoIndexRestore bool           `json:"noIndexRestore"`
+	Snapshot       bool           `json:"snapshot"`
+	Profile        string         `json:"profile,omitempty"`
+	// Job receives the stages and progress of the restore
+	Job *jobs.Job `json:"-"`
+}
+
+// CollectionResult holds the documents restored in a collection, parsed from the mongorestore log
+type CollectionResult struct {
+	Namespace string `json:"namespace"`
+	Restored  int64  `json:"restored"`
+	Failed    int64  `json:"failed"`
+}
+
+type Result struct {
+	backup.Result
+	Collections []CollectionResult `json:"collections"`
+	Snapshot    string             `json:"snapshot,omitempty"`
+	Masked      []MaskedField      `json:"masked,omitempty"`
+}
+
+func Run(plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig, store *db.StatusStore, backupPath string, opts Options) (Result, error) {
 	t1 := time.Now()
 
 	log.WithField("plan", plan.Name).Debugf("Running restore for plan %v, backupPath %v", plan.Name, backupPath)
-	restoreCmd := backup.BuildRestoreCmd(backupPath, plan.Target, plan.Target)
-	log.WithField("plan", plan.Name).Infof("Running restore command with : %v", restoreCmd)
-	fi, err := os.Stat(backupPath)
-
-	res := backup.Result{
-		Plan:      plan.Name,
-		Timestamp: t1.UTC(),
-		Status:    500,
+	res := Result{
+		Result: backup.Result{
+			Plan:      plan.Name,
+			Timestamp: t1.UTC(),
+			Status:    500,
+		},
+		Collections: make([]CollectionResult, 0),
 	}
 	_, res.Name = filepath.Split(backupPath)
+
+	source, snapshot, err := sourceTarget(plan, store, res.Name)
+	if err != nil {
+		return res, err
+	}
+	target, err := restoreTarget(plan.Name, source, opts)
+	if err != nil {
+		return res, err
+	}
+	if err := checkSnapshotTarget(res.Name, snapshot, target, opts); err != nil {
+		return res, err
+	}
+	restoreCmd, err := buildCmd(backupPath, source, target, opts)
+	if err != nil {
+		return res, err
+	}
+	log.WithField("plan", plan.Name).Infof("Running restore command with : %v", redact.String(strings.Join(restoreCmd, " ")))
+	fi, err := os.Stat(backupPath)
 	if err != nil {
 		return res, errors.Wrapf(err, "stat file %v failed", backupPath)
 	}
 	res.Size = fi.Size()
-	output, err := backup.RunRestore(backupPath, plan)
-	if err != nil || backup.CheckIfAnyFailure(string(output)) != nil {
+	opts.Job.SetBytes(res.Size)
+	ctx := opts.Job.Context()
+
+	var profile *config.RestoreProfile
+	if opts.Profile != "" {
+		if profile, err = getProfile(plan, opts.Profile); err != nil {
+			return res, err
+		}
+	}
+
+	if opts.Snapshot {
+		opts.Job.SetStage("snapshot")
+		snapshot, err := backup.Snapshot(ctx, plan, conf, store, target, db.Snapshot{
+			Target:     targetAddress(target),
+			Namespaces: snapshotNamespaces(source, target, opts),
+			Restore:    res.Name,
+		})
+		if err != nil {
+			res.Duration = time.Since(t1)
+			return res, errors.Wrap(err, "snapshot of the restore target failed, nothing was restored")
+		}
+		res.Snapshot = snapshot.Name
+	}
+
+	if err := ctx.Err(); err != nil {
+		res.Duration = time.Since(t1)
+		return res, errors.Wrap(err, "restore cancelled, nothing was restored")
+	}
+	opts.Job.SetStage("restore")
+	output, err := backup.ExecRestore(ctx, plan, restoreCmd)
+	res.Collections = parseCollections(string(output))
+	if err == nil {
+		err = backup.CheckIfAnyFailure(string(output))
+	}
+	if err != nil {
 		log.WithField("plan", plan.Name).Error("Restore failed")
 		res.Duration = time.Since(t1)
+		if res.Snapshot != "" {
+			return res, errors.Wrapf(err, "failed to execute restore command, snapshot %v holds the previous data", res.Snapshot)
+		}
 		return res, errors.Wrapf(err, "failed to execute restore command")
 	}
 	log.WithField("plan", plan.Name).Debugf("Restore command output: %v", string(output))
+
+	if profile != nil {
+		opts.Job.SetStage("masking")
+		res.Masked, err = mask(ctx, plan, target, *profile, maskTasks(*profile, res.Collections, target.Database))
+		if err != nil {
+			log.WithField("plan", plan.Name).Error("Restore masking failed")
+			res.Duration = time.Since(t1)
+			return res, errors.Wrapf(err, "profile %v failed, the restored data is not fully masked", profile.Name)
+		}
+	}
+
 	res.Status = 200
 	res.Duration = time.Since(t1)
-	client, ctx, err := backup.GetMongoClient(backup.BuildUri(plan.Validation.Database))
-	if err == nil {
-		defer backup.Dispose(client, ctx)
-	} else {
-		log.WithField("plan", plan.Name).Errorf("Failed to get mongo client: %v, depose skipped", err)
-	}
 	return res, nil
 }
+
+// sourceTarget is the target an archive was dumped from, the plan target or the one of a snapshot.
+// The snapshot is returned when the archive is one.
+func sourceTarget(plan config.Plan, store *db.StatusStore, name string) (config.Target, *db.Snapshot, error) {
+	source := plan.Target
+	if store == nil {
+		return source, nil, nil
+	}
+	archive, err := store.GetArchive(plan.Name, name)
+	if err == nil && archive == nil && !strings.HasSuffix(name, ".encrypted") {
+		// the archives fetched from a destination are restored once decrypted
+		archive, err = store.GetArchive(plan.Name, name+".encrypted")
+	}
+	if err != nil {
+		return source, nil, err
+	}
+	if archive == nil || archive.Snapshot == nil {
+		return source, nil, nil
+	}
+	// snapshots hold the database of the target they were taken from
+	source.Database = archive.Snapshot.Database
+	return source, archive.Snapshot, nil
+}
+
+// checkSnapshotTarget restores a snapshot only into the target it was taken from. The snapshots of
+// older manifests don't record it, they are restored into the target passed explicitly only.
+func checkSnapshotTarget(name string, snapshot *db.Snapshot, target config.Target, opts Options) error {
+	if snapshot == nil {
+		return nil
+	}
+	if snapshot.Target == "" {
+		if opts.Target == nil {
+			return errors.Errorf("snapshot %v does not record the target it was taken from, pass it as the restore target", name)
+		}
+		return nil
+	}
+	if address := targetAddress(target); address != snapshot.Target {
+		return errors.Errorf("snapshot %v was taken from %v, it is not restored into %v", name, snapshot.Target, address)
+	}
+	return nil
+}
+
+// BuildCmd builds the mongorestore command into the plan target or the alternate one
+func BuildCmd(archive string, plan config.Plan, opts Options) ([]string, error) {
+	target, err := restoreTarget(plan.Name, plan.Target, opts)
+	if err != nil {
+		return nil, err
+	}
+	return buildCmd(archive, plan.Target, target, opts)
+}
+
+// restoreTarget resolves where an archive dumped from source is restored to
+func restoreTarget(planName string, source config.Target, opts Options) (config.Target, error) {
+	target := source
+	if opts.Target != nil {
+		target = *opts.Target
+		// the archive is compressed according to the plan target
+		target.NoGzip = source.NoGzip
+		redact.Add(target.SecretValues()...)
+		if target.Uri == "" && target.Host == "" {
+			return target, errors.New("restore target needs an uri or a host")
+		}
+		if source.Database == "" && target.Database != "" && len(opts.NsMap) == 0 {
+			return target, errors.Errorf("plan %v dumps all databases, use nsMap to restore into %v", planName, target.Database)
+		}
+		if target.Database == "" {
+			target.Database = source.Database
+		}
+	}
+
+	for _, ns := range opts.Namespaces {
+		if err := checkNamespace(ns, source.Database); err != nil {
+			return target, err
+		}
+	}
+
+	if source.Database == "" {
+		// full dumps are renamed with the nsMap rules only
+		target.Database = ""
+	}
+	return target, nil
+}
+
+func buildCmd(archive string, source config.Target, target config.Target, opts Options) ([]string, error) {
+	cmd, err := backup.BuildRestoreCmd(archive, source, target)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.Namespaces) > 0 {
+		cmd = withoutNsInclude(cmd)
+		for _, ns := range opts.Namespaces {
+			cmd = append(cmd, "--nsInclude", ns)
+		}
+	}
+
+	for _, rule := range opts.NsMap {
+		if rule.From == "" || rule.To == "" {
+			return nil, errors.New("nsMap rules need nsFrom and nsTo")
+		}
+		cmd = append(cmd, "--nsFrom", rule.From, "--nsTo", rule.To)
+	}
+	if opts.Drop {
+		cmd = append(cmd, "--drop")
+	}
+	if opts.NoIndexRestore {
+		cmd = append(cmd, "--noIndexRestore")
+	}
+	return cmd, nil
+}
+
+// snapshotNamespaces are the namespaces a restore writes to, none when it may write to any of them
+func snapshotNamespaces(source config.Target, target config.Target, opts Options) []string {
+	namespaces := affectedNamespaces(source, target, opts)
+	for _, ns := range namespaces {
+		if ns == "*.*" {
+			return nil
+		}
+	}
+	return namespaces
+}
+
+// checkNamespace validates a db.collection pattern against the dumped database
+func checkNamespace(ns string, database string) error {
+	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return errors.Errorf("namespace %v is not in the db.collection form", ns)
+	}
+	if strings.ContainsAny(ns, "?[]") {
+		return errors.Errorf("namespace %v: only * wildcards are supported", ns)
+	}
+	if database != "" && !strings.Contains(parts[0], "*") && parts[0] != database {
+		return errors.Errorf("namespace %v is not in the archive of database %v", ns, database)
+	}
+	return nil
+}
+
+func withoutNsInclude(cmd []string) []string {
+	result := make([]string, 0, len(cmd))
+	for i := 0; i < len(cmd); i++ {
+		if cmd[i] == "--nsInclude" {
+			i++
+			continue
+		}
+		result = append(result, cmd[i])
+	}
+	return result
+}
+
+var finishedRegex = regexp.MustCompile(`finished restoring (\S+) \((\d+) documents?, (\d+) failures?\)`)
+
+func parseCollections(output string) []CollectionResult {
+	result := make([]CollectionResult, 0)
+	for _, matches := range finishedRegex.FindAllStringSubmatch(output, -1) {
+		restored, _ := strconv.ParseInt(matches[2], 10, 64)
+		failed, _ := strconv.ParseInt(matches[3], 10, 64)
+		result = append(result, CollectionResult{Namespace: matches[1], Restored: restored, Failed: failed})
+	}
+	return result
+}
+
+// Source points to an archive on one of the plan destinations
+type Source struct {
+	Destination string `json:"destination"`
+	Key         string `json:"key"`
+	backup.FetchOptions
+	Options
+}
+
+// RunFrom downloads an archive from a destination, verifies and decrypts it, then restores it
+func RunFrom(plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig, store *db.StatusStore, src Source) (Result, error) {
+	res := Result{
+		Result: backup.Result{
+			Plan:      plan.Name,
+			Name:      path.Base(src.Key),
+			Timestamp: time.Now().UTC(),
+			Status:    500,
+		},
+		Collections: make([]CollectionResult, 0),
+	}
+
+	dest, err := backup.GetDestination(plan, conf, src.Destination)
+	if err != nil {
+		return res, err
+	}
+
+	log.WithField("plan", plan.Name).Infof("Fetching %v from %v", src.Key, dest.Name())
+	src.Job.SetStage("fetch")
+	archive, cleanup, err := backup.FetchArchive(src.Job.Context(), plan, conf, store, dest, src.Key, src.FetchOptions)
+	defer cleanup()
+	if err != nil {
+		return res, errors.Wrapf(err, "fetching %v from %v failed", src.Key, dest.Name())
+	}
+
+	res, err = Run(plan, conf, modules, store, archive, src.Options)
+	res.Name = path.Base(src.Key)
+	return res, err
+}
@@ -0,0 +1,70 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
+	"github.com/stefanprodan/mgob/pkg/metrics"
+	"github.com/stefanprodan/mgob/pkg/notifier"
+	"github.com/stefanprodan/mgob/pkg/redact"
+)
+
+type drillJob struct {
+	name    string
+	plan    config.Plan
+	conf    *config.AppConfig
+	stats   *db.StatusStore
+	metrics *metrics.DrillMetrics
+	jobs    *jobs.Manager
+}
+
+func (j drillJob) Run() {
+	log.WithField("plan", j.plan.Name).Info("Restore drill started")
+	job := j.jobs.Start("drill", j.plan.Name, "schedule")
+	status := "200"
+
+	report := &db.Drill{Plan: j.plan.Name, Timestamp: time.Now().UTC(), Status: "failed"}
+	// secret files are read on every run to pick up rotated credentials
+	plan, err := config.ResolveSecrets(j.plan)
+	if err != nil {
+		plan = j.plan
+		err = errors.Wrap(err, "resolving secrets failed")
+		report.Error = redact.Error(err)
+		if err := j.stats.AddDrill(report); err != nil {
+			log.WithField("plan", j.plan.Name).Errorf("Drill report store failed %v", err)
+		}
+	} else {
+		report, err = backup.Drill(job.Context(), plan, j.conf, j.stats)
+	}
+
+	job.Finish(report, err)
+
+	body := backup.DrillSummary(report)
+	if err != nil && job.Cancelled() {
+		status = "cancelled"
+		log.WithField("plan", j.plan.Name).Warn(redact.String(fmt.Sprintf("DRILL CANCELLED: %v", err)))
+	} else if err != nil {
+		status = "500"
+		log.WithField("plan", j.plan.Name).Error(redact.String(fmt.Sprintf("DRILL FAILED: %v", err)))
+		if err := notifier.SendNotification(fmt.Sprintf("DRILL FAILED: %v restore drill failed", j.plan.Name),
+			body, true, plan); err != nil {
+			log.WithField("plan", j.plan.Name).Errorf("Notifier failed %v", err)
+		}
+	} else {
+		log.WithField("plan", j.plan.Name).Infof("Restore drill of %v passed, time to restore %v", report.Archive, report.TimeToRestore)
+		if err := notifier.SendNotification(fmt.Sprintf("%v restore drill passed", j.plan.Name),
+			body, false, plan); err != nil {
+			log.WithField("plan", j.plan.Name).Errorf("Notifier failed %v", err)
+		}
+	}
+
+	j.metrics.Total.WithLabelValues(j.plan.Name, status).Inc()
+	j.metrics.TimeToRestore.WithLabelValues(j.plan.Name, status).Set(report.TimeToRestore.Seconds())
+}
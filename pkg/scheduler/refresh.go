@@ -0,0 +1,105 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
+	"github.com/stefanprodan/mgob/pkg/metrics"
+	"github.com/stefanprodan/mgob/pkg/notifier"
+	"github.com/stefanprodan/mgob/pkg/redact"
+	"github.com/stefanprodan/mgob/pkg/restore"
+)
+
+type refreshJob struct {
+	name    string
+	plan    config.Plan
+	conf    *config.AppConfig
+	modules *config.ModuleConfig
+	stats   *db.StatusStore
+	metrics *metrics.RefreshMetrics
+	cron    *cron.Cron
+	jobs    *jobs.Manager
+}
+
+func (j refreshJob) Run() {
+	log.WithField("plan", j.plan.Name).Infof("Refresh from %v started", j.plan.Refresh.Source)
+	job := j.jobs.Start("refresh", j.plan.Name, "schedule")
+	status := "200"
+	var refreshLog string
+	t1 := time.Now()
+
+	res := restore.RefreshResult{}
+	res.Timestamp = t1.UTC()
+
+	// secret files are read on every run to pick up rotated credentials
+	plan, err := config.ResolveSecrets(j.plan)
+	if err != nil {
+		plan = j.plan
+		err = errors.Wrap(err, "resolving secrets failed")
+	} else {
+		res, err = restore.Refresh(plan, j.conf, j.modules, j.stats, job)
+	}
+	if err != nil && job.Cancelled() {
+		status = "cancelled"
+		refreshLog = redact.String(fmt.Sprintf("REFRESH CANCELLED: %v", err))
+		log.WithField("plan", j.plan.Name).Warn(refreshLog)
+	} else if err != nil {
+		status = "500"
+		refreshLog = redact.String(fmt.Sprintf("REFRESH FAILED: %v", err))
+		log.WithField("plan", j.plan.Name).Error(refreshLog)
+
+		if err := notifier.SendNotification(fmt.Sprintf("REFRESH FAILED: %v refresh from %v failed", j.plan.Name, j.plan.Refresh.Source),
+			redact.Error(err), true, plan); err != nil {
+			log.WithField("plan", j.plan.Name).Errorf("Notifier failed %v", err)
+		}
+	} else {
+		refreshLog = fmt.Sprintf("Refresh from %v finished in %v archive %v, %v documents restored, %v hooks run",
+			res.Source, res.Duration, res.Name, restoredDocuments(res.Collections), len(res.Hooks))
+
+		log.WithField("plan", j.plan.Name).Info(refreshLog)
+		if err := notifier.SendNotification(fmt.Sprintf("%v refresh finished", j.plan.Name),
+			refreshLog, false, plan); err != nil {
+			log.WithField("plan", j.plan.Name).Errorf("Notifier failed %v", err)
+		}
+	}
+
+	job.Finish(res, err)
+
+	j.metrics.Total.WithLabelValues(j.plan.Name, status).Inc()
+	j.metrics.Documents.WithLabelValues(j.plan.Name, status).Set(float64(restoredDocuments(res.Collections)))
+	j.metrics.Latency.WithLabelValues(j.plan.Name, status).Observe(time.Since(t1).Seconds())
+
+	s := &db.Status{
+		LastRun:       &res.Timestamp,
+		LastRunStatus: status,
+		Plan:          j.plan.Name,
+		LastRunLog:    refreshLog,
+	}
+
+	for _, e := range j.cron.Entries() {
+		if job, ok := e.Job.(refreshJob); ok && job.name == j.plan.Name {
+			s.NextRun = e.Next
+			break
+		}
+	}
+
+	log.WithField("plan", j.plan.Name).Infof("Next run at %v", s.NextRun)
+	if err := j.stats.Put(s); err != nil {
+		log.WithField("plan", j.plan.Name).Errorf("Status store failed %v", err)
+	}
+}
+
+func restoredDocuments(collections []restore.CollectionResult) int64 {
+	var n int64
+	for _, c := range collections {
+		n += c.Restored
+	}
+	return n
+}
@@ -12,8 +12,10 @@ import (
 	"github.com/stefanprodan/mgob/pkg/backup"
 	"github.com/stefanprodan/mgob/pkg/config"
 	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/jobs"
 	"github.com/stefanprodan/mgob/pkg/metrics"
 	"github.com/stefanprodan/mgob/pkg/notifier"
+	"github.com/stefanprodan/mgob/pkg/redact"
 )
 
 type Scheduler struct {
@@ -22,17 +24,23 @@ type Scheduler struct {
 	Config  *config.AppConfig
 	Modules *config.ModuleConfig
 	Stats   *db.StatusStore
+	Jobs    *jobs.Manager
 	metrics *metrics.BackupMetrics
+	refresh *metrics.RefreshMetrics
+	drill   *metrics.DrillMetrics
 }
 
-func New(plans []config.Plan, conf *config.AppConfig, modules *config.ModuleConfig, stats *db.StatusStore) *Scheduler {
+func New(plans []config.Plan, conf *config.AppConfig, modules *config.ModuleConfig, stats *db.StatusStore, jobs *jobs.Manager) *Scheduler {
 	s := &Scheduler{
 		Cron:    cron.New(),
 		Plans:   plans,
 		Config:  conf,
 		Modules: modules,
 		Stats:   stats,
+		Jobs:    jobs,
 		metrics: metrics.New("mgob", "scheduler"),
+		refresh: metrics.NewRefresh("mgob", "scheduler"),
+		drill:   metrics.NewDrill("mgob", "scheduler"),
 	}
 
 	return s
@@ -44,7 +52,18 @@ func (s *Scheduler) Start() error {
 		if err != nil {
 			return errors.Wrapf(err, "Invalid cron %v for plan %v", plan.Scheduler.Cron, plan.Name)
 		}
-		s.Cron.Schedule(schedule, backupJob{plan.Name, plan, s.Config, s.Modules, s.Stats, s.metrics, s.Cron})
+		if plan.Refresh != nil {
+			s.Cron.Schedule(schedule, refreshJob{plan.Name, plan, s.Config, s.Modules, s.Stats, s.refresh, s.Cron, s.Jobs})
+			continue
+		}
+		s.Cron.Schedule(schedule, backupJob{plan.Name, plan, s.Config, s.Modules, s.Stats, s.metrics, s.Cron, s.Jobs})
+		if plan.Drill != nil {
+			drillSchedule, err := cron.ParseStandard(plan.Drill.Cron)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid drill cron %v for plan %v", plan.Drill.Cron, plan.Name)
+			}
+			s.Cron.Schedule(drillSchedule, drillJob{plan.Name, plan, s.Config, s.Stats, s.drill, s.Jobs})
+		}
 	}
 
 	s.Cron.AddFunc("0 0 */1 * *", func() {
@@ -61,6 +80,13 @@ func (s *Scheduler) Start() error {
 				NextRun: e.Next,
 			}
 			stats = append(stats, status)
+		case refreshJob:
+			stats = append(stats, &db.Status{
+				Plan:    e.Job.(refreshJob).name,
+				NextRun: e.Next,
+			})
+		case drillJob:
+			log.WithField("plan", e.Job.(drillJob).name).Infof("Next restore drill at %v", e.Next)
 		default:
 			log.Infof("Next tmp cleanup run at %v", e.Next)
 		}
@@ -81,22 +107,50 @@ type backupJob struct {
 	stats   *db.StatusStore
 	metrics *metrics.BackupMetrics
 	cron    *cron.Cron
+	jobs    *jobs.Manager
 }
 
 func (b backupJob) Run() {
 	log.WithField("plan", b.plan.Name).Info("Backup started")
+	job := b.jobs.Start("backup", b.plan.Name, "schedule")
 	status := "200"
 	var backupLog string
 	t1 := time.Now()
 
-	res, err := backup.Run(b.plan, b.conf, b.modules)
+	res := backup.Result{
+		Plan:      b.plan.Name,
+		Timestamp: t1.UTC(),
+		Status:    500,
+	}
+
+	// secret files are read on every run to pick up rotated credentials
+	plan, err := config.ResolveSecrets(b.plan)
 	if err != nil {
+		plan = b.plan
+		err = errors.Wrap(err, "resolving secrets failed")
+	} else {
+		res, err = backup.RunJob(plan, b.conf, b.modules, b.stats, job)
+	}
+	if err != nil && job.Cancelled() {
+		status = "cancelled"
+		backupLog = redact.String(fmt.Sprintf("BACKUP CANCELLED: %v", err))
+		log.WithField("plan", b.plan.Name).Warn(backupLog)
+
+		if err := notifier.SendNotification(fmt.Sprintf("BACKUP CANCELLED: %v backup cancelled", b.plan.Name),
+			backupLog, true, plan); err != nil {
+			log.WithField("plan", b.plan.Name).Errorf("Notifier failed %v", err)
+		}
+	} else if err != nil {
 		status = "500"
-		backupLog = fmt.Sprintf("BACKUP FAILED: %v", err)
+		backupLog = redact.String(fmt.Sprintf("BACKUP FAILED: %v", err))
 		log.WithField("plan", b.plan.Name).Error(backupLog)
 
-		if err := notifier.SendNotification(fmt.Sprintf("BACKUP FAILED: %v backup failed", b.plan.Name),
-			err.Error(), true, b.plan); err != nil {
+		subject := fmt.Sprintf("BACKUP FAILED: %v backup failed", b.plan.Name)
+		var spaceErr *backup.InsufficientSpaceError
+		if errors.As(err, &spaceErr) {
+			subject = fmt.Sprintf("BACKUP FAILED: %v not enough disk space in %v", b.plan.Name, spaceErr.Path)
+		}
+		if err := notifier.SendNotification(subject, err.Error(), true, plan); err != nil {
 			log.WithField("plan", b.plan.Name).Errorf("Notifier failed %v", err)
 		}
 	} else {
@@ -107,11 +161,13 @@ func (b backupJob) Run() {
 		if err := notifier.SendNotification(fmt.Sprintf("%v backup finished", b.plan.Name),
 			fmt.Sprintf("%v Backup finished in %v archive size %v",
 				res.Name, res.Duration, humanize.Bytes(uint64(res.Size))),
-			false, b.plan); err != nil {
+			false, plan); err != nil {
 			log.WithField("plan", b.plan.Name).Errorf("Notifier failed %v", err)
 		}
 	}
 
+	job.Finish(res, err)
+
 	t2 := time.Now()
 	b.metrics.Total.WithLabelValues(b.plan.Name, status).Inc()
 	b.metrics.Size.WithLabelValues(b.plan.Name, status).Set(float64(res.Size))